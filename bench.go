@@ -0,0 +1,232 @@
+// bench.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchPhases are what "minictr bench" reports, in the order of a run: the
+// runtime's own trace spans, with workload for the time between the
+// container being started and the runtime seeing it exit, and total for the
+// whole run as a process, from exec to exit.
+var benchPhases = []string{"setup", "create", "start", "workload", "cleanup", "total"}
+
+// benchRun is what one run of the benchmark measured.
+type benchRun struct {
+	phases map[string]time.Duration
+	err    error
+	stderr []byte
+}
+
+// runBench implements "minictr bench [flags] -- RUN-FLAGS... COMMAND...": it
+// runs the container that many times, some at once if asked, and reports
+// the latency of each phase of a run. The phases come from the runs' own
+// traces, which go to a receiver of ours on the loopback instead of any
+// OTLP collector in the environment.
+func runBench(args []string) error {
+	benchCmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := benchCmd.Int("n", 20, "How many containers to run")
+	concurrency := benchCmd.Int("c", 1, "How many to run at once")
+	asJSON := benchCmd.Bool("json", false, "Print the results as JSON, in nanoseconds, e.g. to compare across builds")
+	benchCmd.Parse(args)
+	runArgs := benchCmd.Args()
+	if len(runArgs) == 0 {
+		return fmt.Errorf("usage: minictr bench [flags] -- --rootfs DIR [run flags] COMMAND...")
+	}
+	if *n < 1 || *concurrency < 1 {
+		return fmt.Errorf("-n and -c need to be at least 1")
+	}
+
+	// 1) A receiver for the runs' traces, keyed by trace ID
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	spans := make(map[string]map[string][2]time.Time)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID           string `json:"traceId"`
+						Name              string `json:"name"`
+						StartTimeUnixNano string `json:"startTimeUnixNano"`
+						EndTimeUnixNano   string `json:"endTimeUnixNano"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					start, _ := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+					end, _ := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+					if spans[s.TraceID] == nil {
+						spans[s.TraceID] = make(map[string][2]time.Time)
+					}
+					spans[s.TraceID][s.Name] = [2]time.Time{time.Unix(0, start), time.Unix(0, end)}
+				}
+			}
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	env := []string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT=http://" + ln.Addr().String() + "/v1/traces"}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "OTEL_") && !strings.HasPrefix(kv, "TRACEPARENT=") {
+			env = append(env, kv)
+		}
+	}
+
+	// 2) The runs, each as its own trace
+	runs := make([]benchRun, *n)
+	slots := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	began := time.Now()
+	for i := range runs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(r *benchRun) {
+			defer func() { <-slots; wg.Done() }()
+			var traceID [16]byte
+			var parentID [8]byte
+			rand.Read(traceID[:])
+			rand.Read(parentID[:])
+			cmd := exec.Command("/proc/self/exe", runArgs...)
+			cmd.Args[0] = os.Args[0]
+			cmd.Env = append(env[:len(env):len(env)], fmt.Sprintf("TRACEPARENT=00-%x-%x-01", traceID, parentID))
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			start := time.Now()
+			r.err = cmd.Run()
+			total := time.Since(start)
+			r.stderr = stderr.Bytes()
+
+			mu.Lock()
+			s := spans[hex.EncodeToString(traceID[:])]
+			mu.Unlock()
+			if s == nil {
+				r.err = fmt.Errorf("no trace from the run (%v)", r.err)
+				return
+			}
+			r.phases = map[string]time.Duration{"total": total}
+			for _, name := range []string{"setup", "create", "start", "cleanup"} {
+				if t, ok := s[name]; ok {
+					r.phases[name] = t[1].Sub(t[0])
+				}
+			}
+			if st, ok := s["start"]; ok {
+				if c, ok := s["cleanup"]; ok {
+					r.phases["workload"] = c[0].Sub(st[1])
+				}
+			}
+		}(&runs[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(began)
+
+	// 3) The percentiles of each phase, over the runs that got that far
+	failed, nonzero := 0, 0
+	var firstFailure, firstNonzero *benchRun
+	samples := make(map[string][]time.Duration)
+	for i := range runs {
+		r := &runs[i]
+		if _, started := r.phases["start"]; !started {
+			failed++
+			if firstFailure == nil {
+				firstFailure = r
+			}
+			continue
+		}
+		if r.err != nil {
+			nonzero++
+			if firstNonzero == nil {
+				firstNonzero = r
+			}
+		}
+		for name, d := range r.phases {
+			samples[name] = append(samples[name], d)
+		}
+	}
+	if failed == len(runs) {
+		return fmt.Errorf("every run failed; the first: %v: %s", firstFailure.err, lastLine(firstFailure.stderr))
+	}
+	if firstFailure != nil {
+		logWarnf("%d of %d runs failed to start a container; the first: %v: %s", failed, len(runs), firstFailure.err, lastLine(firstFailure.stderr))
+	}
+	if firstNonzero != nil {
+		logWarnf("%d of %d runs exited non-zero; the first: %v: %s", nonzero, len(runs), firstNonzero.err, lastLine(firstNonzero.stderr))
+	}
+	type stats struct {
+		P50 time.Duration `json:"p50"`
+		P95 time.Duration `json:"p95"`
+		P99 time.Duration `json:"p99"`
+		Max time.Duration `json:"max"`
+	}
+	results := make(map[string]stats)
+	for name, ds := range samples {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		results[name] = stats{percentile(ds, 50), percentile(ds, 95), percentile(ds, 99), ds[len(ds)-1]}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{
+			"runs": len(runs), "concurrency": *concurrency, "failed": failed, "nonzero": nonzero,
+			"elapsed": elapsed, "phases": results,
+		})
+	}
+	fmt.Printf("%d runs, %d at a time, in %s (%.1f/s): %d failed, %d exited non-zero\n",
+		len(runs), *concurrency, elapsed.Round(time.Millisecond), float64(len(runs))/elapsed.Seconds(), failed, nonzero)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tP50\tP95\tP99\tMAX")
+	for _, name := range benchPhases {
+		if s, ok := results[name]; ok {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, formatLatency(s.P50), formatLatency(s.P95), formatLatency(s.P99), formatLatency(s.Max))
+		}
+	}
+	return w.Flush()
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted ds.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+}
+
+// lastLine returns the last line of a run's stderr, which says why it failed.
+func lastLine(b []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	return lines[len(lines)-1]
+}
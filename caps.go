@@ -0,0 +1,246 @@
+// caps.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Capability numbers (linux/capability.h).
+const (
+	CAP_CHOWN              = 0
+	CAP_DAC_OVERRIDE       = 1
+	CAP_DAC_READ_SEARCH    = 2
+	CAP_FOWNER             = 3
+	CAP_FSETID             = 4
+	CAP_KILL               = 5
+	CAP_SETGID             = 6
+	CAP_SETUID             = 7
+	CAP_SETPCAP            = 8
+	CAP_LINUX_IMMUTABLE    = 9
+	CAP_NET_BIND_SERVICE   = 10
+	CAP_NET_BROADCAST      = 11
+	CAP_NET_ADMIN          = 12
+	CAP_NET_RAW            = 13
+	CAP_IPC_LOCK           = 14
+	CAP_IPC_OWNER          = 15
+	CAP_SYS_MODULE         = 16
+	CAP_SYS_RAWIO          = 17
+	CAP_SYS_CHROOT         = 18
+	CAP_SYS_PTRACE         = 19
+	CAP_SYS_PACCT          = 20
+	CAP_SYS_ADMIN          = 21
+	CAP_SYS_BOOT           = 22
+	CAP_SYS_NICE           = 23
+	CAP_SYS_RESOURCE       = 24
+	CAP_SYS_TIME           = 25
+	CAP_SYS_TTY_CONFIG     = 26
+	CAP_MKNOD              = 27
+	CAP_LEASE              = 28
+	CAP_AUDIT_WRITE        = 29
+	CAP_AUDIT_CONTROL      = 30
+	CAP_SETFCAP            = 31
+	CAP_MAC_OVERRIDE       = 32
+	CAP_MAC_ADMIN          = 33
+	CAP_SYSLOG             = 34
+	CAP_WAKE_ALARM         = 35
+	CAP_BLOCK_SUSPEND      = 36
+	CAP_AUDIT_READ         = 37
+	CAP_PERFMON            = 38
+	CAP_BPF                = 39
+	CAP_CHECKPOINT_RESTORE = 40
+
+	PR_CAPBSET_DROP          = 24
+	PR_SET_NO_NEW_PRIVS      = 38
+	PR_CAP_AMBIENT           = 47
+	PR_CAP_AMBIENT_CLEAR_ALL = 4
+
+	_LINUX_CAPABILITY_VERSION_3 = 0x20080522
+)
+
+// capabilities maps --cap-add/--cap-drop names, without the CAP_ prefix,
+// onto capability numbers.
+var capabilities = map[string]int{
+	"CHOWN":              CAP_CHOWN,
+	"DAC_OVERRIDE":       CAP_DAC_OVERRIDE,
+	"DAC_READ_SEARCH":    CAP_DAC_READ_SEARCH,
+	"FOWNER":             CAP_FOWNER,
+	"FSETID":             CAP_FSETID,
+	"KILL":               CAP_KILL,
+	"SETGID":             CAP_SETGID,
+	"SETUID":             CAP_SETUID,
+	"SETPCAP":            CAP_SETPCAP,
+	"LINUX_IMMUTABLE":    CAP_LINUX_IMMUTABLE,
+	"NET_BIND_SERVICE":   CAP_NET_BIND_SERVICE,
+	"NET_BROADCAST":      CAP_NET_BROADCAST,
+	"NET_ADMIN":          CAP_NET_ADMIN,
+	"NET_RAW":            CAP_NET_RAW,
+	"IPC_LOCK":           CAP_IPC_LOCK,
+	"IPC_OWNER":          CAP_IPC_OWNER,
+	"SYS_MODULE":         CAP_SYS_MODULE,
+	"SYS_RAWIO":          CAP_SYS_RAWIO,
+	"SYS_CHROOT":         CAP_SYS_CHROOT,
+	"SYS_PTRACE":         CAP_SYS_PTRACE,
+	"SYS_PACCT":          CAP_SYS_PACCT,
+	"SYS_ADMIN":          CAP_SYS_ADMIN,
+	"SYS_BOOT":           CAP_SYS_BOOT,
+	"SYS_NICE":           CAP_SYS_NICE,
+	"SYS_RESOURCE":       CAP_SYS_RESOURCE,
+	"SYS_TIME":           CAP_SYS_TIME,
+	"SYS_TTY_CONFIG":     CAP_SYS_TTY_CONFIG,
+	"MKNOD":              CAP_MKNOD,
+	"LEASE":              CAP_LEASE,
+	"AUDIT_WRITE":        CAP_AUDIT_WRITE,
+	"AUDIT_CONTROL":      CAP_AUDIT_CONTROL,
+	"SETFCAP":            CAP_SETFCAP,
+	"MAC_OVERRIDE":       CAP_MAC_OVERRIDE,
+	"MAC_ADMIN":          CAP_MAC_ADMIN,
+	"SYSLOG":             CAP_SYSLOG,
+	"WAKE_ALARM":         CAP_WAKE_ALARM,
+	"BLOCK_SUSPEND":      CAP_BLOCK_SUSPEND,
+	"AUDIT_READ":         CAP_AUDIT_READ,
+	"PERFMON":            CAP_PERFMON,
+	"BPF":                CAP_BPF,
+	"CHECKPOINT_RESTORE": CAP_CHECKPOINT_RESTORE,
+}
+
+// defaultCapabilities is the set a container keeps, the same as Docker's.
+var defaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW", "SETGID",
+	"SETUID", "SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT", "KILL",
+	"AUDIT_WRITE",
+}
+
+// capabilitySet applies --cap-add and --cap-drop to the default set. ALL
+// stands for every capability, so "--cap-drop ALL --cap-add NET_BIND_SERVICE"
+// keeps just that one. The result is sorted by capability number.
+func capabilitySet(add, drop []string) ([]string, error) {
+	normalize := func(names []string) ([]string, bool, error) {
+		var out []string
+		all := false
+		for _, name := range names {
+			name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+			if name == "ALL" {
+				all = true
+				continue
+			}
+			if _, ok := capabilities[name]; !ok {
+				return nil, false, fmt.Errorf("unknown capability %q", name)
+			}
+			out = append(out, name)
+		}
+		return out, all, nil
+	}
+	add, addAll, err := normalize(add)
+	if err != nil {
+		return nil, err
+	}
+	drop, dropAll, err := normalize(drop)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for _, name := range defaultCapabilities {
+		set[name] = true
+	}
+	if addAll {
+		for name := range capabilities {
+			set[name] = true
+		}
+	}
+	if dropAll {
+		set = make(map[string]bool)
+	}
+	for _, name := range add {
+		set[name] = true
+	}
+	for _, name := range drop {
+		delete(set, name)
+	}
+
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return capabilities[names[i]] < capabilities[names[j]] })
+	return names, nil
+}
+
+// lastCapability is the highest capability number the running kernel knows.
+func lastCapability() int {
+	if b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			return n
+		}
+	}
+	return CAP_CHECKPOINT_RESTORE
+}
+
+// allCapabilities lists every capability the kernel knows about.
+func allCapabilities() []uintptr {
+	caps := make([]uintptr, lastCapability()+1)
+	for i := range caps {
+		caps[i] = uintptr(i)
+	}
+	return caps
+}
+
+// applyCapabilities limits the current process to the named capabilities.
+// Everything else leaves the bounding set, so that not even a setuid or
+// file-capability binary gets it back, and the ambient set is cleared so
+// that a non-root workload starts without any.
+func applyCapabilities(names []string) error {
+	// Capabilities belong to a thread; the exec that follows must run on this one
+	runtime.LockOSThread()
+
+	var keep uint64
+	for _, name := range names {
+		c, ok := capabilities[name]
+		if !ok {
+			return fmt.Errorf("unknown capability %q", name)
+		}
+		keep |= 1 << c
+	}
+
+	// 1) Drop from the bounding set first, which itself needs CAP_SETPCAP
+	for c := 0; c <= lastCapability(); c++ {
+		if keep&(1<<c) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_CAPBSET_DROP, uintptr(c), 0); errno != 0 {
+			return fmt.Errorf("drop capability %d from the bounding set: %w", c, errno)
+		}
+	}
+
+	// 2) Clear the ambient set
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, PR_CAP_AMBIENT, PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("clear ambient capabilities: %w", errno)
+	}
+
+	// 3) Reduce the effective and permitted sets and empty the inheritable one.
+	//    Capabilities we don't hold ourselves (ALL on a restricted host) stay off.
+	hdr := struct {
+		Version uint32
+		Pid     int32
+	}{Version: _LINUX_CAPABILITY_VERSION_3}
+	var data [2]struct{ Effective, Permitted, Inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %w", errno)
+	}
+	for i := range data {
+		data[i].Permitted &= uint32(keep >> (32 * i))
+		data[i].Effective = data[i].Permitted
+		data[i].Inheritable = 0
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+	return nil
+}
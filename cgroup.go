@@ -0,0 +1,623 @@
+// cgroup.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupMountpoint = "/sys/fs/cgroup"
+
+	// CGROUP2_SUPER_MAGIC is the statfs f_type of a cgroup2 filesystem.
+	CGROUP2_SUPER_MAGIC = 0x63677270
+
+	// defaultCPUPeriod is the CFS period used for --cpus, in microseconds.
+	defaultCPUPeriod = 100000
+
+	// defaultRTPeriod is the kernel's default cpu.rt_period_us.
+	defaultRTPeriod = 1000000
+
+	// delegatedCgroup is the child of the container cgroup that the
+	// container's processes live in with --delegate-cgroup.
+	delegatedCgroup = "container"
+
+	// --cgroup-manager choices
+	cgroupManagerCgroupfs = "cgroupfs"
+	cgroupManagerSystemd  = "systemd"
+)
+
+// cgroupResources are the limits applied to a container's cgroup.
+// Zero values leave the kernel default in place.
+type cgroupResources struct {
+	Memory     int64  // bytes
+	MemorySwap int64  // memory+swap total in bytes (docker semantics); -1 allows unlimited swap
+	MemoryLow  int64  // soft limit in bytes the container is reclaimed towards under pressure
+	NoOOMKill  bool   // pause instead of OOM killing at the limit (v1 only)
+	CPUQuota   int64  // microseconds of CPU time per CPUPeriod
+	CPUPeriod  int64  // microseconds
+	CPUShares  uint64 // relative weight, v1 scale (2-262144, default 1024)
+	RTRuntime  int64  // realtime microseconds per RTPeriod (v1 only)
+	RTPeriod   int64  // microseconds
+	CpusetCpus string // CPU list, e.g. "0-3,6"
+	CpusetMems string // memory node list, e.g. "0"
+	PidsLimit  int64  // maximum number of tasks (processes and threads)
+	IOThrottle []deviceThrottle
+	Devices    []deviceRule // allow list; everything else is denied when non-empty
+	Extra      []cgroupFile // raw --cgroup-conf writes, applied after everything else
+}
+
+// deviceThrottle is a per-device block IO limit from --device-{read,write}-{bps,iops}.
+// Kind is the io.max key: rbps, wbps, riops or wiops.
+type deviceThrottle struct {
+	Kind         string
+	Major, Minor uint64
+	Rate         uint64
+}
+
+func (t deviceThrottle) String() string {
+	return fmt.Sprintf("%s=%d:%d:%d", t.Kind, t.Major, t.Minor, t.Rate)
+}
+
+// blkioThrottleFiles maps io.max keys onto the cgroup v1 blkio files.
+var blkioThrottleFiles = map[string]string{
+	"rbps":  "blkio.throttle.read_bps_device",
+	"wbps":  "blkio.throttle.write_bps_device",
+	"riops": "blkio.throttle.read_iops_device",
+	"wiops": "blkio.throttle.write_iops_device",
+}
+
+var (
+	cpuListRE       = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+	cgroupFileKeyRE = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_.]+$`)
+)
+
+// cgroupOptions says where and how the container cgroup is created.
+type cgroupOptions struct {
+	Manager string // cgroupManagerCgroupfs or cgroupManagerSystemd
+	Parent  string // relative to the hierarchy root, e.g. "batch.slice"; "" is the root
+	// Delegate runs the container one level below its limits, with every
+	// controller enabled for it, so that it can manage its own subtree (v2 only)
+	Delegate bool
+}
+
+// cgroupFile is a single interface file write, e.g. memory.max = 1073741824.
+type cgroupFile struct {
+	controller string
+	name       string
+	value      string
+}
+
+func (r *cgroupResources) empty() bool {
+	return r.String() == ""
+}
+
+func (r *cgroupResources) String() string {
+	var parts []string
+	if r.Memory > 0 {
+		parts = append(parts, fmt.Sprintf("memory=%d", r.Memory))
+	}
+	if r.MemorySwap != 0 {
+		parts = append(parts, fmt.Sprintf("memory-swap=%d", r.MemorySwap))
+	}
+	if r.MemoryLow > 0 {
+		parts = append(parts, fmt.Sprintf("memory-reservation=%d", r.MemoryLow))
+	}
+	if r.NoOOMKill {
+		parts = append(parts, "oom-kill-disable")
+	}
+	if r.CPUQuota > 0 {
+		parts = append(parts, fmt.Sprintf("cpu-quota=%d/%d", r.CPUQuota, r.CPUPeriod))
+	}
+	if r.CPUShares > 0 {
+		parts = append(parts, fmt.Sprintf("cpu-shares=%d", r.CPUShares))
+	}
+	if r.RTRuntime > 0 {
+		parts = append(parts, fmt.Sprintf("cpu-rt=%d/%d", r.RTRuntime, r.RTPeriod))
+	}
+	if r.CpusetCpus != "" {
+		parts = append(parts, "cpuset-cpus="+r.CpusetCpus)
+	}
+	if r.CpusetMems != "" {
+		parts = append(parts, "cpuset-mems="+r.CpusetMems)
+	}
+	if r.PidsLimit > 0 {
+		parts = append(parts, fmt.Sprintf("pids=%d", r.PidsLimit))
+	}
+	for _, t := range r.IOThrottle {
+		parts = append(parts, t.String())
+	}
+	if len(r.Devices) > 0 {
+		parts = append(parts, fmt.Sprintf("device-rules=%d", len(r.Devices)))
+	}
+	for _, f := range r.Extra {
+		parts = append(parts, fmt.Sprintf("%s=%s", f.name, f.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// v1Files lists the writes for the cgroup v1 controllers, in order, for a
+// cgroup created under parent.
+func (r *cgroupResources) v1Files(parent string) []cgroupFile {
+	var files []cgroupFile
+	if r.Memory > 0 {
+		files = append(files, cgroupFile{"memory", "memory.limit_in_bytes", strconv.FormatInt(r.Memory, 10)})
+	}
+	if r.MemorySwap != 0 {
+		// memsw may never be below limit_in_bytes, so it goes after it
+		files = append(files, cgroupFile{"memory", "memory.memsw.limit_in_bytes", strconv.FormatInt(r.MemorySwap, 10)})
+	}
+	if r.MemoryLow > 0 {
+		files = append(files, cgroupFile{"memory", "memory.soft_limit_in_bytes", strconv.FormatInt(r.MemoryLow, 10)})
+	}
+	if r.NoOOMKill {
+		files = append(files, cgroupFile{"memory", "memory.oom_control", "1"})
+	}
+	if r.CPUQuota > 0 {
+		files = append(files,
+			cgroupFile{"cpu", "cpu.cfs_period_us", strconv.FormatInt(r.CPUPeriod, 10)},
+			cgroupFile{"cpu", "cpu.cfs_quota_us", strconv.FormatInt(r.CPUQuota, 10)},
+		)
+	}
+	if r.CPUShares > 0 {
+		files = append(files, cgroupFile{"cpu", "cpu.shares", strconv.FormatUint(r.CPUShares, 10)})
+	}
+	if r.RTRuntime > 0 {
+		// The runtime is checked against the period, so the period goes first
+		files = append(files,
+			cgroupFile{"cpu", "cpu.rt_period_us", strconv.FormatInt(r.RTPeriod, 10)},
+			cgroupFile{"cpu", "cpu.rt_runtime_us", strconv.FormatInt(r.RTRuntime, 10)},
+		)
+	}
+	if r.CpusetCpus != "" || r.CpusetMems != "" {
+		// A fresh v1 cpuset has empty cpus and mems and refuses tasks, so
+		// whichever one wasn't requested is inherited from the parent
+		cpus, mems := r.CpusetCpus, r.CpusetMems
+		if cpus == "" {
+			cpus = inheritedCpuset(parent, "cpuset.cpus")
+		}
+		if mems == "" {
+			mems = inheritedCpuset(parent, "cpuset.mems")
+		}
+		files = append(files,
+			cgroupFile{"cpuset", "cpuset.cpus", cpus},
+			cgroupFile{"cpuset", "cpuset.mems", mems},
+		)
+	}
+	if r.PidsLimit > 0 {
+		files = append(files, cgroupFile{"pids", "pids.max", strconv.FormatInt(r.PidsLimit, 10)})
+	}
+	for _, t := range r.IOThrottle {
+		files = append(files, cgroupFile{"blkio", blkioThrottleFiles[t.Kind], fmt.Sprintf("%d:%d %d", t.Major, t.Minor, t.Rate)})
+	}
+	if len(r.Devices) > 0 {
+		// Start from deny-all, then open up one rule per write
+		files = append(files, cgroupFile{"devices", "devices.deny", "a"})
+		for _, d := range r.Devices {
+			files = append(files, cgroupFile{"devices", "devices.allow", d.String()})
+		}
+	}
+	return append(files, r.Extra...)
+}
+
+// inheritedCpuset returns the v1 cpuset file that a new cgroup under parent
+// would get, i.e. the value of the closest ancestor that exists and has it set.
+func inheritedCpuset(parent, file string) string {
+	for dir := filepath.Join(cgroupMountpoint, "cpuset", parent); ; dir = filepath.Dir(dir) {
+		if v := readCgroupFile(dir, file); v != "" || dir == filepath.Join(cgroupMountpoint, "cpuset") {
+			return v
+		}
+	}
+}
+
+// v2Files lists the writes for the unified hierarchy, in order.
+func (r *cgroupResources) v2Files() []cgroupFile {
+	var files []cgroupFile
+	if r.Memory > 0 {
+		files = append(files, cgroupFile{"memory", "memory.max", strconv.FormatInt(r.Memory, 10)})
+	}
+	if r.MemorySwap != 0 {
+		// v2 limits swap on its own rather than memory+swap
+		swap := "max"
+		if r.MemorySwap > 0 {
+			swap = strconv.FormatInt(r.MemorySwap-r.Memory, 10)
+		}
+		files = append(files, cgroupFile{"memory", "memory.swap.max", swap})
+	}
+	if r.MemoryLow > 0 {
+		// memory.high throttles and reclaims above the reservation instead of OOM killing
+		files = append(files, cgroupFile{"memory", "memory.high", strconv.FormatInt(r.MemoryLow, 10)})
+	}
+	if r.CPUQuota > 0 {
+		files = append(files, cgroupFile{"cpu", "cpu.max", fmt.Sprintf("%d %d", r.CPUQuota, r.CPUPeriod)})
+	}
+	if r.CPUShares > 0 {
+		files = append(files, cgroupFile{"cpu", "cpu.weight", strconv.FormatUint(sharesToWeight(r.CPUShares), 10)})
+	}
+	if r.CpusetCpus != "" {
+		files = append(files, cgroupFile{"cpuset", "cpuset.cpus", r.CpusetCpus})
+	}
+	if r.CpusetMems != "" {
+		files = append(files, cgroupFile{"cpuset", "cpuset.mems", r.CpusetMems})
+	}
+	if r.PidsLimit > 0 {
+		files = append(files, cgroupFile{"pids", "pids.max", strconv.FormatInt(r.PidsLimit, 10)})
+	}
+	for _, t := range r.IOThrottle {
+		// io.max only updates the keys present on the line
+		files = append(files, cgroupFile{"io", "io.max", fmt.Sprintf("%d:%d %s=%d", t.Major, t.Minor, t.Kind, t.Rate)})
+	}
+	return append(files, r.Extra...)
+}
+
+// sharesToWeight maps v1 cpu.shares [2, 262144] onto v2 cpu.weight [1, 10000].
+func sharesToWeight(shares uint64) uint64 {
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// cgroupUnified reports whether /sys/fs/cgroup is the cgroup v2 unified
+// hierarchy. Hybrid setups, which mount cgroup2 at /sys/fs/cgroup/unified
+// but keep the controllers on v1, report false.
+func cgroupUnified() bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cgroupMountpoint, &st); err != nil {
+		return false
+	}
+	return st.Type == CGROUP2_SUPER_MAGIC
+}
+
+// applyCgroupLimits creates a cgroup for the given PID with the requested limits and moves it there.
+// With the cgroupfs manager, on the unified hierarchy this is /sys/fs/cgroup/<parent>/mini_<pid>;
+// otherwise it falls back to one /sys/fs/cgroup/<controller>/<parent>/mini_<pid> directory per
+// cgroup v1 controller involved. Missing parents are created and left in place afterwards.
+// Requires that the hierarchy is mounted and writable (and that the runtime has permissions).
+// The systemd manager asks systemd for a transient scope instead (see applySystemdScope).
+func applyCgroupLimits(pid int, res *cgroupResources, opts cgroupOptions) error {
+	if opts.Manager == cgroupManagerSystemd {
+		return applySystemdScope(pid, res, opts)
+	}
+	name := filepath.Join(opts.Parent, fmt.Sprintf("mini_%d", pid))
+	if cgroupUnified() {
+		cgroupPath := filepath.Join(cgroupMountpoint, name)
+		if err := applyCgroupV2(cgroupPath, pid, res.v2Files(), res.Devices); err != nil {
+			return err
+		}
+		if opts.Delegate {
+			return delegateCgroup(cgroupPath, pid)
+		}
+		return nil
+	}
+	return applyCgroupV1(name, pid, res.v1Files(opts.Parent))
+}
+
+// cgroupOOMKills returns how many processes the OOM killer has killed in the
+// container's cgroup, from memory.events on v2 or memory.oom_control on v1.
+// It has to be read before removeCgroupLimits. Scopes created by the systemd
+// manager are gone by the time the container exits, so they report 0.
+func cgroupOOMKills(pid int, opts cgroupOptions) int {
+	if opts.Manager == cgroupManagerSystemd {
+		return 0
+	}
+	name := filepath.Join(opts.Parent, fmt.Sprintf("mini_%d", pid))
+	path := filepath.Join(cgroupMountpoint, "memory", name, "memory.oom_control")
+	if cgroupUnified() {
+		path = filepath.Join(cgroupMountpoint, name, "memory.events")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// removeCgroupLimits deletes the cgroup directories applyCgroupLimits created
+// for pid once the container has exited. Anything still attached is killed
+// first, and rmdir is retried while the kernel finishes reaping it.
+func removeCgroupLimits(pid int, opts cgroupOptions) error {
+	if opts.Manager == cgroupManagerSystemd {
+		// systemd garbage-collects the scope once it is empty
+		return nil
+	}
+	name := filepath.Join(opts.Parent, fmt.Sprintf("mini_%d", pid))
+	dirs := []string{filepath.Join(cgroupMountpoint, name)}
+	if !cgroupUnified() {
+		dirs, _ = filepath.Glob(filepath.Join(cgroupMountpoint, "*", name))
+	}
+	for _, dir := range dirs {
+		if err := removeCgroupDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCgroupDir(dir string) error {
+	// Children first, including any hierarchy the container built itself
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := removeCgroupDir(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		for _, p := range strings.Fields(readCgroupFile(dir, "cgroup.procs")) {
+			if straggler, err := strconv.Atoi(p); err == nil {
+				syscall.Kill(straggler, syscall.SIGKILL)
+			}
+		}
+		err := syscall.Rmdir(dir)
+		if err == nil || err == syscall.ENOENT {
+			return nil
+		}
+		if err != syscall.EBUSY || attempt == 100 {
+			return fmt.Errorf("rmdir %q: %w", dir, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func applyCgroupV1(name string, pid int, files []cgroupFile) error {
+	var dirs []string
+	for _, f := range files {
+		cgroupPath := filepath.Join(cgroupMountpoint, f.controller, name)
+		if !contains(dirs, cgroupPath) {
+			hierarchy := filepath.Join(cgroupMountpoint, f.controller)
+			if _, err := os.Stat(hierarchy); err != nil {
+				return fmt.Errorf("%q not found or not accessible: %w", hierarchy, err)
+			}
+			if err := makeCgroupParents(hierarchy, filepath.Dir(name), f.controller == "cpuset"); err != nil {
+				return err
+			}
+			if err := os.Mkdir(cgroupPath, 0755); err != nil {
+				return fmt.Errorf("mkdir %q: %w", cgroupPath, err)
+			}
+			dirs = append(dirs, cgroupPath)
+		}
+		if err := writeCgroupFile(cgroupPath, f.name, f.value); err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyCgroupV2(cgroupPath string, pid int, files []cgroupFile, devices []deviceRule) error {
+	// Controllers must be enabled in every ancestor before the child gets its interface files
+	var controllers []string
+	for _, f := range files {
+		// cgroup.* core files exist without enabling anything
+		if f.controller != "cgroup" && !contains(controllers, f.controller) {
+			controllers = append(controllers, f.controller)
+		}
+	}
+	parent := filepath.Dir(cgroupPath)
+	rel, _ := filepath.Rel(cgroupMountpoint, parent)
+	if err := makeCgroupParents(cgroupMountpoint, rel, false); err != nil {
+		return err
+	}
+	ancestors := []string{}
+	for dir := parent; dir != cgroupMountpoint && dir != "/"; dir = filepath.Dir(dir) {
+		ancestors = append([]string{dir}, ancestors...)
+	}
+	for _, dir := range append([]string{cgroupMountpoint}, ancestors...) {
+		if err := enableControllers(dir, controllers...); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(cgroupPath, 0755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", cgroupPath, err)
+	}
+	if err := configureCgroupV2(cgroupPath, files, devices); err != nil {
+		return err
+	}
+	return writeCgroupFile(cgroupPath, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// configureCgroupV2 writes the interface files of an existing cgroup v2 directory.
+func configureCgroupV2(cgroupPath string, files []cgroupFile, devices []deviceRule) error {
+	for _, f := range files {
+		if err := writeCgroupFile(cgroupPath, f.name, f.value); err != nil {
+			return err
+		}
+	}
+	// v2 has no devices controller; access is checked by an eBPF program instead
+	if len(devices) > 0 {
+		if err := attachDeviceFilter(cgroupPath, devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delegateCgroup moves pid from cgroupPath into a delegatedCgroup child and
+// enables every controller available in cgroupPath for it. The container can
+// then create cgroups of its own below the child, while the limits written to
+// cgroupPath stay out of its reach. The move comes first because a cgroup
+// with processes in it can't enable controllers for its children.
+func delegateCgroup(cgroupPath string, pid int) error {
+	child := filepath.Join(cgroupPath, delegatedCgroup)
+	if err := os.Mkdir(child, 0755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", child, err)
+	}
+	if err := writeCgroupFile(child, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+	return enableControllers(cgroupPath, strings.Fields(readCgroupFile(cgroupPath, "cgroup.controllers"))...)
+}
+
+// enterCgroupNamespace is called by containerInit once it has been placed in its
+// cgroup. It unshares a cgroup namespace rooted there and mounts it read-write
+// at /sys/fs/cgroup. Namespaces belong to the calling thread, so the thread
+// stays locked and the exec that follows has to happen on it.
+func enterCgroupNamespace() error {
+	runtime.LockOSThread()
+	if err := syscall.Unshare(CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("unshare cgroup namespace: %w", err)
+	}
+	if err := os.MkdirAll(cgroupMountpoint, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("cgroup2", cgroupMountpoint, "cgroup2", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount cgroup2 on %s: %w", cgroupMountpoint, err)
+	}
+	return nil
+}
+
+// makeCgroupParents creates the directories of parent below root that don't
+// exist yet. A new v1 cpuset refuses tasks until its cpus and mems are set, so
+// with copyCpuset those are inherited from each level's own parent.
+func makeCgroupParents(root, parent string, copyCpuset bool) error {
+	dir := root
+	for _, elem := range strings.Split(parent, "/") {
+		if elem == "." || elem == "" {
+			continue
+		}
+		up := dir
+		dir = filepath.Join(dir, elem)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return fmt.Errorf("mkdir %q: %w", dir, err)
+		}
+		if copyCpuset {
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				if err := writeCgroupFile(dir, file, readCgroupFile(up, file)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// enableControllers turns on the given cgroup v2 controllers in dir's cgroup.subtree_control.
+func enableControllers(dir string, controllers ...string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("read %q: %w", filepath.Join(dir, "cgroup.controllers"), err)
+	}
+	available := strings.Fields(string(data))
+	for _, c := range controllers {
+		if !contains(available, c) {
+			return fmt.Errorf("cgroup v2 controller %q not available in %q", c, dir)
+		}
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	path := filepath.Join(dir, file)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("write %q: %w", path, err)
+	}
+	return nil
+}
+
+// readCgroupFile returns the trimmed contents of an interface file, or "" if it can't be read.
+func readCgroupFile(dir, file string) string {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// parseCgroupConf parses a --cgroup-conf key=value, e.g. memory.swap.max=0 or
+// io.weight=50. The file goes to the controller named by the key's prefix.
+func parseCgroupConf(s string) (cgroupFile, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !cgroupFileKeyRE.MatchString(key) {
+		return cgroupFile{}, fmt.Errorf("invalid cgroup setting %q (want controller.file=value)", s)
+	}
+	controller, _, _ := strings.Cut(key, ".")
+	switch {
+	case key == "cgroup.procs" || key == "cgroup.threads" || key == "cgroup.kill" ||
+		key == "cgroup.freeze" || key == "cgroup.subtree_control" || key == "cgroup.type":
+		return cgroupFile{}, fmt.Errorf("%s is managed by the runtime", key)
+	case controller == "devices":
+		// Written after the device rules, these would undo them
+		return cgroupFile{}, fmt.Errorf("%s is set by --device-cgroup-rule", key)
+	case controller == "cgroup" && !cgroupUnified():
+		return cgroupFile{}, fmt.Errorf("%s only exists on cgroup v2", key)
+	}
+	return cgroupFile{controller, key, value}, nil
+}
+
+// parseCPUs converts a --cpus value such as "1.5" into a CFS quota for defaultCPUPeriod.
+func parseCPUs(s string) (int64, error) {
+	cpus, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse number from %q: %w", s, err)
+	}
+	quota := int64(cpus * defaultCPUPeriod)
+	if quota < 1000 {
+		return 0, fmt.Errorf("--cpus %q too small (minimum 0.01)", s)
+	}
+	return quota, nil
+}
+
+// parseDeviceThrottle parses a path:rate spec such as "/dev/sda:10m" for the
+// given io.max key. Byte rates accept the --mem suffixes; IOPS are plain counts.
+func parseDeviceThrottle(kind, spec string) (deviceThrottle, error) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 || i == len(spec)-1 {
+		return deviceThrottle{}, fmt.Errorf("invalid device limit %q (want path:rate)", spec)
+	}
+	path, rateStr := spec[:i], spec[i+1:]
+
+	var rate uint64
+	if strings.HasSuffix(kind, "bps") {
+		bytes, err := parseMemLimit(rateStr)
+		if err != nil {
+			return deviceThrottle{}, err
+		}
+		rate = uint64(bytes)
+	} else {
+		var err error
+		if rate, err = strconv.ParseUint(rateStr, 10, 64); err != nil {
+			return deviceThrottle{}, fmt.Errorf("parse integer from %q: %w", rateStr, err)
+		}
+	}
+	if rate == 0 {
+		return deviceThrottle{}, fmt.Errorf("rate in %q must be positive", spec)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return deviceThrottle{}, fmt.Errorf("stat %q: %w", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return deviceThrottle{}, fmt.Errorf("%q is not a block device", path)
+	}
+	// Same split as the kernel's new_decode_dev()
+	rdev := uint64(st.Rdev)
+	return deviceThrottle{
+		Kind:  kind,
+		Major: (rdev>>8)&0xfff | (rdev>>32)&^0xfff,
+		Minor: rdev&0xff | (rdev>>12)&^0xff,
+		Rate:  rate,
+	}, nil
+}
@@ -0,0 +1,134 @@
+// cgroup_systemd.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scopeTimeout bounds how long we wait for systemd to move the container into its scope.
+const scopeTimeout = 5 * time.Second
+
+// applySystemdScope asks systemd, over D-Bus, for a transient minictr-<pid>.scope
+// holding the container and then writes the limits into the scope's cgroup.
+// The scope is created with Delegate=yes, which hands that subtree to us, so
+// systemd won't later reset what we wrote; it is removed by systemd once the
+// container's processes are gone. Unprivileged runs use the user's own manager,
+// which works in delegated user sessions. A --cgroup-parent slice places the
+// scope in that slice instead of the manager's default.
+func applySystemdScope(pid int, res *cgroupResources, opts cgroupOptions) error {
+	unit := fmt.Sprintf("minictr-%d.scope", pid)
+	if err := startTransientScope(unit, pid, opts.Parent); err != nil {
+		return err
+	}
+	paths, err := waitForScope(pid, unit)
+	if err != nil {
+		return err
+	}
+
+	if cgroupUnified() {
+		scope := filepath.Join(cgroupMountpoint, paths[""])
+		if err := configureCgroupV2(scope, res.v2Files(), res.Devices); err != nil {
+			return err
+		}
+		if opts.Delegate {
+			return delegateCgroup(scope, pid)
+		}
+		return nil
+	}
+	for _, f := range res.v1Files(filepath.Dir(paths["cpuset"])) {
+		path, ok := paths[f.controller]
+		if !ok || filepath.Base(path) != unit {
+			return fmt.Errorf("systemd did not delegate the %s controller to %s", f.controller, unit)
+		}
+		if err := writeCgroupFile(filepath.Join(cgroupMountpoint, f.controller, path), f.name, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startTransientScope calls org.freedesktop.systemd1.Manager.StartTransientUnit
+// through busctl to create unit around pid.
+func startTransientScope(unit string, pid int, slice string) error {
+	props := []string{
+		"Description", "s", fmt.Sprintf("minictr container %d", pid),
+		"PIDs", "au", "1", strconv.Itoa(pid),
+		"Delegate", "b", "true",
+	}
+	if slice != "" {
+		props = append(props, "Slice", "s", slice)
+	}
+
+	args := []string{}
+	if os.Geteuid() != 0 {
+		args = append(args, "--user")
+	}
+	args = append(args, "call",
+		"org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager",
+		"StartTransientUnit", "ssa(sv)a(sa(sv))", unit, "fail",
+		strconv.Itoa(len(props)/3),
+	)
+	args = append(args, props...)
+	args = append(args, "0")
+	out, err := exec.Command("busctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("busctl StartTransientUnit %s: %v: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// waitForScope polls until pid shows up in unit, as StartTransientUnit only
+// queues a job, and returns the resulting cgroup paths.
+func waitForScope(pid int, unit string) (map[string]string, error) {
+	deadline := time.Now().Add(scopeTimeout)
+	for {
+		paths, err := procCgroups(pid)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if filepath.Base(path) == unit {
+				return paths, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for PID %d to join %s", pid, unit)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// procCgroups parses /proc/<pid>/cgroup into controller -> path. The unified
+// hierarchy is keyed by "" and named v1 hierarchies by e.g. "name=systemd".
+func procCgroups(pid int) (map[string]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			paths[c] = parts[2]
+		}
+	}
+	return paths, scanner.Err()
+}
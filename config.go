@@ -0,0 +1,88 @@
+// config.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// initConfig is everything the container init needs to know from the
+// runtime. It goes over a pipe as JSON rather than through the environment,
+// which the workload would otherwise inherit and which limits its size.
+type initConfig struct {
+	Rootfs   string
+	Hostname string
+	// Env is the workload's environment, from --env and --env-file
+	Env []string
+
+	// Descriptors the child inherits: the socket activation sockets from
+	// SD_LISTEN_FDS_START, then the sync pipe and the seccomp socket
+	ListenFds       int
+	ListenFdNames   string
+	SyncFd          int
+	SeccompNotifyFd int `json:",omitempty"`
+
+	Rlimits     []string `json:",omitempty"` // parseUlimit specs
+	OOMScoreAdj int      `json:",omitempty"`
+	SchedPolicy string   `json:",omitempty"` // policy:priority
+	Nice        int      `json:",omitempty"`
+	IOPrio      *int     `json:",omitempty"`
+	Sysctls     []string `json:",omitempty"` // key=value
+	Secrets     []secret `json:",omitempty"`
+
+	CgroupNS     bool                 `json:",omitempty"`
+	Privileged   bool                 `json:",omitempty"`
+	AppArmor     string               `json:",omitempty"`
+	SELinuxLabel string               `json:",omitempty"`
+	Landlock     bool                 `json:",omitempty"`
+	Seccomp      []syscall.SockFilter `json:",omitempty"`
+	NoNewPrivs   bool                 `json:",omitempty"`
+	User         string               `json:",omitempty"` // --user spec
+	Caps         []string
+	Umask        int
+	Init         bool         `json:",omitempty"` // run the workload under runReaper
+	WaitOrphans  bool         `json:",omitempty"`
+	Health       *healthCheck `json:",omitempty"`
+	HealthFd     int          `json:",omitempty"` // where the reaper reports health
+	DialFd       int          `json:",omitempty"` // where the reaper takes --publish connections
+	Pod          []podProcess `json:",omitempty"` // --pod processes, run instead of the command
+	Cores        *coresMount  `json:",omitempty"`
+	NotifyDir    string       `json:",omitempty"` // where the sd_notify proxy listens
+	// The container-side hooks, and our PID as the runtime sees it for their
+	// state and our logs
+	Hooks *ociHooks `json:",omitempty"`
+	Pid   int       `json:",omitempty"`
+}
+
+// sendInitConfig writes the config to the pipe the child reads INITPIPE from.
+func sendInitConfig(w *os.File, cfg *initConfig) error {
+	defer w.Close()
+	return json.NewEncoder(w).Encode(cfg)
+}
+
+// initPipe returns the pipe in INITPIPE.
+func initPipe() (*os.File, error) {
+	fd, err := strconv.Atoi(os.Getenv("INITPIPE"))
+	if err != nil {
+		return nil, fmt.Errorf("INITPIPE not set")
+	}
+	return os.NewFile(uintptr(fd), "init"), nil
+}
+
+// readInitConfig reads the config from INITPIPE and closes it.
+func readInitConfig() (*initConfig, error) {
+	pipe, err := initPipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pipe.Close()
+	var cfg initConfig
+	if err := json.NewDecoder(pipe).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("read init config: %w", err)
+	}
+	os.Unsetenv("INITPIPE")
+	return &cfg, nil
+}
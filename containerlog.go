@@ -0,0 +1,688 @@
+// containerlog.go
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxLogLine is the longest line a record holds; longer ones are split,
+	// as docker does.
+	maxLogLine = 16 * 1024
+	// maxLogRecord bounds a record joined from lines by multiline-pattern.
+	maxLogRecord = 1024 * 1024
+	// multilineTimeout is how long a joined record waits for another line
+	// before it goes to the driver; --log-opt multiline-timeout changes it.
+	multilineTimeout = time.Second
+)
+
+// logsDir holds the json-file driver's logs and --record-tty's recordings,
+// under the config's storage-root.
+var logsDir = filepath.Join(defaultStorageRoot, "logs")
+
+// logRecord is one line of the container's output.
+type logRecord struct {
+	Stream string // stdout or stderr
+	Line   []byte // with its newline, unless it was cut short
+	Time   time.Time
+}
+
+// logDriver stores or ships the container's output. open is called once the
+// container has its PID, before the first record.
+type logDriver interface {
+	open(pid int) error
+	write(r logRecord) error
+	close() error
+}
+
+// logOptions are the --log-opt key=value pairs. Drivers take the ones they
+// know, and any left over is an error.
+type logOptions map[string]string
+
+func parseLogOptions(opts []string) (logOptions, error) {
+	o := make(logOptions)
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not key=value", opt)
+		}
+		o[key] = value
+	}
+	return o, nil
+}
+
+// take returns the option and forgets it.
+func (o logOptions) take(key string) string {
+	v := o[key]
+	delete(o, key)
+	return v
+}
+
+func (o logOptions) check(driver string) error {
+	for key := range o {
+		return fmt.Errorf("the %s driver has no option %q", driver, key)
+	}
+	return nil
+}
+
+// containerLog captures the container's stdout and stderr through pipes and
+// hands them line by line to a --log-driver. A copy still goes to our own
+// stdout and stderr, as the run is in the foreground. A nil containerLog
+// leaves the container writing to them directly.
+//
+// With --log-opt multiline-pattern, a line that doesn't match it continues
+// the record before it, so that e.g. a stack trace is one record.
+type containerLog struct {
+	driver         string
+	d              logDriver
+	stdout, stderr *os.File // the container's ends
+	readers        [2]*os.File
+	copies         sync.WaitGroup
+
+	multiline        *regexp.Regexp
+	multilineTimeout time.Duration
+
+	mu      sync.Mutex
+	failed  bool
+	pending map[string]*logRecord // by stream, for multiline
+	timers  map[string]*time.Timer
+}
+
+// newContainerLog sets up the named driver with its options, or returns nil for
+// no driver. name is what drivers that label records call the container.
+func newContainerLog(driver string, opts []string, name string) (*containerLog, error) {
+	o, err := parseLogOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	var d logDriver
+	switch driver {
+	case "":
+		if len(o) > 0 {
+			return nil, fmt.Errorf("--log-opt needs a --log-driver")
+		}
+		return nil, nil
+	case "json-file":
+		d, err = newJSONFileLog(o)
+	case "journald":
+		d, err = newJournaldLog(o, name)
+	case "syslog":
+		d, err = newSyslogLog(o, name)
+	case "fluentd":
+		d, err = newFluentdLog(o, name)
+	case "loki":
+		d, err = newLokiLog(o, name)
+	default:
+		return nil, fmt.Errorf("unknown --log-driver %q (want json-file, journald, syslog, fluentd or loki)", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &containerLog{driver: driver, d: d, multilineTimeout: multilineTimeout,
+		pending: make(map[string]*logRecord), timers: make(map[string]*time.Timer)}
+	if s := o.take("multiline-pattern"); s != "" {
+		if l.multiline, err = regexp.Compile(s); err != nil {
+			return nil, fmt.Errorf("invalid multiline-pattern: %v", err)
+		}
+	}
+	if s := o.take("multiline-timeout"); s != "" {
+		if l.multilineTimeout, err = time.ParseDuration(s); err != nil || l.multilineTimeout <= 0 || l.multiline == nil {
+			return nil, fmt.Errorf("invalid multiline-timeout %q (want a duration, with multiline-pattern)", s)
+		}
+	}
+	if err := o.check(driver); err != nil {
+		return nil, err
+	}
+	if l.readers[0], l.stdout, err = os.Pipe(); err != nil {
+		return nil, err
+	}
+	if l.readers[1], l.stderr, err = os.Pipe(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// start opens the driver for the container and begins copying its output.
+func (l *containerLog) start(pid int) error {
+	if l == nil {
+		return nil
+	}
+	l.stdout.Close()
+	l.stderr.Close()
+	if err := l.d.open(pid); err != nil {
+		return fmt.Errorf("%s log driver: %w", l.driver, err)
+	}
+	l.copies.Add(2)
+	go l.copy("stdout", l.readers[0], os.Stdout)
+	go l.copy("stderr", l.readers[1], os.Stderr)
+	return nil
+}
+
+// copy passes what the container writes to tee as it comes, and to the
+// driver a line at a time.
+func (l *containerLog) copy(stream string, r, tee *os.File) {
+	defer l.copies.Done()
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	var line []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			tee.Write(buf[:n])
+			line = append(line, buf[:n]...)
+			for {
+				i := bytes.IndexByte(line, '\n')
+				if i < 0 && len(line) < maxLogLine {
+					break
+				}
+				if i < 0 || i >= maxLogLine {
+					i = maxLogLine - 1
+				}
+				l.add(logRecord{Stream: stream, Line: append([]byte(nil), line[:i+1]...), Time: time.Now()})
+				line = line[i+1:]
+			}
+		}
+		if err != nil {
+			if len(line) > 0 {
+				l.add(logRecord{Stream: stream, Line: line, Time: time.Now()})
+			}
+			l.mu.Lock()
+			l.flushLocked(stream)
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// add passes a line to the driver, or with multiline-pattern joins it to
+// the record it continues, holding that back until a line starts the next
+// record or multilineTimeout passes.
+func (l *containerLog) add(r logRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.multiline == nil {
+		l.writeLocked(r)
+		return
+	}
+	p := l.pending[r.Stream]
+	if p != nil && !l.multiline.Match(r.Line) && len(p.Line)+len(r.Line) <= maxLogRecord {
+		p.Line = append(p.Line, r.Line...)
+	} else {
+		l.flushLocked(r.Stream)
+		l.pending[r.Stream] = &r
+	}
+	if t := l.timers[r.Stream]; t != nil {
+		t.Stop()
+	}
+	p = l.pending[r.Stream]
+	l.timers[r.Stream] = time.AfterFunc(l.multilineTimeout, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// A timer stopped too late finds another record, or none
+		if l.pending[r.Stream] == p {
+			l.flushLocked(r.Stream)
+		}
+	})
+}
+
+// flushLocked writes the stream's pending record, if there is one.
+func (l *containerLog) flushLocked(stream string) {
+	if t := l.timers[stream]; t != nil {
+		t.Stop()
+		delete(l.timers, stream)
+	}
+	if p := l.pending[stream]; p != nil {
+		delete(l.pending, stream)
+		l.writeLocked(*p)
+	}
+}
+
+func (l *containerLog) writeLocked(r logRecord) {
+	if err := l.d.write(r); err != nil && !l.failed {
+		// Once is enough; the container's output still reaches our stdio
+		l.failed = true
+		logWarnf("%s log driver: %v", l.driver, err)
+	}
+}
+
+// close waits for the container's output to run out, which it does once
+// every process in it has exited, and closes the driver.
+func (l *containerLog) close() {
+	if l == nil {
+		return
+	}
+	l.copies.Wait()
+	if err := l.d.close(); err != nil {
+		logWarnf("%s log driver: %v", l.driver, err)
+	}
+}
+
+// jsonFileLog writes docker's json-file format, one
+// {"log":...,"stream":...,"time":...} object per line, rotating the file
+// at max-size and keeping max-file files in all.
+type jsonFileLog struct {
+	path     string // "" for <logsDir>/<pid>-json.log
+	maxSize  int64  // 0 means no rotation
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newJSONFileLog(o logOptions) (*jsonFileLog, error) {
+	j := &jsonFileLog{path: o.take("path"), maxFiles: 1}
+	if s := o.take("max-size"); s != "" {
+		n, err := parseMemLimit(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid max-size %q", s)
+		}
+		j.maxSize = n
+	}
+	if s := o.take("max-file"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid max-file %q (want a number of files, at least 1)", s)
+		}
+		if j.maxSize == 0 {
+			return nil, fmt.Errorf("max-file needs max-size")
+		}
+		j.maxFiles = n
+	}
+	if j.path != "" && !filepath.IsAbs(j.path) {
+		return nil, fmt.Errorf("path %q is not absolute", j.path)
+	}
+	return j, nil
+}
+
+// jsonLogPath is where the json-file driver logs pid's output by default. A
+// log left by an earlier container with the same PID is overwritten.
+func jsonLogPath(pid int) string {
+	return filepath.Join(logsDir, fmt.Sprintf("%d-json.log", pid))
+}
+
+func (j *jsonFileLog) open(pid int) error {
+	if j.path == "" {
+		j.path = jsonLogPath(pid)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	f, err := j.create()
+	if err != nil {
+		return err
+	}
+	j.f = f
+	logInfof("logging the container's output to %s", j.path)
+	return nil
+}
+
+// create puts a new file at path, locked for as long as it is written to.
+// "minictr logs --follow" takes a file it has read to the end that isn't
+// locked as the end of the log, so the lock is taken before the file gets
+// its name.
+func (j *jsonFileLog) create() (*os.File, error) {
+	tmp := j.path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (j *jsonFileLog) write(r logRecord) error {
+	line, err := json.Marshal(jsonLogEntry{Log: string(r.Line), Stream: r.Stream, Time: r.Time.UTC()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if j.maxSize > 0 && j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, dropping the
+// oldest, and starts path afresh. The old file is let go of only once the
+// new one is in place.
+func (j *jsonFileLog) rotate() error {
+	for i := j.maxFiles - 1; i >= 1; i-- {
+		from := j.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", j.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", j.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	f, err := j.create()
+	if err != nil {
+		return err
+	}
+	j.f.Close()
+	j.f, j.size = f, 0
+	return nil
+}
+
+func (j *jsonFileLog) close() error {
+	return j.f.Close()
+}
+
+// journaldSocket is where journald takes entries in its native protocol.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldLog sends each line to the journal with docker's fields:
+// CONTAINER_ID, CONTAINER_NAME and CONTAINER_TAG, with stderr at priority 3
+// and stdout at 6. The runtime is the sender, so under a unit the entries
+// belong to it for journalctl -u.
+type journaldLog struct {
+	name, tag string
+	pid       int
+	conn      *net.UnixConn
+}
+
+func newJournaldLog(o logOptions, name string) (*journaldLog, error) {
+	j := &journaldLog{name: o.take("name"), tag: o.take("tag")}
+	if j.name == "" {
+		j.name = name
+	}
+	if j.tag == "" {
+		j.tag = j.name
+	}
+	return j, nil
+}
+
+func (j *journaldLog) open(pid int) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	j.pid, j.conn = pid, conn
+	return nil
+}
+
+func (j *journaldLog) write(r logRecord) error {
+	priority := "6"
+	if r.Stream == "stderr" {
+		priority = "3"
+	}
+	msg := bytes.TrimSuffix(r.Line, []byte("\n"))
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", []byte(priority))
+	journalField(&b, "SYSLOG_IDENTIFIER", []byte(j.tag))
+	journalField(&b, "CONTAINER_ID", []byte(strconv.Itoa(j.pid)))
+	journalField(&b, "CONTAINER_NAME", []byte(j.name))
+	journalField(&b, "CONTAINER_TAG", []byte(j.tag))
+	if len(msg) == len(r.Line) {
+		journalField(&b, "CONTAINER_PARTIAL_MESSAGE", []byte("true"))
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField appends a field in the native protocol: KEY=value, or for a
+// value with a newline in it, KEY, its length as 64-bit little endian and
+// the value.
+func journalField(b *bytes.Buffer, key string, value []byte) {
+	if bytes.IndexByte(value, '\n') < 0 {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.Write(value)
+	b.WriteByte('\n')
+}
+
+func (j *journaldLog) close() error {
+	return j.conn.Close()
+}
+
+// syslogDialTimeout bounds connecting to a remote syslog server, and
+// syslogWriteTimeout sending it one line, so that a server that is down or
+// stalls holds up the container's output for no longer than that. After a
+// failure the connection is made again after a pause that doubles each time,
+// up to syslogMaxBackoff, and lines are dropped until then.
+const (
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 2 * time.Second
+	syslogMaxBackoff   = time.Minute
+)
+
+// syslogFacilities are the facility codes by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogLog sends each line to a syslog server, local or remote, in RFC 5424
+// format, or RFC 3164 for older local daemons, with stderr at severity err
+// and stdout at info. Over TCP and TLS messages are octet-counted as RFC 6587
+// and RFC 5425 frame them; a dropped connection is made again right away,
+// then with a backoff.
+type syslogLog struct {
+	network, addr string // unixgram ("" tries unix too), udp, tcp or tls
+	tlsConfig     *tls.Config
+	facility      int
+	format        string
+	tag, host     string
+	pid           int
+	conn          net.Conn
+
+	backoff time.Duration
+	retryAt time.Time
+	dropped int // lines since the connection was lost
+}
+
+func newSyslogLog(o logOptions, name string) (*syslogLog, error) {
+	l := &syslogLog{addr: "/dev/log", facility: syslogFacilities["daemon"], format: "rfc5424", tag: o.take("tag")}
+	if l.tag == "" {
+		l.tag = name
+	}
+
+	// 1) Where to, as unix:///dev/log, udp://host:514, tcp://... or tcp+tls://...
+	if a := o.take("syslog-address"); a != "" {
+		u, err := url.Parse(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog-address %q", a)
+		}
+		switch u.Scheme {
+		case "unix":
+			l.addr = u.Path
+		case "unixgram":
+			l.network, l.addr = "unixgram", u.Path
+		case "udp", "tcp", "tcp+tls":
+			l.network, l.addr = strings.TrimPrefix(u.Scheme, "tcp+"), u.Host
+			if u.Port() == "" {
+				l.addr = net.JoinHostPort(u.Hostname(), "514")
+				if u.Scheme == "tcp+tls" {
+					l.addr = net.JoinHostPort(u.Hostname(), "6514")
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid syslog-address %q (want unix://, unixgram://, udp://, tcp:// or tcp+tls://)", a)
+		}
+		if l.addr == "" {
+			return nil, fmt.Errorf("invalid syslog-address %q", a)
+		}
+	}
+
+	// 2) How to look
+	if f := o.take("syslog-facility"); f != "" {
+		code, ok := syslogFacilities[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog-facility %q", f)
+		}
+		l.facility = code
+	}
+	if f := o.take("syslog-format"); f != "" {
+		if f != "rfc5424" && f != "rfc3164" {
+			return nil, fmt.Errorf("invalid syslog-format %q (want rfc5424 or rfc3164)", f)
+		}
+		l.format = f
+	}
+	l.host, _ = os.Hostname()
+
+	// 3) And for TLS, who to trust and be
+	ca, cert, key := o.take("syslog-tls-ca-cert"), o.take("syslog-tls-cert"), o.take("syslog-tls-key")
+	skipVerify := o.take("syslog-tls-skip-verify")
+	if l.network != "tls" {
+		if ca != "" || cert != "" || key != "" || skipVerify != "" {
+			return nil, fmt.Errorf("the syslog-tls options need a tcp+tls:// syslog-address")
+		}
+		return l, nil
+	}
+	host, _, _ := net.SplitHostPort(l.addr)
+	l.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: skipVerify == "true"}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig.RootCAs = x509.NewCertPool()
+		if !l.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("syslog-tls-ca-cert %s has no certificates", ca)
+		}
+	}
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("syslog-tls-cert and syslog-tls-key go together")
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return l, nil
+}
+
+func (l *syslogLog) open(pid int) error {
+	l.pid = pid
+	return l.dial()
+}
+
+func (l *syslogLog) dial() error {
+	var err error
+	switch l.network {
+	case "":
+		// Local daemons listen on a datagram socket, a few on a stream one
+		if l.conn, err = net.Dial("unixgram", l.addr); err != nil {
+			l.conn, err = net.Dial("unix", l.addr)
+		}
+	case "tls":
+		l.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: syslogDialTimeout}, "tcp", l.addr, l.tlsConfig)
+	default:
+		l.conn, err = net.DialTimeout(l.network, l.addr, syslogDialTimeout)
+	}
+	return err
+}
+
+func (l *syslogLog) write(r logRecord) error {
+	severity := 6
+	if r.Stream == "stderr" {
+		severity = 3
+	}
+	msg := bytes.TrimSuffix(r.Line, []byte("\n"))
+	var b bytes.Buffer
+	if l.format == "rfc3164" {
+		fmt.Fprintf(&b, "<%d>%s %s[%d]: %s", l.facility*8+severity, r.Time.Format(time.Stamp), l.tag, l.pid, msg)
+	} else {
+		fmt.Fprintf(&b, "<%d>1 %s %s %s %d - - %s", l.facility*8+severity, r.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+			syslogHeaderField(l.host), syslogHeaderField(l.tag), l.pid, msg)
+	}
+	data := b.Bytes()
+	if l.network == "tcp" || l.network == "tls" {
+		data = append([]byte(strconv.Itoa(len(data))+" "), data...)
+	}
+	// A connection the server dropped gets one more try at once; one that
+	// timed out, or a new one that fails, waits out the backoff
+	retry := l.conn != nil
+	for {
+		if l.conn == nil {
+			if time.Now().Before(l.retryAt) {
+				l.dropped++
+				return fmt.Errorf("dropping lines until %s can be reached again", l.addr)
+			}
+			if err := l.dial(); err != nil {
+				l.conn = nil
+				l.failed()
+				return err
+			}
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		_, err := l.conn.Write(data)
+		if err == nil {
+			break
+		}
+		l.conn.Close()
+		l.conn = nil
+		if ne, ok := err.(net.Error); !retry || ok && ne.Timeout() {
+			l.failed()
+			return err
+		}
+		retry = false
+	}
+	if l.dropped > 0 {
+		logWarnf("syslog log driver: reached %s again after dropping %d lines", l.addr, l.dropped)
+	}
+	l.backoff, l.dropped = 0, 0
+	return nil
+}
+
+// failed drops the line that couldn't be sent and puts off the next try.
+func (l *syslogLog) failed() {
+	l.dropped++
+	l.backoff = min(max(2*l.backoff, time.Second), syslogMaxBackoff)
+	l.retryAt = time.Now().Add(l.backoff)
+}
+
+// syslogHeaderField makes s fit an RFC 5424 header field: printable ASCII
+// without spaces, or - if nothing is left.
+func syslogHeaderField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *syslogLog) close() error {
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.Close()
+}
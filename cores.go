@@ -0,0 +1,68 @@
+// cores.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultCoresTarget is where --cores goes when core_pattern doesn't name a
+// directory the container could have.
+const defaultCoresTarget = "/cores"
+
+// coresMount is a --cores directory and where in the container it goes.
+type coresMount struct {
+	Source, Target string
+}
+
+// coresTarget works out where in the container core dumps are written.
+// core_pattern isn't namespaced, and the kernel resolves a file pattern in
+// the crashing process's root, so cores go where the host's pattern points
+// if that is a fixed directory. Otherwise warning says why cores won't land
+// in defaultCoresTarget by themselves.
+func coresTarget() (target, warning string) {
+	data, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return defaultCoresTarget, fmt.Sprintf("can't read core_pattern: %v", err)
+	}
+	pattern := strings.TrimSpace(string(data))
+	dir := filepath.Dir(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "|"):
+		helper := "a program"
+		if fields := strings.Fields(pattern[1:]); len(fields) > 0 {
+			helper = fields[0]
+		}
+		return defaultCoresTarget, fmt.Sprintf("core_pattern pipes cores to %s on the host, not to a file", helper)
+	case !filepath.IsAbs(pattern):
+		return defaultCoresTarget, fmt.Sprintf("core_pattern %q is relative, so cores land in the crashing process's working directory", pattern)
+	case strings.Contains(dir, "%"):
+		return defaultCoresTarget, fmt.Sprintf("core_pattern %q names a different directory for each dump", pattern)
+	}
+	return dir, ""
+}
+
+// coreRlimit returns a --ulimit that lets the container dump cores as large
+// as the runtime's hard limit allows, which it cannot raise.
+func coreRlimit() (rlimit, error) {
+	var cur syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &cur); err != nil {
+		return rlimit{}, err
+	}
+	return rlimit{Name: "core", Soft: cur.Max, Hard: cur.Max}, nil
+}
+
+// mountCores bind-mounts the --cores directory into root.
+func mountCores(root string, m *coresMount) error {
+	target := filepath.Join(root, m.Target)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", m.Target, err)
+	}
+	if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s on %s: %w", m.Source, m.Target, err)
+	}
+	return nil
+}
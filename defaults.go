@@ -0,0 +1,382 @@
+// defaults.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// systemConfigPath holds the host's defaults; a user's own, in
+// $XDG_CONFIG_HOME/minictr/config.toml, win over them key by key, and flags
+// win over both.
+const systemConfigPath = "/etc/minictr/config.toml"
+
+// defaultStorageRoot is where minictr keeps its state, e.g. networks.
+const defaultStorageRoot = "/var/lib/minictr"
+
+// minictrConfig is what the config files set:
+//
+//	storage-root = "/srv/minictr"
+//
+//	[run]               # defaults for any run flag, by its name
+//	cgroup-manager = "systemd"
+//	network = ["br0"]   # a repeatable flag takes a list
+//	init = true
+//	pids-limit = 4096
+type minictrConfig struct {
+	StorageRoot string
+	Run         map[string]configValue
+}
+
+// configValue is one setting, kept as the text a flag would get.
+type configValue struct {
+	values []string
+	list   bool
+	from   string // file:line, for errors
+}
+
+// loadConfig reads the system and user config files, either of which may be
+// missing.
+func loadConfig() (*minictrConfig, error) {
+	cfg := &minictrConfig{StorageRoot: defaultStorageRoot, Run: make(map[string]configValue)}
+	paths := []string{systemConfigPath}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "minictr", "config.toml"))
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := parseConfig(path, data, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if !filepath.IsAbs(cfg.StorageRoot) {
+		return nil, fmt.Errorf("config: storage-root %q is not absolute", cfg.StorageRoot)
+	}
+	return cfg, nil
+}
+
+// applyRunDefaults sets the run flags the config has defaults for and the
+// command line didn't give. A flag given under any of its names, like -e for
+// --env, replaces the default rather than adding to it.
+func (cfg *minictrConfig) applyRunDefaults(fs *flag.FlagSet) error {
+	given := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Value] = true })
+	names := make([]string, 0, len(cfg.Run))
+	for name := range cfg.Run {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := cfg.Run[name]
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: there is no run flag --%s", v.from, name)
+		}
+		if given[f.Value] {
+			continue
+		}
+		if _, repeatable := f.Value.(*stringList); v.list && !repeatable {
+			return fmt.Errorf("%s: --%s takes one value, not a list", v.from, name)
+		}
+		for _, s := range v.values {
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf("%s: invalid --%s: %v", v.from, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runDefault returns the config's default for a run flag, or "" if it has
+// none; for a list, the first entry.
+func (cfg *minictrConfig) runDefault(name string) string {
+	if v := cfg.Run[name]; len(v.values) > 0 {
+		return v.values[0]
+	}
+	return ""
+}
+
+// parseConfig reads one file into cfg. It understands the part of TOML the
+// config needs: comments, a [run] table, and keys set to strings, numbers,
+// booleans or one-level arrays of them.
+func parseConfig(path string, data []byte, cfg *minictrConfig) error {
+	p := &configParser{path: path, data: string(data), line: 1}
+	table := ""
+	seen := make(map[string]bool)
+	for {
+		// 1) A table header, a key = value line, or the end
+		p.skip(true)
+		if p.pos == len(p.data) {
+			return nil
+		}
+		if p.peek() == '[' {
+			p.pos++
+			end := strings.IndexAny(p.data[p.pos:], "]\n")
+			if end < 0 || p.data[p.pos+end] != ']' {
+				return p.errorf("unterminated table header")
+			}
+			table = strings.TrimSpace(p.data[p.pos : p.pos+end])
+			p.pos += end + 1
+			if table != "run" {
+				return p.errorf("unknown table [%s]", table)
+			}
+			if err := p.endLine(); err != nil {
+				return err
+			}
+			continue
+		}
+		from := fmt.Sprintf("%s:%d", path, p.line)
+		key, err := p.key()
+		if err != nil {
+			return err
+		}
+		p.skip(false)
+		if p.peek() != '=' {
+			return p.errorf("expected = after %q", key)
+		}
+		p.pos++
+		p.skip(false)
+
+		// 2) Its value
+		var v configValue
+		if p.peek() == '[' {
+			v.list = true
+			v.values, err = p.array()
+		} else {
+			var s string
+			s, err = p.scalar()
+			v.values = []string{s}
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endLine(); err != nil {
+			return err
+		}
+		v.from = from
+		if seen[table+"."+key] {
+			return fmt.Errorf("%s: %q is set twice", from, key)
+		}
+		seen[table+"."+key] = true
+
+		// 3) Then what it sets
+		switch {
+		case table == "run":
+			cfg.Run[key] = v
+		case key == "storage-root" && !v.list:
+			cfg.StorageRoot = v.values[0]
+		case key == "storage-root":
+			return fmt.Errorf("%s: storage-root takes one path", from)
+		default:
+			return fmt.Errorf("%s: unknown setting %q", from, key)
+		}
+	}
+}
+
+// configParser walks a config file, counting lines for its errors.
+type configParser struct {
+	path string
+	data string
+	pos  int
+	line int
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.path, p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *configParser) peek() byte {
+	if p.pos < len(p.data) {
+		return p.data[p.pos]
+	}
+	return 0
+}
+
+// skip passes over blanks, and with newlines also line ends and comments.
+func (p *configParser) skip(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case newlines && c == '\n':
+			p.pos++
+			p.line++
+		case newlines && c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endLine accepts blanks and a comment up to the end of the line.
+func (p *configParser) endLine() error {
+	p.skip(false)
+	if p.peek() == '#' {
+		for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+			p.pos++
+		}
+	}
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		return p.errorf("unexpected %q after the value", p.rest())
+	}
+	return nil
+}
+
+// rest returns what is left of the line, for errors.
+func (p *configParser) rest() string {
+	s := p.data[p.pos:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// key reads a bare or quoted key.
+func (p *configParser) key() (string, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		return p.scalar()
+	}
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a key, found %q", p.rest())
+	}
+	return p.data[start:p.pos], nil
+}
+
+// array reads [a, b, ...], which may span lines.
+func (p *configParser) array() ([]string, error) {
+	p.pos++
+	values := []string{}
+	for {
+		p.skip(true)
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		if p.peek() == '[' {
+			return nil, p.errorf("nested arrays are not supported")
+		}
+		s, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+		p.skip(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array, found %q", p.rest())
+		}
+	}
+}
+
+// scalar reads a string, number or boolean, returning it as a flag would
+// be given it.
+func (p *configParser) scalar() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.basicString()
+	case '\'':
+		if strings.HasPrefix(p.data[p.pos:], "'''") {
+			return "", p.errorf("multi-line strings are not supported")
+		}
+		end := strings.IndexAny(p.data[p.pos+1:], "'\n")
+		if end < 0 || p.data[p.pos+1+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		s := p.data[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return s, nil
+	}
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n,]#", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	tok := p.data[start:p.pos]
+	if tok == "true" || tok == "false" {
+		return tok, nil
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	if _, err := strconv.ParseFloat(num, 64); err != nil || tok == "" {
+		return "", p.errorf("invalid value %q (strings need quotes)", tok)
+	}
+	return num, nil
+}
+
+// basicString reads a "..." string with its escapes.
+func (p *configParser) basicString() (string, error) {
+	if strings.HasPrefix(p.data[p.pos:], `"""`) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos == len(p.data) || p.data[p.pos] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.pos == len(p.data) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.pos+n > len(p.data) {
+					return "", p.errorf("short \\%c escape", e)
+				}
+				r, err := strconv.ParseUint(p.data[p.pos:p.pos+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", p.errorf("invalid \\%c escape", e)
+				}
+				b.WriteRune(rune(r))
+				p.pos += n
+			default:
+				return "", p.errorf("invalid escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// devices.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// eBPF constants from <linux/bpf.h> for cgroup v2 device filtering.
+const (
+	BPF_PROG_LOAD   = 5
+	BPF_PROG_ATTACH = 8
+
+	BPF_PROG_TYPE_CGROUP_DEVICE = 15
+	BPF_CGROUP_DEVICE           = 6
+	BPF_F_ALLOW_MULTI           = 1 << 1
+
+	BPF_DEVCG_DEV_BLOCK = 1
+	BPF_DEVCG_DEV_CHAR  = 2
+
+	BPF_DEVCG_ACC_MKNOD = 1
+	BPF_DEVCG_ACC_READ  = 2
+	BPF_DEVCG_ACC_WRITE = 4
+)
+
+// deviceRule is a device cgroup allow rule in the v1 devices.allow format,
+// "type major:minor access", e.g. "c 1:3 rwm". Major and Minor are -1 for "*".
+type deviceRule struct {
+	Type         byte // 'a', 'b' or 'c'
+	Major, Minor int64
+	Access       string
+}
+
+func (d deviceRule) String() string {
+	num := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", d.Type, num(d.Major), num(d.Minor), d.Access)
+}
+
+// defaultDeviceRules is what every container may use: mknod of anything,
+// plus the pseudo-devices and terminals that programs expect to find.
+var defaultDeviceRules = []deviceRule{
+	{'c', -1, -1, "m"},
+	{'b', -1, -1, "m"},
+	{'c', 1, 3, "rwm"},    // /dev/null
+	{'c', 1, 5, "rwm"},    // /dev/zero
+	{'c', 1, 7, "rwm"},    // /dev/full
+	{'c', 1, 8, "rwm"},    // /dev/random
+	{'c', 1, 9, "rwm"},    // /dev/urandom
+	{'c', 5, 0, "rwm"},    // /dev/tty
+	{'c', 5, 1, "rwm"},    // /dev/console
+	{'c', 5, 2, "rwm"},    // /dev/ptmx
+	{'c', 136, -1, "rwm"}, // /dev/pts/*
+	{'c', 10, 200, "rwm"}, // /dev/net/tun
+}
+
+// defaultDevice reports whether rule allows nothing defaultDeviceRules
+// don't already.
+func defaultDevice(rule deviceRule) bool {
+	for _, d := range defaultDeviceRules {
+		if d.Type == rule.Type &&
+			(d.Major < 0 || d.Major == rule.Major) &&
+			(d.Minor < 0 || d.Minor == rule.Minor) &&
+			strings.Trim(rule.Access, d.Access) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeviceRule parses a --device-cgroup-rule such as "c 42:* rmw" or "a".
+func parseDeviceRule(s string) (deviceRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 1 && fields[0] == "a" {
+		return deviceRule{'a', -1, -1, "rwm"}, nil
+	}
+	if len(fields) != 3 || len(fields[0]) != 1 || !strings.Contains("abc", fields[0]) {
+		return deviceRule{}, fmt.Errorf("invalid device rule %q (want \"type major:minor access\")", s)
+	}
+	nums := strings.Split(fields[1], ":")
+	if len(nums) != 2 {
+		return deviceRule{}, fmt.Errorf("invalid device number %q in %q", fields[1], s)
+	}
+	rule := deviceRule{Type: fields[0][0], Access: fields[2]}
+	for i, dst := range []*int64{&rule.Major, &rule.Minor} {
+		if nums[i] == "*" {
+			*dst = -1
+			continue
+		}
+		n, err := strconv.ParseUint(nums[i], 10, 32)
+		if err != nil {
+			return deviceRule{}, fmt.Errorf("invalid device number %q in %q", fields[1], s)
+		}
+		*dst = int64(n)
+	}
+	if rule.Access == "" || strings.Trim(rule.Access, "rwm") != "" {
+		return deviceRule{}, fmt.Errorf("invalid access %q in %q (want a combination of r, w and m)", rule.Access, s)
+	}
+	return rule, nil
+}
+
+// bpfInsn is one eBPF instruction; dst and src registers share Regs.
+type bpfInsn struct {
+	Code uint8
+	Regs uint8 // dst in the low nibble, src in the high one
+	Off  int16
+	Imm  int32
+}
+
+func bpfLoadW(dst, src uint8, off int16) bpfInsn { return bpfInsn{0x61, dst | src<<4, off, 0} }
+func bpfAndK(dst uint8, imm int32) bpfInsn       { return bpfInsn{0x57, dst, 0, imm} }
+func bpfRshK(dst uint8, imm int32) bpfInsn       { return bpfInsn{0x77, dst, 0, imm} }
+func bpfMovK(dst uint8, imm int32) bpfInsn       { return bpfInsn{0xb7, dst, 0, imm} }
+func bpfMovX(dst, src uint8) bpfInsn             { return bpfInsn{0xbf, dst | src<<4, 0, 0} }
+func bpfJneK(dst uint8, imm int32, off int16) bpfInsn {
+	return bpfInsn{0x55, dst, off, imm}
+}
+func bpfJneX(dst, src uint8, off int16) bpfInsn { return bpfInsn{0x5d, dst | src<<4, off, 0} }
+func bpfExit() bpfInsn                          { return bpfInsn{0x95, 0, 0, 0} }
+
+// deviceFilterProgram compiles the allow rules into a BPF_PROG_TYPE_CGROUP_DEVICE
+// program, the cgroup v2 replacement for devices.allow. Rules are tried in order
+// and anything that matches none of them is denied.
+func deviceFilterProgram(rules []deviceRule) []bpfInsn {
+	// r2 = device type, r3 = requested access, r4 = major, r5 = minor
+	// (struct bpf_cgroup_dev_ctx is {access_type, major, minor})
+	prog := []bpfInsn{
+		bpfLoadW(2, 1, 0),
+		bpfAndK(2, 0xffff),
+		bpfLoadW(3, 1, 0),
+		bpfRshK(3, 16),
+		bpfLoadW(4, 1, 4),
+		bpfLoadW(5, 1, 8),
+	}
+	for _, rule := range rules {
+		var block []bpfInsn
+		var jumps []int // indexes of the "no match, next rule" jumps
+		switch rule.Type {
+		case 'b':
+			jumps = append(jumps, len(block))
+			block = append(block, bpfJneK(2, BPF_DEVCG_DEV_BLOCK, 0))
+		case 'c':
+			jumps = append(jumps, len(block))
+			block = append(block, bpfJneK(2, BPF_DEVCG_DEV_CHAR, 0))
+		}
+		var access int32
+		for _, c := range rule.Access {
+			switch c {
+			case 'm':
+				access |= BPF_DEVCG_ACC_MKNOD
+			case 'r':
+				access |= BPF_DEVCG_ACC_READ
+			case 'w':
+				access |= BPF_DEVCG_ACC_WRITE
+			}
+		}
+		if access != BPF_DEVCG_ACC_MKNOD|BPF_DEVCG_ACC_READ|BPF_DEVCG_ACC_WRITE {
+			// Every requested access bit must be granted by the rule
+			block = append(block, bpfMovX(1, 3), bpfAndK(1, access))
+			jumps = append(jumps, len(block))
+			block = append(block, bpfJneX(1, 3, 0))
+		}
+		if rule.Major >= 0 {
+			jumps = append(jumps, len(block))
+			block = append(block, bpfJneK(4, int32(rule.Major), 0))
+		}
+		if rule.Minor >= 0 {
+			jumps = append(jumps, len(block))
+			block = append(block, bpfJneK(5, int32(rule.Minor), 0))
+		}
+		block = append(block, bpfMovK(0, 1), bpfExit())
+		for _, i := range jumps {
+			block[i].Off = int16(len(block) - i - 1)
+		}
+		prog = append(prog, block...)
+		if len(jumps) == 0 {
+			// Matches everything; the verifier rejects the unreachable rest
+			return prog
+		}
+	}
+	return append(prog, bpfMovK(0, 0), bpfExit())
+}
+
+// attachDeviceFilter loads the device filter for rules and attaches it to the
+// cgroup v2 directory at cgroupPath.
+func attachDeviceFilter(cgroupPath string, rules []deviceRule) error {
+	prog := deviceFilterProgram(rules)
+	insns := make([]byte, 0, len(prog)*8)
+	for _, insn := range prog {
+		insns = append(insns, insn.Code, insn.Regs)
+		insns = binary.LittleEndian.AppendUint16(insns, uint16(insn.Off))
+		insns = binary.LittleEndian.AppendUint32(insns, uint32(insn.Imm))
+	}
+	license := []byte("GPL\x00")
+
+	// Leading fields of union bpf_attr for BPF_PROG_LOAD
+	load := struct {
+		ProgType, InsnCnt uint32
+		Insns, License    uint64
+		LogLevel, LogSize uint32
+		LogBuf            uint64
+	}{
+		ProgType: BPF_PROG_TYPE_CGROUP_DEVICE,
+		InsnCnt:  uint32(len(prog)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFd, _, errno := syscall.Syscall(SYS_BPF, BPF_PROG_LOAD, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return fmt.Errorf("load device filter: %w", errno)
+	}
+	defer syscall.Close(int(progFd))
+
+	dir, err := os.Open(cgroupPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// ALLOW_MULTI keeps any filter on the parent in force alongside ours
+	attach := struct {
+		TargetFd, AttachBpfFd, AttachType, AttachFlags uint32
+	}{uint32(dir.Fd()), uint32(progFd), BPF_CGROUP_DEVICE, BPF_F_ALLOW_MULTI}
+	if _, _, errno := syscall.Syscall(SYS_BPF, BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("attach device filter to %q: %w", cgroupPath, errno)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// env.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultPath is the container's PATH unless --env sets one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// parseEnv checks a --env or --env-file entry, KEY=value or a bare KEY that
+// takes the runtime's own value. ok is false for a bare KEY that isn't set.
+func parseEnv(entry string) (kv string, ok bool, err error) {
+	key, _, hasValue := strings.Cut(entry, "=")
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", false, fmt.Errorf("%q (want KEY=value or KEY)", entry)
+	}
+	if hasValue {
+		return entry, true, nil
+	}
+	value, ok := os.LookupEnv(key)
+	return key + "=" + value, ok, nil
+}
+
+// readEnvFile reads an --env-file in dotenv style: one KEY=value, or a bare
+// KEY, per line, optionally after "export ", skipping blank lines and #
+// comments. See parseEnvValue for what a value may look like.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, hasValue := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if hasValue {
+			if value, err = parseEnvValue(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			line = key + "=" + value
+		} else {
+			line = key
+		}
+		kv, ok, err := parseEnv(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if ok {
+			env = append(env, kv)
+		}
+	}
+	return env, scanner.Err()
+}
+
+// parseEnvValue unquotes an --env-file value. In single quotes it is taken
+// literally; in double quotes \n, \t, \", \\ and \$ are escapes. Unquoted, it
+// is trimmed and ends at a # after whitespace. Only a comment may follow a
+// quoted value.
+func parseEnvValue(s string) (string, error) {
+	trimmed := strings.TrimLeft(s, " \t")
+	if len(trimmed) < len(s) && strings.HasPrefix(trimmed, "#") {
+		return "", nil
+	}
+	s = trimmed
+	if s == "" || (s[0] != '\'' && s[0] != '"') {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		if i := strings.Index(s, "\t#"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimRight(s, " \t"), nil
+	}
+	quote := s[0]
+	var b strings.Builder
+	i := 1
+	for ; i < len(s) && s[i] != quote; i++ {
+		c := s[i]
+		if quote == '"' && c == '\\' && i+1 < len(s) {
+			i++
+			switch c = s[i]; c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case '"', '\\', '$':
+			default:
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(c)
+	}
+	if i == len(s) {
+		return "", fmt.Errorf("unterminated %c quote", quote)
+	}
+	if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after the closing quote", rest)
+	}
+	return b.String(), nil
+}
+
+// setEnv sets kv in env, replacing an earlier value of the same key.
+func setEnv(env []string, kv string) []string {
+	key, _, _ := strings.Cut(kv, "=")
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+// lookupEnv returns the value of key in env.
+func lookupEnv(env []string, key string) (string, bool) {
+	for _, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			return e[len(key)+1:], true
+		}
+	}
+	return "", false
+}
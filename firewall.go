@@ -0,0 +1,175 @@
+// firewall.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Firewall backends for the NAT rules backing user-defined networks.
+const (
+	firewallAuto     = "auto"
+	firewallNftables = "nftables"
+	firewallIptables = "iptables"
+)
+
+// resolveFirewall turns a --firewall choice into a concrete backend.
+// "auto" prefers nftables and falls back to iptables when the kernel lacks it.
+func resolveFirewall(choice string) (string, error) {
+	switch choice {
+	case "", firewallAuto:
+		if nftAvailable() {
+			return firewallNftables, nil
+		}
+		return firewallIptables, nil
+	case firewallNftables:
+		if !nftAvailable() {
+			return "", fmt.Errorf("nftables requested but the kernel does not accept nf_tables requests")
+		}
+		return firewallNftables, nil
+	case firewallIptables:
+		return firewallIptables, nil
+	}
+	return "", fmt.Errorf("unknown firewall backend %q (want auto, nftables or iptables)", choice)
+}
+
+// addMasquerade NATs traffic from the network's subnet leaving via any other interface.
+// It is idempotent, so it can be reapplied whenever the bridge is recreated.
+func addMasquerade(nw *Network) error {
+	if nw.Firewall == firewallNftables {
+		chain := nftChainName(nw)
+		b := &nftBatch{}
+		b.addTable()
+		b.addBaseChain(chain, "nat", NF_INET_POST_ROUTING, 100)
+		b.flushChain(chain)
+		b.addRule(chain, append(nftMatchSubnet(12, nw.ipnet(), NFT_CMP_EQ),
+			nftMeta(NFT_META_OIFNAME),
+			nftCmp(NFT_CMP_NEQ, nftIfname(nw.Bridge)),
+			nftExpr("masq"),
+		)...)
+		return b.commit()
+	}
+
+	masq := iptablesMasqueradeRule(nw)
+	if err := runIptables(append([]string{"-C"}, masq...)...); err == nil {
+		return nil
+	}
+	return runIptables(append([]string{"-A"}, masq...)...)
+}
+
+// removeMasquerade undoes addMasquerade.
+func removeMasquerade(nw *Network) error {
+	if nw.Firewall == firewallNftables {
+		chain := nftChainName(nw)
+		b := &nftBatch{}
+		b.flushChain(chain)
+		b.delChain(chain)
+		return b.commit()
+	}
+	return runIptables(append([]string{"-D"}, iptablesMasqueradeRule(nw)...)...)
+}
+
+func nftChainName(nw *Network) string {
+	return "postrouting-" + nw.Name
+}
+
+func iptablesMasqueradeRule(nw *Network) []string {
+	return []string{"POSTROUTING", "-t", "nat", "-s", nw.Subnet, "!", "-o", nw.Bridge, "-j", "MASQUERADE"}
+}
+
+// runIptables prefers iptables-legacy, since on nft-based distros plain
+// "iptables" is itself a frontend for the nf_tables backend we're replacing.
+func runIptables(args ...string) error {
+	bin := "iptables-legacy"
+	if _, err := exec.LookPath(bin); err != nil {
+		bin = "iptables"
+	}
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", bin, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// addPortForwards DNATs connections to the host's own addresses on each published
+// port to containerIP. Loopback destinations are left alone, since the kernel
+// won't route 127.0.0.0/8 sources out to the bridge.
+func addPortForwards(backend string, pid int, containerIP string, ports []portMapping) error {
+	ip := net.ParseIP(containerIP).To4()
+	if backend == firewallNftables {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		pre, out := nftPortChains(pid)
+		b := &nftBatch{}
+		b.addTable()
+		b.addBaseChain(pre, "nat", NF_INET_PRE_ROUTING, -100)
+		b.addBaseChain(out, "nat", NF_INET_LOCAL_OUT, -100)
+		for _, p := range ports {
+			match := append(nftDaddrLocal(),
+				nftMeta(NFT_META_L4PROTO),
+				nftCmp(NFT_CMP_EQ, []byte{p.protoNumber()}),
+				nftPayload(NFT_PAYLOAD_TRANSPORT, 2, 2),
+				nftCmp(NFT_CMP_EQ, be16(p.HostPort)),
+				nftImmediate(NFT_REG_1, ip),
+				nftImmediate(NFT_REG_2, be16(p.ContainerPort)),
+				nftDNAT(),
+			)
+			b.addRule(pre, match...)
+			b.addRule(out, append(nftMatchSubnet(16, loopback, NFT_CMP_NEQ), match...)...)
+		}
+		return b.commit()
+	}
+
+	// On failure take out exactly the rules that went in, which can be half
+	// of a port's
+	var added [][]string
+	for _, p := range ports {
+		for _, rule := range iptablesPortRules(containerIP, p) {
+			if err := runIptables(append([]string{"-A"}, rule...)...); err != nil {
+				for i := len(added) - 1; i >= 0; i-- {
+					runIptables(append([]string{"-D"}, added[i]...)...)
+				}
+				return err
+			}
+			added = append(added, rule)
+		}
+	}
+	return nil
+}
+
+// removePortForwards undoes addPortForwards.
+func removePortForwards(backend string, pid int, containerIP string, ports []portMapping) error {
+	if backend == firewallNftables {
+		pre, out := nftPortChains(pid)
+		b := &nftBatch{}
+		b.flushChain(pre)
+		b.delChain(pre)
+		b.flushChain(out)
+		b.delChain(out)
+		return b.commit()
+	}
+
+	var firstErr error
+	for _, p := range ports {
+		for _, rule := range iptablesPortRules(containerIP, p) {
+			if err := runIptables(append([]string{"-D"}, rule...)...); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func nftPortChains(pid int) (prerouting, output string) {
+	return fmt.Sprintf("ports-pre-%d", pid), fmt.Sprintf("ports-out-%d", pid)
+}
+
+func iptablesPortRules(containerIP string, p portMapping) [][]string {
+	dnat := []string{"-m", "addrtype", "--dst-type", "LOCAL", "-p", p.Proto, "--dport", fmt.Sprint(p.HostPort),
+		"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", containerIP, p.ContainerPort)}
+	return [][]string{
+		append([]string{"PREROUTING", "-t", "nat"}, dnat...),
+		append([]string{"OUTPUT", "-t", "nat", "!", "-d", "127.0.0.0/8"}, dnat...),
+	}
+}
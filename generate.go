@@ -0,0 +1,164 @@
+// generate.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// restartPolicies maps the --restart policies onto systemd's Restart=.
+var restartPolicies = map[string]string{
+	"no":             "no",
+	"always":         "always",
+	"unless-stopped": "always", // a unit stopped by hand stays stopped anyway
+	"on-failure":     "on-failure",
+}
+
+// runGenerate writes configuration for other tools to stdout.
+func runGenerate(args []string, cfg *minictrConfig) error {
+	if len(args) == 0 || args[0] != "systemd" {
+		return fmt.Errorf("usage: minictr generate systemd [flags] -- RUN-ARGS...")
+	}
+	return generateSystemd(args[1:], cfg)
+}
+
+// generateSystemd prints a service unit that runs minictr with the given run
+// flags and command. There is no stop command; systemd's SIGTERM to the
+// runtime stops the container with its --stop-signal, and KillMode=mixed
+// leaves anything else to the final SIGKILL. The run flags the unit depends
+// on may also come from the config's defaults.
+func generateSystemd(args []string, cfg *minictrConfig) error {
+	genCmd := flag.NewFlagSet("generate systemd", flag.ExitOnError)
+	name := genCmd.String("name", "", "Name of the container in the unit's description (default: the base name of its --rootfs or --verity-image)")
+	restart := genCmd.String("restart", "no", "Restart policy: no, always, unless-stopped, on-failure or on-failure:N to give up after N restarts")
+	genCmd.Parse(args)
+
+	runArgs := genCmd.Args()
+	if len(runArgs) == 0 {
+		return fmt.Errorf("usage: minictr generate systemd [flags] -- RUN-ARGS...")
+	}
+	runDefault := func(name string) string {
+		if v := runFlagValue(runArgs, name); v != "" {
+			return v
+		}
+		return cfg.runDefault(name)
+	}
+
+	// 1) Work out the restart policy and the run's stop signal
+	policy, maxRetries, _ := strings.Cut(*restart, ":")
+	systemdRestart, ok := restartPolicies[policy]
+	if !ok || (maxRetries != "" && policy != "on-failure") {
+		return fmt.Errorf("invalid --restart %q (want no, always, unless-stopped, on-failure or on-failure:N)", *restart)
+	}
+	retries := 0
+	if maxRetries != "" {
+		n, err := strconv.Atoi(maxRetries)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid --restart %q: N must be a positive number", *restart)
+		}
+		retries = n
+	}
+	stopSignal := syscall.SIGTERM
+	if s := runDefault("stop-signal"); s != "" {
+		sig, err := parseSignal(s)
+		if err != nil {
+			return fmt.Errorf("invalid --stop-signal: %v", err)
+		}
+		stopSignal = sig
+	}
+	if *name == "" {
+		root := runFlagValue(runArgs, "rootfs")
+		if root == "" {
+			root = runFlagValue(runArgs, "verity-image")
+		}
+		*name = filepath.Base(root)
+	}
+
+	// 2) ExecStart needs absolute paths, and relative run arguments resolve
+	// against the directory we were called in
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find minictr: %w", err)
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return fmt.Errorf("find minictr: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	execStart := []string{systemdQuote(self)}
+	for _, arg := range runArgs {
+		execStart = append(execStart, systemdQuote(arg))
+	}
+
+	// 3) Print the unit
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by 'minictr generate systemd'\n")
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=minictr container %s\n", *name)
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=network-online.target\n")
+	if retries > 0 {
+		// The first start counts too
+		fmt.Fprintf(&b, "StartLimitIntervalSec=infinity\n")
+		fmt.Fprintf(&b, "StartLimitBurst=%d\n", retries+1)
+	}
+	fmt.Fprintf(&b, "\n[Service]\n")
+	if runDefault("wait-for") != "" {
+		// minictr tells systemd once the --wait-for conditions hold
+		fmt.Fprintf(&b, "Type=notify\n")
+	} else {
+		fmt.Fprintf(&b, "Type=simple\n")
+	}
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", systemdQuote(wd))
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(execStart, " "))
+	fmt.Fprintf(&b, "KillMode=mixed\n")
+	fmt.Fprintf(&b, "Delegate=yes\n")
+	// minictr exits with 128+signal when the stop signal kills the container
+	fmt.Fprintf(&b, "SuccessExitStatus=%d\n", 128+int(stopSignal))
+	fmt.Fprintf(&b, "Restart=%s\n", systemdRestart)
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	_, err = os.Stdout.WriteString(b.String())
+	return err
+}
+
+// runFlagValue returns the value of a run flag in args, given as --flag value
+// or --flag=value with one dash or two, or "" if it isn't there. Without the
+// run flag set it can't tell where the command starts, so it takes the first.
+func runFlagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		flag := strings.TrimLeft(arg, "-")
+		if v, ok := strings.CutPrefix(flag, name+"="); ok {
+			return v
+		}
+		if flag == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// systemdQuote quotes s as one word of a unit file's command line, escaping
+// the specifiers and variables systemd would otherwise expand.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -1 +1,3 @@
 module minictr
+
+go 1.27.1
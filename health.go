@@ -0,0 +1,142 @@
+// health.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxHealthOutput is how much of a failing check's output is reported.
+const maxHealthOutput = 4096
+
+// healthCheck is a --health-cmd with its timing, run by the --init reaper so
+// that it runs inside the container, confined as the workload is.
+type healthCheck struct {
+	Cmd         string // run with /bin/sh -c
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+}
+
+// runHealthChecks runs hc every interval from inside the container and
+// writes each change of status to report as status<TAB>detail. Failures in
+// the start period don't count; Retries failures in a row after it make the
+// container unhealthy, and one success healthy again. Each check is started
+// by whoever receives on forks. It stops when ctx is done.
+func runHealthChecks(ctx context.Context, hc *healthCheck, env []string, report *os.File, forks chan<- func()) {
+	defer report.Close()
+	start := time.Now()
+	status, failures := "starting", 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hc.Interval):
+		}
+		out, ok := runHealthCheck(ctx, hc, env, forks)
+		switch {
+		case ok:
+			failures = 0
+			if status != "healthy" {
+				status = "healthy"
+				fmt.Fprintf(report, "%s\t\n", status)
+			}
+		case time.Since(start) < hc.StartPeriod && status == "starting":
+		default:
+			failures++
+			if failures >= hc.Retries && status != "unhealthy" {
+				status = "unhealthy"
+				fmt.Fprintf(report, "%s\t%d failed checks, last: %s\n", status, failures, out)
+			}
+		}
+	}
+}
+
+// runHealthCheck runs the check once and returns its output, and whether it
+// exited 0 within the timeout. The check gets the workload's environment, an
+// empty stdin and a process group of its own, which is killed on timeout.
+func runHealthCheck(ctx context.Context, hc *healthCheck, env []string, forks chan<- func()) (string, bool) {
+	// 1) Start it, collecting its stdout and stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err.Error(), false
+	}
+	defer r.Close()
+	stdin, closed, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return err.Error(), false
+	}
+	closed.Close()
+	attr := &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{stdin.Fd(), w.Fd(), w.Fd()},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	}
+	var pid int
+	var exited <-chan syscall.WaitStatus
+	started := make(chan struct{})
+	select {
+	case forks <- func() {
+		pid, exited, err = startWatched("/bin/sh", []string{"/bin/sh", "-c", hc.Cmd}, attr)
+		close(started)
+	}:
+		<-started
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	w.Close()
+	stdin.Close()
+	if err != nil {
+		return fmt.Sprintf("exec /bin/sh: %v", err), false
+	}
+	output := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		if len(b) > maxHealthOutput {
+			b = b[:maxHealthOutput]
+		}
+		output <- strings.Join(strings.Fields(string(b)), " ")
+	}()
+
+	// 2) Wait for it, or kill it
+	var ws syscall.WaitStatus
+	select {
+	case ws = <-exited:
+	case <-time.After(hc.Timeout):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-exited
+		return fmt.Sprintf("timed out after %s", hc.Timeout), false
+	}
+
+	// 3) Anything it left running may hold the pipe open; don't wait for that
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	out := <-output
+	if ws.Signaled() {
+		return fmt.Sprintf("killed by %v: %s", ws.Signal(), out), false
+	}
+	return out, ws.ExitStatus() == 0
+}
+
+// watchHealth logs the container's health status changes the reaper reports
+// on r as events, and sends them to the webhooks, until the container exits.
+func watchHealth(pid int, r *os.File, events *webhooks) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		status, detail, _ := strings.Cut(scanner.Text(), "\t")
+		events.send("health", pid, map[string]interface{}{"status": status, "detail": detail})
+		if detail == "" {
+			logEventf("container %d is %s", pid, status)
+		} else {
+			logEventf("container %d is %s (%s)", pid, status, detail)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// hooks.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hook is one OCI lifecycle hook: a program run with the container's state
+// as JSON on stdin, killed after Timeout seconds if it has one.
+type hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"` // including argv[0]
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+// ociHooks is the "hooks" object of an OCI runtime config. createRuntime,
+// poststart and poststop hooks run in the runtime's namespaces;
+// createContainer ones in the container's before pivot_root, so with the
+// host's filesystem, and startContainer ones in the container's rootfs just
+// before the command.
+type ociHooks struct {
+	CreateRuntime   []hook `json:"createRuntime,omitempty"`
+	CreateContainer []hook `json:"createContainer,omitempty"`
+	StartContainer  []hook `json:"startContainer,omitempty"`
+	Poststart       []hook `json:"poststart,omitempty"`
+	Poststop        []hook `json:"poststop,omitempty"`
+}
+
+// loadHooks reads a --hooks file: the hooks object of an OCI config.json.
+func loadHooks(path string) (*ociHooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hs ociHooks
+	if err := json.Unmarshal(data, &hs); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	for _, list := range [][]hook{hs.CreateRuntime, hs.CreateContainer, hs.StartContainer, hs.Poststart, hs.Poststop} {
+		for _, h := range list {
+			if !strings.HasPrefix(h.Path, "/") {
+				return nil, fmt.Errorf("%s: hook path %q is not absolute", path, h.Path)
+			}
+			if h.Timeout != nil && *h.Timeout <= 0 {
+				return nil, fmt.Errorf("%s: hook %s: timeout must be positive", path, h.Path)
+			}
+		}
+	}
+	return &hs, nil
+}
+
+// hostPrograms returns the programs of the hooks that run from the host's
+// filesystem, which is all but the startContainer ones.
+func (hs *ociHooks) hostPrograms() []string {
+	if hs == nil {
+		return nil
+	}
+	var paths []string
+	for _, list := range [][]hook{hs.CreateRuntime, hs.CreateContainer, hs.Poststart, hs.Poststop} {
+		for _, h := range list {
+			paths = append(paths, h.Path)
+		}
+	}
+	return paths
+}
+
+// ociState is the OCI state of the container with the given PID, as hooks
+// and seccomp agents get it.
+func ociState(pid int, status, bundle string) map[string]interface{} {
+	return map[string]interface{}{
+		"ociVersion": "1.0.2",
+		"id":         strconv.Itoa(pid),
+		"status":     status,
+		"pid":        pid,
+		"bundle":     bundle,
+	}
+}
+
+// runHooks runs the hooks for one lifecycle phase in order, stopping at the
+// first one that fails or when ctx is done.
+func runHooks(ctx context.Context, phase string, hs []hook, pid int, status, bundle string) error {
+	if len(hs) == 0 {
+		return nil
+	}
+	state, err := json.Marshal(ociState(pid, status, bundle))
+	if err != nil {
+		return err
+	}
+	for _, h := range hs {
+		if err := runHook(ctx, h, state); err != nil {
+			return fmt.Errorf("%s hook %s: %w", phase, h.Path, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs h with state on stdin, its output in the error if it fails.
+func runHook(ctx context.Context, h hook, state []byte) error {
+	if h.Timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*h.Timeout)*time.Second)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	cmd.Env = h.Env
+	cmd.Stdin = bytes.NewReader(state)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded && h.Timeout != nil {
+		return fmt.Errorf("timed out after %ds", *h.Timeout)
+	}
+	if output := strings.TrimSpace(out.String()); err != nil && output != "" {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// landlock.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock constants from <linux/landlock.h>; the syscall numbers are the
+// same on amd64 and arm64.
+const (
+	SYS_LANDLOCK_CREATE_RULESET = 444
+	SYS_LANDLOCK_ADD_RULE       = 445
+	SYS_LANDLOCK_RESTRICT_SELF  = 446
+
+	LANDLOCK_CREATE_RULESET_VERSION = 1 << 0
+	LANDLOCK_RULE_PATH_BENEATH      = 1
+
+	LANDLOCK_ACCESS_FS_EXECUTE     = 1 << 0
+	LANDLOCK_ACCESS_FS_WRITE_FILE  = 1 << 1
+	LANDLOCK_ACCESS_FS_READ_FILE   = 1 << 2
+	LANDLOCK_ACCESS_FS_READ_DIR    = 1 << 3
+	LANDLOCK_ACCESS_FS_REMOVE_DIR  = 1 << 4
+	LANDLOCK_ACCESS_FS_REMOVE_FILE = 1 << 5
+	LANDLOCK_ACCESS_FS_MAKE_CHAR   = 1 << 6
+	LANDLOCK_ACCESS_FS_MAKE_DIR    = 1 << 7
+	LANDLOCK_ACCESS_FS_MAKE_REG    = 1 << 8
+	LANDLOCK_ACCESS_FS_MAKE_SOCK   = 1 << 9
+	LANDLOCK_ACCESS_FS_MAKE_FIFO   = 1 << 10
+	LANDLOCK_ACCESS_FS_MAKE_BLOCK  = 1 << 11
+	LANDLOCK_ACCESS_FS_MAKE_SYM    = 1 << 12
+	LANDLOCK_ACCESS_FS_REFER       = 1 << 13 // ABI 2
+	LANDLOCK_ACCESS_FS_TRUNCATE    = 1 << 14 // ABI 3
+	LANDLOCK_ACCESS_FS_IOCTL_DEV   = 1 << 15 // ABI 5
+)
+
+// landlockABI returns the Landlock ABI version of the running kernel, or 0
+// if Landlock is missing or disabled.
+func landlockABI() int {
+	v, _, errno := syscall.RawSyscall(SYS_LANDLOCK_CREATE_RULESET, 0, 0, LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// landlockFSAccess is every filesystem access right the given ABI knows.
+func landlockFSAccess(abi int) uint64 {
+	access := uint64(LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		access |= LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// applyLandlock restricts this thread, and the workload it execs, to files
+// beneath the root it has pivoted to. Everything in the rootfs stays
+// accessible; what is cut off is any path out of it, such as a directory
+// descriptor inherited from the host or another process's /proc/<pid>/root.
+// It needs either no_new_privs or CAP_SYS_ADMIN.
+func applyLandlock() error {
+	abi := landlockABI()
+	if abi == 0 {
+		return fmt.Errorf("Landlock is not available on this kernel")
+	}
+	runtime.LockOSThread()
+	access := landlockFSAccess(abi)
+
+	// 1) A ruleset that handles every filesystem access we know about
+	attr := access
+	rulesetFd, _, errno := syscall.RawSyscall(SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %w", errno)
+	}
+	defer syscall.Close(int(rulesetFd))
+
+	// 2) Allow all of it beneath /. struct landlock_path_beneath_attr is packed.
+	rootFd, err := syscall.Open("/", O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open /: %w", err)
+	}
+	defer syscall.Close(rootFd)
+	var rule [12]byte
+	binary.LittleEndian.PutUint64(rule[0:], access)
+	binary.LittleEndian.PutUint32(rule[8:], uint32(rootFd))
+	if _, _, errno := syscall.RawSyscall6(SYS_LANDLOCK_ADD_RULE, rulesetFd, LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_add_rule: %w", errno)
+	}
+
+	// 3) Enforce it
+	if _, _, errno := syscall.RawSyscall(SYS_LANDLOCK_RESTRICT_SELF, rulesetFd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// listen.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed under the systemd
+// socket activation protocol (sd_listen_fds(3)).
+const SD_LISTEN_FDS_START = 3
+
+// inheritedListenFds claims the sockets systemd passed to this process, along
+// with their names, and clears the LISTEN_* variables so they aren't inherited
+// verbatim by the container (whose PID differs).
+func inheritedListenFds() ([]*os.File, []string) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	if len(names) != n {
+		names = make([]string, n)
+	}
+
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		fd := SD_LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+		if names[i] == "" {
+			names[i] = "unknown"
+		}
+		files = append(files, os.NewFile(uintptr(fd), names[i]))
+	}
+	return files, names
+}
+
+// bindListeners creates the sockets requested with --listen. Each spec is
+// [name=]proto:address, where proto is tcp, tcp4, tcp6, udp, udp4, udp6 or
+// unix and a bare port means all addresses, e.g. "tcp:80", "http=tcp:127.0.0.1:8080"
+// or "unix:/run/app.sock". The sockets are bound in the runtime's namespaces,
+// so privileged ports work without granting the container anything.
+func bindListeners(specs []string) ([]*os.File, []string, error) {
+	var files []*os.File
+	var names []string
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for _, spec := range specs {
+		name := "unknown"
+		rest := spec
+		if i := strings.Index(rest, "="); i >= 0 {
+			name, rest = rest[:i], rest[i+1:]
+		}
+		parts := strings.SplitN(rest, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid --listen %q (want [name=]proto:address)", spec)
+		}
+		proto, addr := parts[0], parts[1]
+		if _, err := strconv.Atoi(addr); err == nil {
+			addr = ":" + addr
+		}
+
+		var f *os.File
+		var err error
+		switch proto {
+		case "tcp", "tcp4", "tcp6", "unix":
+			var ln net.Listener
+			if ln, err = net.Listen(proto, addr); err == nil {
+				if ul, ok := ln.(*net.UnixListener); ok {
+					// The container owns the socket path from here on
+					ul.SetUnlinkOnClose(false)
+				}
+				f, err = ln.(interface{ File() (*os.File, error) }).File()
+				ln.Close()
+			}
+		case "udp", "udp4", "udp6":
+			var pc net.PacketConn
+			if pc, err = net.ListenPacket(proto, addr); err == nil {
+				f, err = pc.(*net.UDPConn).File()
+				pc.Close()
+			}
+		default:
+			err = fmt.Errorf("unsupported protocol %q", proto)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("--listen %q: %w", spec, err)
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+	return files, names, nil
+}
+
+// listenFdsEnv returns the socket activation variables for the process about
+// to be exec'd, which keeps our PID, so that sd_listen_fds() in the workload
+// finds the sockets passed at SD_LISTEN_FDS_START.
+func listenFdsEnv(count int, names string) []string {
+	return []string{
+		"LISTEN_PID=" + strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS=" + strconv.Itoa(count),
+		"LISTEN_FDNAMES=" + names,
+	}
+}
@@ -0,0 +1,129 @@
+// logging.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevels are the --log-level names.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var (
+	// logHandler formats every record; configureLogging replaces it.
+	logHandler slog.Handler = &textHandler{level: slog.LevelInfo, out: log.New(os.Stderr, "", log.LstdFlags)}
+	// logComponent is "runtime", or "container" in the container init.
+	logComponent = "runtime"
+	// logContainer is the container's PID, its ID, once there is one. It is
+	// set before any goroutine logs.
+	logContainer int
+)
+
+// configureLogging sets the level and format, text or json, of what we log.
+// Whatever goes through the log package, which is what fails the run, is
+// logged at the error level.
+func configureLogging(level, format string) error {
+	l, ok := logLevels[level]
+	if !ok {
+		return fmt.Errorf("invalid --log-level %q (want debug, info, warn or error)", level)
+	}
+	switch format {
+	case "text":
+		logHandler = &textHandler{level: l, out: log.New(os.Stderr, "", log.LstdFlags)}
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})
+	default:
+		return fmt.Errorf("invalid --log-format %q (want text or json)", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logWriter{})
+	return nil
+}
+
+// configureInitLogging logs as the runtime does, from LOGLEVEL and LOGFORMAT.
+func configureInitLogging() {
+	logComponent = "container"
+	if level, format := os.Getenv("LOGLEVEL"), os.Getenv("LOGFORMAT"); level != "" && format != "" {
+		configureLogging(level, format)
+	}
+	os.Unsetenv("LOGLEVEL")
+	os.Unsetenv("LOGFORMAT")
+}
+
+func logDebugf(format string, args ...interface{}) { logf(slog.LevelDebug, false, format, args...) }
+func logInfof(format string, args ...interface{})  { logf(slog.LevelInfo, false, format, args...) }
+func logWarnf(format string, args ...interface{})  { logf(slog.LevelWarn, false, format, args...) }
+
+// logEventf logs a change in the container's state that tools may watch for.
+func logEventf(format string, args ...interface{}) { logf(slog.LevelInfo, true, format, args...) }
+
+func logf(level slog.Level, event bool, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !logHandler.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, args...), 0)
+	r.AddAttrs(slog.String("component", logComponent))
+	if logContainer != 0 {
+		r.AddAttrs(slog.Int("container", logContainer))
+	}
+	if event {
+		r.AddAttrs(slog.Bool("event", true))
+	}
+	logHandler.Handle(ctx, r)
+}
+
+// logWriter turns the log package's output into error records.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	logf(slog.LevelError, false, "%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// textHandler writes records the way minictr always has: "[runtime] ...",
+// "[runtime] warning: ..." and "[runtime] event: ...". Errors, which say
+// what failed themselves, go out as they are.
+type textHandler struct {
+	level slog.Level
+	out   *log.Logger
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		h.out.Print(r.Message)
+		return nil
+	}
+	var component, kind string
+	r.Attrs(func(a slog.Attr) bool {
+		switch {
+		case a.Key == "component":
+			component = a.Value.String()
+		case a.Key == "event":
+			kind = "event: "
+		}
+		return true
+	})
+	if r.Level >= slog.LevelWarn {
+		kind = "warning: "
+	}
+	h.out.Printf("[%s] %s%s", component, kind, r.Message)
+	return nil
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *textHandler) WithGroup(string) slog.Handler      { return h }
@@ -0,0 +1,422 @@
+// logs.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// jsonLogEntry is one line of a json-file log.
+type jsonLogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// runLogs implements "minictr logs PID|FILE": it prints a json-file log,
+// rotated files first, each line to our stdout or stderr as the container
+// wrote it. With --follow it goes on printing what is added until the
+// runtime writing the log exits.
+func runLogs(args []string) error {
+	logsCmd := flag.NewFlagSet("logs", flag.ExitOnError)
+	stream := logsCmd.String("stream", "", "Show only the container's stdout or its stderr")
+	timestamps := logsCmd.Bool("timestamps", false, "Start each line with its time")
+	follow := logsCmd.Bool("follow", false, "Keep printing what the container writes until it exits")
+	logsCmd.BoolVar(follow, "f", false, "Shorthand for --follow")
+	tail := logsCmd.Int("tail", -1, "Show only this many of the last lines; -1 shows all")
+	since := logsCmd.String("since", "", "Show only lines written since this time (RFC 3339, e.g. 2024-05-01T12:00:00Z) or this long ago (e.g. 10m)")
+	logsCmd.Parse(args)
+	if logsCmd.NArg() != 1 {
+		return fmt.Errorf("usage: minictr logs [flags] PID|FILE")
+	}
+	if *stream != "" && *stream != "stdout" && *stream != "stderr" {
+		return fmt.Errorf("invalid --stream %q (want stdout or stderr)", *stream)
+	}
+	var from time.Time
+	if *since != "" {
+		var err error
+		if from, err = parseSince(*since); err != nil {
+			return err
+		}
+	}
+	path := logsCmd.Arg(0)
+	if pid, err := strconv.Atoi(path); err == nil {
+		path = jsonLogPath(pid)
+	}
+	files, err := jsonLogFiles(path)
+	if err != nil {
+		return err
+	}
+	keep := func(e jsonLogEntry) bool {
+		return (*stream == "" || e.Stream == *stream) && !e.Time.Before(from)
+	}
+	starts, err := logStarts(files, from, *tail, keep)
+	if err != nil {
+		return err
+	}
+	// Unbuffered, so that on a terminal the two come out in order
+	out := map[string]io.Writer{"stdout": os.Stdout, "stderr": os.Stderr}
+	emit := func(e jsonLogEntry) {
+		w, ok := out[e.Stream]
+		if !ok || !keep(e) {
+			return
+		}
+		if *timestamps {
+			fmt.Fprintf(w, "%s ", e.Time.Format(time.RFC3339Nano))
+		}
+		io.WriteString(w, e.Log)
+	}
+	last := len(files) - 1
+	if *follow {
+		// The current file is followed rather than read
+		files = files[:last]
+	}
+	for i, file := range files {
+		if err := readJSONLog(file, starts[i], emit); err != nil {
+			return err
+		}
+	}
+	if *follow {
+		return followJSONLog(path, starts[last], emit)
+	}
+	return nil
+}
+
+// parseSince parses --since, a time or a duration before now.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q (want a time like 2024-05-01T12:00:00Z or a duration like 10m)", s)
+}
+
+// jsonLogFiles returns path and the files it was rotated to, oldest first.
+func jsonLogFiles(path string) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	rotated := make(map[string]int)
+	for _, m := range matches {
+		if n, err := strconv.Atoi(strings.TrimPrefix(m, path+".")); err == nil && n > 0 {
+			rotated[m] = n
+		}
+	}
+	files := make([]string, 0, len(rotated)+1)
+	for m := range rotated {
+		files = append(files, m)
+	}
+	sort.Slice(files, func(i, j int) bool { return rotated[files[i]] > rotated[files[j]] })
+	return append(files, path), nil
+}
+
+// logStarts returns the offset to start reading each of files at, oldest
+// first, for the lines since since and then only the last tail of them that
+// keep accepts. It seeks to those rather than reading the files through:
+// lines are written in time order, so the first since since is found by
+// binary search, and the last few by reading back from the end.
+func logStarts(files []string, since time.Time, tail int, keep func(jsonLogEntry) bool) ([]int64, error) {
+	starts := make([]int64, len(files))
+	if since.IsZero() && tail < 0 {
+		return starts, nil
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		f, err := os.Open(files[i])
+		if os.IsNotExist(err) {
+			// Rotated away since we looked, and skipped by readJSONLog
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, found, err := logStart(f, since, tail, keep)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", files[i], err)
+		}
+		starts[i] = start
+		if tail >= 0 {
+			if tail -= found; tail == 0 {
+				// Older files have nothing to show, so are read from their end
+				for j := 0; j < i; j++ {
+					if fi, err := os.Stat(files[j]); err == nil {
+						starts[j] = fi.Size()
+					}
+				}
+				break
+			}
+		}
+	}
+	return starts, nil
+}
+
+// logStart returns where in f to start for logStarts, and how many lines
+// from there on count towards tail.
+func logStart(f *os.File, since time.Time, tail int, keep func(jsonLogEntry) bool) (int64, int, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := fi.Size()
+
+	// 1) The first line since since
+	lo, hi := int64(0), size
+	if !since.IsZero() {
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			_, e, ok, err := lineAt(f, mid, size)
+			if err != nil {
+				return 0, 0, err
+			}
+			if !ok || !e.Time.Before(since) {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		if lo, _, _, err = lineAt(f, lo, size); err != nil {
+			return 0, 0, err
+		}
+	}
+	if tail <= 0 {
+		if tail == 0 {
+			return size, 0, nil
+		}
+		return lo, 0, nil
+	}
+
+	// 2) Then back from the end over tail lines that keep accepts, to no
+	// earlier than that
+	found := 0
+	counts := func(line []byte) bool {
+		var e jsonLogEntry
+		if json.Unmarshal(line, &e) == nil && keep(e) {
+			found++
+		}
+		return found == tail
+	}
+	buf := make([]byte, 64*1024)
+	pos := size
+	var rest []byte // from pos to the end of the line it is in
+	for pos > lo {
+		n := int64(len(buf))
+		if pos-lo < n {
+			n = pos - lo
+		}
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return 0, 0, err
+		}
+		rest = append(append([]byte(nil), buf[:n]...), rest...)
+		// Each newline before the last byte ends the line ahead of another
+		for len(rest) > 1 {
+			i := bytes.LastIndexByte(rest[:len(rest)-1], '\n')
+			if i < 0 {
+				break
+			}
+			if counts(rest[i+1:]) {
+				return pos + int64(i) + 1, found, nil
+			}
+			rest = rest[:i+1]
+		}
+	}
+	if len(rest) > 0 {
+		counts(rest)
+	}
+	return lo, found, nil
+}
+
+// lineAt returns the offset and entry of the first line of f to start at or
+// after off, or false if none does.
+func lineAt(f *os.File, off, size int64) (int64, jsonLogEntry, bool, error) {
+	var e jsonLogEntry
+	skip := off > 0
+	if skip {
+		// From the byte before, so a line starting at off is found
+		off--
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, off, size-off))
+	if skip {
+		skipped, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, e, false, nil
+		}
+		if err != nil {
+			return 0, e, false, err
+		}
+		off += int64(len(skipped))
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == nil && json.Unmarshal(line, &e) == nil {
+			return off, e, true, nil
+		}
+		if err == io.EOF {
+			return size, e, false, nil
+		}
+		if err != nil {
+			return 0, e, false, err
+		}
+		off += int64(len(line))
+	}
+}
+
+// readJSONLog calls fn with each entry of a json-file log from the line at
+// offset from. A line that doesn't parse, like one cut short by a crash, is
+// skipped.
+func readJSONLog(path string, from int64, fn func(jsonLogEntry)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Rotated away since we looked
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		var e jsonLogEntry
+		if len(line) > 0 && json.Unmarshal(line, &e) == nil {
+			fn(e)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// followJSONLog prints path from offset from and then what is added to it as
+// inotify reports it, following it to each new file as it is rotated. The runtime holds a
+// lock on the file it writes, so one that is read to the end and not locked
+// is the end of the log.
+func followJSONLog(path string, from int64, emit func(jsonLogEntry)) error {
+	ifd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+	defer syscall.Close(ifd)
+	const mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+	if _, err := syscall.InotifyAddWatch(ifd, filepath.Dir(path), mask); err != nil {
+		return fmt.Errorf("inotify: watch %s: %w", filepath.Dir(path), err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	var pending []byte
+	drain := func() error {
+		for {
+			n, err := f.Read(buf)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				var e jsonLogEntry
+				if json.Unmarshal(pending[:i+1], &e) == nil {
+					emit(e)
+				}
+				pending = pending[i+1:]
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		// 1) Print what has been written
+		if err := drain(); err != nil {
+			return err
+		}
+
+		// 2) Another file at path means this one was rotated away, and done
+		// once we have what was written to it since step 1
+		if rotated(f, path) {
+			next, err := os.Open(path)
+			if err == nil {
+				if err := drain(); err != nil {
+					next.Close()
+					return err
+				}
+				f.Close()
+				f, pending = next, nil
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		// 3) Nobody writing it means the container has exited, though the
+		// runtime may have written a last line after step 1
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB) == nil {
+			return drain()
+		}
+
+		// 4) Then sleep until the file changes
+		if err := waitInotify(ifd, filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+}
+
+// rotated reports whether path now names a file other than f.
+func rotated(f *os.File, path string) bool {
+	a, err1 := f.Stat()
+	b, err2 := os.Stat(path)
+	return err1 == nil && err2 == nil && !os.SameFile(a, b)
+}
+
+// waitInotify blocks until inotify reports an event for name.
+func waitInotify(ifd int, name string) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Read(ifd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inotify: %w", err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			if string(bytes.TrimRight(nameBytes, "\x00")) == name || ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				return nil
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+// logship.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A shipping driver sends its lines once it has logBatchSize of them, or
+	// logBatchWait after the first; --log-opt batch-size and batch-wait
+	// change that.
+	logBatchSize = 100
+	logBatchWait = time.Second
+	// logShipAttempts is how often a batch is tried before it is dropped,
+	// with logShipBackoff doubling between attempts.
+	logShipAttempts = 3
+	logShipBackoff  = time.Second
+	logShipTimeout  = 5 * time.Second
+)
+
+// logBatcher collects the lines of a driver that ships them in batches. One
+// goroutine sends the batches in order; while it is behind by more than a
+// few, the container's output waits rather than piling up.
+type logBatcher struct {
+	driver string
+	size   int
+	wait   time.Duration
+	send   func([]logRecord) error
+
+	mu      sync.Mutex
+	batch   []logRecord
+	timer   *time.Timer
+	closed  bool
+	batches chan []logRecord
+	done    chan struct{}
+}
+
+// parseBatchOptions takes batch-size and batch-wait from o.
+func parseBatchOptions(o logOptions) (int, time.Duration, error) {
+	size, wait := logBatchSize, logBatchWait
+	if s := o.take("batch-size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid batch-size %q (want a number of lines)", s)
+		}
+		size = n
+	}
+	if s := o.take("batch-wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid batch-wait %q (want a duration, e.g. 500ms)", s)
+		}
+		wait = d
+	}
+	return size, wait, nil
+}
+
+func newLogBatcher(driver string, size int, wait time.Duration, send func([]logRecord) error) *logBatcher {
+	b := &logBatcher{driver: driver, size: size, wait: wait, send: send,
+		batches: make(chan []logRecord, 4), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+func (b *logBatcher) add(r logRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batch = append(b.batch, r)
+	if len(b.batch) >= b.size {
+		b.flushLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.wait, b.flush)
+	}
+}
+
+func (b *logBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.flushLocked()
+	}
+}
+
+func (b *logBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.batch) > 0 {
+		b.batches <- b.batch
+		b.batch = nil
+	}
+}
+
+func (b *logBatcher) run() {
+	defer close(b.done)
+	for batch := range b.batches {
+		if err := b.send(batch); err != nil {
+			logWarnf("%s log driver: dropped %d lines: %v", b.driver, len(batch), err)
+		}
+	}
+}
+
+// close sends what is left and waits for it to be delivered or dropped.
+func (b *logBatcher) close() {
+	b.mu.Lock()
+	b.flushLocked()
+	b.closed = true
+	close(b.batches)
+	b.mu.Unlock()
+	<-b.done
+}
+
+// fluentdLog ships lines to fluentd, or fluent-bit, with its forward
+// protocol: one [tag, [[time, record]...]] message in msgpack per batch,
+// with docker's record fields container_id, container_name, source and log.
+type fluentdLog struct {
+	network, addr string
+	tag, name     string
+	pid           int
+	conn          net.Conn
+	batcher       *logBatcher
+}
+
+func newFluentdLog(o logOptions, name string) (*fluentdLog, error) {
+	l := &fluentdLog{network: "tcp", addr: "localhost:24224", tag: o.take("tag"), name: name}
+	if l.tag == "" {
+		l.tag = name
+	}
+	if a := o.take("fluentd-address"); a != "" {
+		if path, ok := strings.CutPrefix(a, "unix://"); ok {
+			l.network, l.addr = "unix", path
+		} else {
+			a = strings.TrimPrefix(a, "tcp://")
+			if _, _, err := net.SplitHostPort(a); err != nil {
+				a = net.JoinHostPort(a, "24224")
+			}
+			l.addr = a
+		}
+	}
+	size, wait, err := parseBatchOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	l.batcher = newLogBatcher("fluentd", size, wait, l.send)
+	return l, nil
+}
+
+func (l *fluentdLog) open(pid int) error {
+	l.pid = pid
+	var err error
+	l.conn, err = net.DialTimeout(l.network, l.addr, logShipTimeout)
+	return err
+}
+
+func (l *fluentdLog) write(r logRecord) error {
+	l.batcher.add(r)
+	return nil
+}
+
+// send writes one Forward mode message, making the connection again if it
+// was dropped.
+func (l *fluentdLog) send(batch []logRecord) error {
+	var m msgpackWriter
+	m.array(2)
+	m.str(l.tag)
+	m.array(len(batch))
+	for _, r := range batch {
+		m.array(2)
+		m.eventTime(r.Time)
+		m.mapHeader(4)
+		m.str("container_id")
+		m.str(strconv.Itoa(l.pid))
+		m.str("container_name")
+		m.str(l.name)
+		m.str("source")
+		m.str(r.Stream)
+		m.str("log")
+		m.str(string(bytes.TrimSuffix(r.Line, []byte("\n"))))
+	}
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if l.conn == nil {
+			if l.conn, err = net.DialTimeout(l.network, l.addr, logShipTimeout); err != nil {
+				continue
+			}
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(logShipTimeout))
+		if _, err = l.conn.Write(m.Bytes()); err == nil {
+			return nil
+		}
+		l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+func (l *fluentdLog) close() error {
+	l.batcher.close()
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.Close()
+}
+
+// msgpackWriter encodes the few msgpack types the forward protocol needs.
+type msgpackWriter struct {
+	bytes.Buffer
+}
+
+func (m *msgpackWriter) header(fix byte, max16, max32 byte, n int) {
+	switch {
+	case n < 16:
+		m.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		m.WriteByte(max16)
+		binary.Write(m, binary.BigEndian, uint16(n))
+	default:
+		m.WriteByte(max32)
+		binary.Write(m, binary.BigEndian, uint32(n))
+	}
+}
+
+func (m *msgpackWriter) array(n int)     { m.header(0x90, 0xdc, 0xdd, n) }
+func (m *msgpackWriter) mapHeader(n int) { m.header(0x80, 0xde, 0xdf, n) }
+
+func (m *msgpackWriter) str(s string) {
+	switch n := len(s); {
+	case n < 32:
+		m.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		m.WriteByte(0xd9)
+		m.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		m.WriteByte(0xda)
+		binary.Write(m, binary.BigEndian, uint16(n))
+	default:
+		m.WriteByte(0xdb)
+		binary.Write(m, binary.BigEndian, uint32(n))
+	}
+	m.WriteString(s)
+}
+
+// eventTime writes fluentd's EventTime, extension type 0: seconds and
+// nanoseconds as two big endian 32-bit numbers.
+func (m *msgpackWriter) eventTime(t time.Time) {
+	m.Write([]byte{0xd7, 0x00})
+	binary.Write(m, binary.BigEndian, uint32(t.Unix()))
+	binary.Write(m, binary.BigEndian, uint32(t.Nanosecond()))
+}
+
+// lokiLog ships lines to Grafana Loki's push API, as one stream per
+// container and output stream labelled container_name, stream and host,
+// plus loki-external-labels.
+type lokiLog struct {
+	url     string
+	tenant  string
+	labels  map[string]string
+	client  *http.Client
+	batcher *logBatcher
+}
+
+func newLokiLog(o logOptions, name string) (*lokiLog, error) {
+	l := &lokiLog{url: o.take("loki-url"), tenant: o.take("loki-tenant-id"), client: &http.Client{Timeout: logShipTimeout}}
+	u, err := url.Parse(l.url)
+	if l.url == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("the loki driver needs loki-url, e.g. http://localhost:3100/loki/api/v1/push")
+	}
+	if u.Path == "" || u.Path == "/" {
+		l.url = strings.TrimSuffix(l.url, "/") + "/loki/api/v1/push"
+	}
+	host, _ := os.Hostname()
+	l.labels = map[string]string{"container_name": name, "host": host}
+	if s := o.take("loki-external-labels"); s != "" {
+		for _, kv := range strings.Split(s, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				return nil, fmt.Errorf("invalid loki-external-labels entry %q (want key=value)", kv)
+			}
+			l.labels[k] = v
+		}
+	}
+	size, wait, err := parseBatchOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	l.batcher = newLogBatcher("loki", size, wait, l.send)
+	return l, nil
+}
+
+func (l *lokiLog) open(pid int) error { return nil }
+
+func (l *lokiLog) write(r logRecord) error {
+	l.batcher.add(r)
+	return nil
+}
+
+// send pushes a batch, retrying failed connections, server errors and 429s
+// with backoff.
+func (l *lokiLog) send(batch []logRecord) error {
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, r := range batch {
+		s := streams[r.Stream]
+		if s == nil {
+			labels := map[string]string{"stream": r.Stream}
+			for k, v := range l.labels {
+				labels[k] = v
+			}
+			s = &lokiStream{Stream: labels}
+			streams[r.Stream] = s
+			order = append(order, r.Stream)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(r.Time.UnixNano(), 10), string(bytes.TrimSuffix(r.Line, []byte("\n")))})
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, name := range order {
+		push.Streams = append(push.Streams, streams[name])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	backoff := logShipBackoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = l.post(body); err == nil || !retry || attempt == logShipAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (l *lokiLog) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg := make([]byte, 512)
+		n, _ := resp.Body.Read(msg)
+		return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg[:n])))
+	}
+	return false, nil
+}
+
+func (l *lokiLog) close() error {
+	l.batcher.close()
+	return nil
+}
@@ -2,15 +2,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -20,145 +26,1631 @@ const (
 	CLONE_NEWNS  = syscall.CLONE_NEWNS
 	CLONE_NEWNET = syscall.CLONE_NEWNET
 	CLONE_NEWIPC = syscall.CLONE_NEWIPC
+
+	CLONE_NEWCGROUP = syscall.CLONE_NEWCGROUP
+	CLONE_NEWUSER   = syscall.CLONE_NEWUSER
 )
 
 func main() {
-	// If first argument is "init", run containerInit(); otherwise enter "runtime" mode.
-	if len(os.Args) > 1 && os.Args[1] == "init" {
-		if err := containerInit(); err != nil {
-			log.Fatalf("container init failed: %v", err)
+	// If first argument is "init", run containerInit(); "network" manages networks,
+	// "stats" reports on running containers, "generate" writes service units,
+	// "plugin" lists plugins, "logs" prints a json-file log, "system" reports
+	// disk usage and "bench" times runs; otherwise enter "runtime" mode. A
+	// leading --host runs all that elsewhere. Defaults come from
+	// /etc/minictr/config.toml and the user's config.toml.
+	if len(os.Args) > 2 && (os.Args[1] == "--host" || os.Args[1] == "-host") {
+		log.Fatalf("remote: %v", runRemote(os.Args[2], os.Args[3:]))
+	}
+	if len(os.Args) > 1 && (strings.HasPrefix(os.Args[1], "--host=") || strings.HasPrefix(os.Args[1], "-host=")) {
+		_, host, _ := strings.Cut(os.Args[1], "=")
+		log.Fatalf("remote: %v", runRemote(host, os.Args[2:]))
+	}
+	// Everything but the container init starts from the config's defaults
+	var cfg *minictrConfig
+	if len(os.Args) < 2 || os.Args[1] != "init" {
+		var err error
+		if cfg, err = loadConfig(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		networksDir = filepath.Join(cfg.StorageRoot, "networks")
+		logsDir = filepath.Join(cfg.StorageRoot, "logs")
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			closeSelfExe()
+			configureInitLogging()
+			if err := containerInit(); err != nil {
+				log.Fatalf("container init failed: %v", err)
+			}
+			return
+		case "network":
+			if err := runNetwork(os.Args[2:]); err != nil {
+				log.Fatalf("network: %v", err)
+			}
+			return
+		case "stats":
+			if err := runStats(os.Args[2:]); err != nil {
+				log.Fatalf("stats: %v", err)
+			}
+			return
+		case "generate":
+			if err := runGenerate(os.Args[2:], cfg); err != nil {
+				log.Fatalf("generate: %v", err)
+			}
+			return
+		case "plugin":
+			if err := runPlugins(os.Args[2:]); err != nil {
+				log.Fatalf("plugin: %v", err)
+			}
+			return
+		case "logs":
+			if err := runLogs(os.Args[2:]); err != nil {
+				log.Fatalf("logs: %v", err)
+			}
+			return
+		case "system":
+			if err := runSystem(os.Args[2:], cfg); err != nil {
+				log.Fatalf("system: %v", err)
+			}
+			return
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				log.Fatalf("bench: %v", err)
+			}
+			return
 		}
-		return
 	}
 
 	// Runtime mode: parse flags, fork/exec child with new namespaces.
 	runCmd := flag.NewFlagSet("run", flag.ExitOnError)
-	rootfs := runCmd.String("rootfs", "", "Path to the directory to use as root filesystem (required)")
+	rootfs := runCmd.String("rootfs", "", "Path to the directory to use as root filesystem (required unless --verity-image is given)")
+	verityImagePath := runCmd.String("verity-image", "", "Run from a read-only erofs, squashfs or ext4 image whose every block the kernel checks with dm-verity; instead of --rootfs, needs --verity-hash-tree and --verity-root-hash")
+	verityHashTree := runCmd.String("verity-hash-tree", "", "The --verity-image's hash tree, as written by 'veritysetup format'")
+	verityRootHash := runCmd.String("verity-root-hash", "", "The --verity-image's root hash in hex, as printed by 'veritysetup format'")
 	memLimit := runCmd.String("mem", "", "Memory limit (e.g. 100m, 1g). If empty, no limit is applied.")
+	memSwap := runCmd.String("memory-swap", "", "Total memory plus swap limit (e.g. 2g), or -1 for unlimited swap. Requires --mem.")
+	memReservation := runCmd.String("memory-reservation", "", "Soft memory limit (e.g. 512m); above it the container is throttled and reclaimed before --mem is hit")
+	oomKillDisable := runCmd.Bool("oom-kill-disable", false, "Don't OOM kill the container at its memory limit; its tasks wait for memory instead (cgroup v1 only). Requires --mem.")
+	oomScoreAdj := runCmd.Int("oom-score-adj", 0, "Bias the kernel OOM killer for the container's processes (-1000 to 1000; higher is killed first)")
+	cpus := runCmd.String("cpus", "", "Number of CPUs the container may use (e.g. 1.5), enforced as a CFS quota")
+	cpuShares := runCmd.Uint64("cpu-shares", 0, "Relative CPU weight (2-262144, default 1024)")
+	cpuRTRuntime := runCmd.Int64("cpu-rt-runtime", 0, "Microseconds per --cpu-rt-period the container's realtime tasks may run (cgroup v1 with RT group scheduling)")
+	cpuRTPeriod := runCmd.Int64("cpu-rt-period", 0, "Realtime scheduling period in microseconds (default 1000000)")
+	schedPolicy := runCmd.String("sched-policy", "", "Scheduling policy for the container process: other, fifo, rr, batch or idle")
+	schedPriority := runCmd.Int("sched-priority", 0, "Realtime priority for --sched-policy fifo or rr (1-99)")
+	nice := runCmd.Int("nice", 0, "Nice value for the container process (-20 to 19; higher runs less)")
+	ionice := runCmd.String("ionice", "", "IO scheduling class and level for the container process: realtime[:0-7], best-effort[:0-7] or idle")
+	cpusetCpus := runCmd.String("cpuset-cpus", "", "CPUs the container may run on (e.g. 0-3,6)")
+	cpusetMems := runCmd.String("cpuset-mems", "", "NUMA memory nodes the container may allocate from (e.g. 0,1)")
+	pidsLimit := runCmd.Int64("pids-limit", 0, "Maximum number of processes/threads in the container. 0 means unlimited.")
+	var deviceReadBps, deviceWriteBps, deviceReadIOPS, deviceWriteIOPS stringList
+	runCmd.Var(&deviceReadBps, "device-read-bps", "Limit read rate from a block device as path:rate, e.g. /dev/sda:10m (repeatable)")
+	runCmd.Var(&deviceWriteBps, "device-write-bps", "Limit write rate to a block device as path:rate, e.g. /dev/sda:10m (repeatable)")
+	runCmd.Var(&deviceReadIOPS, "device-read-iops", "Limit read operations per second from a block device as path:count (repeatable)")
+	runCmd.Var(&deviceWriteIOPS, "device-write-iops", "Limit write operations per second to a block device as path:count (repeatable)")
+	var deviceRules stringList
+	runCmd.Var(&deviceRules, "device-cgroup-rule", "Allow access to more devices, e.g. 'c 42:* rmw' (repeatable). All devices outside the default set are denied.")
+	var cgroupConf stringList
+	runCmd.Var(&cgroupConf, "cgroup-conf", "Write a raw cgroup interface file as key=value, e.g. memory.swap.max=0 or io.weight=50 (repeatable; applied after the dedicated flags)")
+	delegateCgroup := runCmd.Bool("delegate-cgroup", false, "Give the container a cgroup namespace and a writable /sys/fs/cgroup with all controllers delegated, e.g. for systemd inside (cgroup v2 only)")
+	cgroupManager := runCmd.String("cgroup-manager", cgroupManagerCgroupfs, "How to create the container cgroup: cgroupfs (write /sys/fs/cgroup directly) or systemd (transient scope via D-Bus)")
+	cgroupParent := runCmd.String("cgroup-parent", "", "Parent cgroup for the container, e.g. batch.slice or /sys/fs/cgroup/batch.slice; a slice name with --cgroup-manager systemd")
+	coresDir := runCmd.String("cores", "", "Host directory for the container's core dumps, mounted where the host's core_pattern writes them (or /cores), with the core size limit raised to the hard limit unless --ulimit core is given")
+	var ulimits stringList
+	runCmd.Var(&ulimits, "ulimit", "Resource limit for the container process as name=soft[:hard], e.g. nofile=1024:4096 or core=0 (repeatable)")
+	var sysctls stringList
+	runCmd.Var(&sysctls, "sysctl", "Set a namespaced kernel parameter in the container, e.g. net.ipv4.ip_forward=1 or kernel.shmmax=1073741824 (repeatable; net.*, kernel.shm*, kernel.msg*, kernel.sem, fs.mqueue.*)")
+	var envs, envFiles stringList
+	runCmd.Var(&envs, "env", "Set an environment variable in the container as KEY=value, or KEY to pass on the runtime's value (repeatable)")
+	runCmd.Var(&envs, "e", "Shorthand for --env")
+	runCmd.Var(&envFiles, "env-file", "Read environment variables from a dotenv-style file of KEY=value lines, with '' and \"\" quoting and # comments (repeatable; --env entries take precedence)")
+	var secretSpecs stringList
+	runCmd.Var(&secretSpecs, "secret", "Make a file available as /run/secrets/<name> on a tmpfs in the container, as [name=]file; file - reads it from stdin (repeatable)")
+	var capAdd, capDrop stringList
+	runCmd.Var(&capAdd, "cap-add", "Give the container a capability beyond the default set, e.g. NET_ADMIN, or ALL (repeatable)")
+	runCmd.Var(&capDrop, "cap-drop", "Take a capability away from the container, e.g. MKNOD, or ALL (repeatable)")
+	privileged := runCmd.Bool("privileged", false, "Give the container host-level access: all capabilities, no seccomp, AppArmor or SELinux confinement, every device, and the host's /dev plus a writable /sys and cgroup tree")
+	noNewPrivs := runCmd.Bool("no-new-privileges", true, "Stop setuid and file-capability binaries in the container from gaining privileges; --no-new-privileges=false turns it off")
+	landlock := runCmd.Bool("landlock", false, "Confine the container to files in its rootfs with Landlock (kernel 5.13+), also shutting out descriptors and /proc paths that lead elsewhere")
+	var securityOpts stringList
+	runCmd.Var(&securityOpts, "security-opt", "Security option: seccomp=unconfined, seccomp=profile.json (Docker/OCI format), apparmor=PROFILE, apparmor=unconfined, label=type:TYPE (also user:, role:, level:), label=disable or no-new-privileges[=true|false] (repeatable)")
+	var pressureThresholds stringList
+	runCmd.Var(&pressureThresholds, "pressure-threshold", "Log an event when the container's 10s PSI stall average for a resource reaches a percentage, e.g. memory=20 (repeatable; cgroup v2 only)")
+	pressureHook := runCmd.String("pressure-hook", "", "Program to run when a --pressure-threshold is crossed, with MINICTR_PID, MINICTR_PRESSURE_RESOURCE and MINICTR_PRESSURE_AVG10 set")
+	var uidMapSpecs, gidMapSpecs stringList
+	runCmd.Var(&uidMapSpecs, "uidmap", "Map container UIDs to host UIDs as container:host:size, e.g. 0:100000:65536 (repeatable; runs the container in a user namespace)")
+	runCmd.Var(&gidMapSpecs, "gidmap", "Map container GIDs to host GIDs as container:host:size (repeatable; defaults to the --uidmap ranges)")
+	userns := runCmd.String("userns", "", "User namespace mode: keep-id maps your UID and GID to the same IDs inside the container (unprivileged runs only)")
+	user := runCmd.String("user", "", "Run the command as user[:group], by name from the rootfs's /etc/passwd and /etc/group or as numeric IDs, e.g. 1000:1000 or nobody")
+	runCmd.StringVar(user, "u", "", "Shorthand for --user")
+	stopSignalName := runCmd.String("stop-signal", "SIGTERM", "Signal the container gets when the runtime is asked to stop with SIGTERM, e.g. SIGQUIT for nginx")
+	initReaper := runCmd.Bool("init", false, "Run a minimal init as the container's PID 1 that forwards signals to the command and reaps orphaned zombies")
+	healthCmd := runCmd.String("health-cmd", "", "With --init, a command run with /bin/sh -c inside the container to check it is healthy; exit status 0 means healthy")
+	healthInterval := runCmd.Duration("health-interval", 30*time.Second, "Time between --health-cmd checks")
+	healthTimeout := runCmd.Duration("health-timeout", 30*time.Second, "Time a --health-cmd check may take before it is killed and counted as failed")
+	healthRetries := runCmd.Int("health-retries", 3, "Consecutive failed --health-cmd checks that make the container unhealthy")
+	healthStartPeriod := runCmd.Duration("health-start-period", 0, "Time the container gets to start up, during which failed --health-cmd checks don't count")
+	waitOrphans := runCmd.Bool("wait-orphans", false, "With --init, keep the container up after the command exits until the processes it left running, e.g. a daemon it forked, have exited too")
+	umask := runCmd.String("umask", "0022", "File mode creation mask for the container's command, in octal")
+	podFile := runCmd.String("pod", "", "JSON file of processes to run together in the container under the --init reaper instead of one command, e.g. an app and its log shipper; the first to exit stops the others")
+	var waitFor stringList
+	runCmd.Var(&waitFor, "wait-for", "Log that the container is ready, and tell systemd so under a Type=notify unit, only once this holds: tcp://host:port listening in its network namespace, or path:/file existing (and accepting connections, for a socket) in its rootfs (repeatable)")
+	waitForTimeout := runCmd.Duration("wait-for-timeout", time.Minute, "How long to wait for the --wait-for conditions before warning that the container isn't ready")
+	var webhookURLs stringList
+	runCmd.Var(&webhookURLs, "webhook", "POST the container's start, health, oom and die events as JSON to this http(s) URL, retrying failures (repeatable)")
+	webhookSecret := runCmd.String("webhook-secret", "", "File with a key to sign --webhook requests with, as HMAC-SHA256 of the body in X-Minictr-Signature")
+	hooksFile := runCmd.String("hooks", "", "JSON file of OCI lifecycle hooks (createRuntime, createContainer, startContainer, poststart, poststop), as in the hooks of an OCI config.json")
+	consoleSocket := runCmd.String("console-socket", "", "Give the container a new terminal and send its master to the unix socket at this path, as runc does, e.g. for a containerd shim")
+	recordTTY := runCmd.Bool("record-tty", false, "Give the container a new terminal relayed to ours, and record the session, with its timing, in asciinema's format in <storage-root>/logs/<pid>.cast")
 	hostname := runCmd.String("hostname", "mini-container", "Hostname to set inside the container")
+	var networks stringList
+	runCmd.Var(&networks, "network", "Network to attach to: none (default), host, or a name from 'minictr network create'. Repeat to attach several named networks.")
+	netRate := runCmd.String("net-rate", "", "Egress bandwidth limit for each container interface (e.g. 10mbit). Requires a named --network.")
+	mtu := runCmd.Int("mtu", 0, "MTU for the container interfaces (both veth ends). 0 keeps the default.")
+	txQueueLen := runCmd.Int("txqueuelen", 0, "Transmit queue length for the container interfaces. 0 keeps the default.")
+	disableOffload := runCmd.Bool("disable-offload", false, "Disable checksum and TSO offloads on the container interfaces")
+	var publish stringList
+	runCmd.Var(&publish, "publish", "Publish a container port as hostPort:containerPort[/tcp|udp] (repeatable). On a named --network by DNAT; otherwise, as for rootless runs, through a userspace proxy into the container's own network, which runs it under --init")
+	runCmd.Var(&publish, "p", "Shorthand for --publish")
+	wireguard := runCmd.String("wireguard", "", "wg-quick style config file; gives the container a wg0 overlay interface whose UDP socket stays on the host")
+	var listen stringList
+	runCmd.Var(&listen, "listen", "Bind a socket in the host's namespaces and pass it to the container via socket activation (LISTEN_FDS): [name=]proto:address, e.g. tcp:80 (repeatable)")
+	logDriver := runCmd.String("log-driver", "", "Also send the container's output to: json-file (docker's format, in <storage-root>/logs/<pid>-json.log), journald, syslog, fluentd or loki")
+	var logOpts stringList
+	runCmd.Var(&logOpts, "log-opt", "Option for the --log-driver as key=value; json-file takes path, max-size (e.g. 10m) and max-file; journald takes name (default: the --hostname) and tag; syslog takes syslog-address (e.g. udp://host:514, tcp+tls://host, default unix:///dev/log), syslog-facility, syslog-format (rfc5424 or rfc3164), syslog-tls-ca-cert, syslog-tls-cert, syslog-tls-key, syslog-tls-skip-verify and tag; fluentd takes fluentd-address (default localhost:24224) and tag; loki takes loki-url, loki-external-labels (k=v,...) and loki-tenant-id; both take batch-size (lines) and batch-wait; all take multiline-pattern, a regexp that starts a record, so lines that don't match join the one before, and multiline-timeout (repeatable)")
+	logLevel := runCmd.String("log-level", "info", "Least severe messages to log: debug, info, warn or error")
+	logFormat := runCmd.String("log-format", "text", "Log as text, or as json with the component and container as fields")
 	runCmd.Parse(os.Args[1:])
+	if err := cfg.applyRunDefaults(runCmd); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := configureLogging(*logLevel, *logFormat); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Everything the runtime waits on outside itself, like hooks, takes ctx.
+	// Nothing cancels it yet: our SIGINT and SIGTERM go to the container,
+	// and the run cleans up once it exits
+	ctx := context.Background()
+	// With an OTLP endpoint in the environment, the run's steps are traced
+	tr, err := newTracer()
+	if err != nil {
+		logWarnf("not tracing: %v", err)
+	}
+	runSpan := tr.start("run", nil)
+	setupSpan := tr.start("setup", runSpan)
 
-	if *rootfs == "" {
+	switch {
+	case *verityImagePath != "":
+		if *rootfs != "" {
+			log.Fatal("Error: --verity-image replaces --rootfs; give only one")
+		}
+		if *verityHashTree == "" || *verityRootHash == "" {
+			log.Fatal("Error: --verity-image requires --verity-hash-tree and --verity-root-hash")
+		}
+		if err := checkRootHash(*verityRootHash); err != nil {
+			log.Fatalf("Error: invalid --verity-root-hash: %v", err)
+		}
+	case *verityHashTree != "" || *verityRootHash != "":
+		log.Fatal("Error: --verity-hash-tree and --verity-root-hash require --verity-image")
+	case *rootfs == "":
 		log.Fatal("Error: --rootfs must be specified")
 	}
 	remaining := runCmd.Args()
-	if len(remaining) == 0 {
+	var pod []podProcess
+	switch {
+	case *podFile != "":
+		if len(remaining) > 0 {
+			log.Fatal("Error: --pod replaces the command; give only one")
+		}
+		var err error
+		if pod, err = loadPodSpec(*podFile); err != nil {
+			log.Fatalf("Error: invalid --pod: %v", err)
+		}
+		// Only the reaper can run several processes
+		*initReaper = true
+	case len(remaining) == 0:
 		log.Fatal("Error: must specify at least one command to run inside the container")
 	}
 
-	cmdPath, err := exec.LookPath(os.Args[0])
+	// Collect the limits for the container's cgroup
+	var res cgroupResources
+	if *memLimit != "" {
+		limitBytes, err := parseMemLimit(*memLimit)
+		if err != nil {
+			logWarnf("could not parse memory limit %q: %v", *memLimit, err)
+		} else {
+			res.Memory = limitBytes
+		}
+	}
+	if *memSwap != "" {
+		if res.Memory == 0 {
+			log.Fatal("Error: --memory-swap requires --mem")
+		}
+		if *memSwap == "-1" {
+			res.MemorySwap = -1
+		} else {
+			swapBytes, err := parseMemLimit(*memSwap)
+			if err != nil {
+				log.Fatalf("Error: invalid --memory-swap: %v", err)
+			}
+			if swapBytes < res.Memory {
+				log.Fatalf("Error: --memory-swap %q must not be smaller than --mem %q", *memSwap, *memLimit)
+			}
+			res.MemorySwap = swapBytes
+		}
+	}
+	if *memReservation != "" {
+		lowBytes, err := parseMemLimit(*memReservation)
+		if err != nil {
+			log.Fatalf("Error: invalid --memory-reservation: %v", err)
+		}
+		if res.Memory > 0 && lowBytes > res.Memory {
+			log.Fatalf("Error: --memory-reservation %q must not exceed --mem %q", *memReservation, *memLimit)
+		}
+		res.MemoryLow = lowBytes
+	}
+	if *oomKillDisable {
+		// Without a limit the host OOM killer is the only line of defence
+		if res.Memory == 0 {
+			log.Fatal("Error: --oom-kill-disable requires --mem")
+		}
+		if cgroupUnified() {
+			logWarnf("--oom-kill-disable is not supported on cgroup v2; ignoring")
+		} else {
+			res.NoOOMKill = true
+		}
+	}
+	if *oomScoreAdj < -1000 || *oomScoreAdj > 1000 {
+		log.Fatalf("Error: --oom-score-adj %d out of range (-1000 to 1000)", *oomScoreAdj)
+	}
+	if *cpus != "" {
+		quota, err := parseCPUs(*cpus)
+		if err != nil {
+			log.Fatalf("Error: invalid --cpus: %v", err)
+		}
+		res.CPUQuota, res.CPUPeriod = quota, defaultCPUPeriod
+	}
+	if *cpuShares != 0 {
+		if *cpuShares < 2 || *cpuShares > 262144 {
+			log.Fatalf("Error: --cpu-shares %d out of range (2-262144)", *cpuShares)
+		}
+		res.CPUShares = *cpuShares
+	}
+
+	if *cpuRTRuntime != 0 || *cpuRTPeriod != 0 {
+		if cgroupUnified() {
+			log.Fatal("Error: --cpu-rt-runtime and --cpu-rt-period need cgroup v1; the unified hierarchy has no realtime group scheduling")
+		}
+		res.RTRuntime, res.RTPeriod = *cpuRTRuntime, *cpuRTPeriod
+		if res.RTPeriod == 0 {
+			res.RTPeriod = defaultRTPeriod
+		}
+		if res.RTRuntime <= 0 || res.RTRuntime > res.RTPeriod {
+			log.Fatalf("Error: --cpu-rt-runtime must be between 1 and the period (%d)", res.RTPeriod)
+		}
+	}
+	var sched string
+	if *schedPolicy != "" || *schedPriority != 0 {
+		var err error
+		if sched, err = parseSchedPolicy(*schedPolicy, *schedPriority); err != nil {
+			log.Fatalf("Error: invalid --sched-policy: %v", err)
+		}
+	}
+
+	if *nice < -20 || *nice > 19 {
+		log.Fatalf("Error: --nice %d out of range (-20 to 19)", *nice)
+	}
+	ioprio := -1
+	if *ionice != "" {
+		var err error
+		if ioprio, err = parseIOPrio(*ionice); err != nil {
+			log.Fatalf("Error: invalid --ionice: %v", err)
+		}
+	}
+
+	for flagName, list := range map[string]string{"cpuset-cpus": *cpusetCpus, "cpuset-mems": *cpusetMems} {
+		if list != "" && !cpuListRE.MatchString(list) {
+			log.Fatalf("Error: invalid --%s %q (want a list such as 0-3,6)", flagName, list)
+		}
+	}
+	res.CpusetCpus, res.CpusetMems = *cpusetCpus, *cpusetMems
+	if *pidsLimit < 0 {
+		log.Fatalf("Error: --pids-limit must not be negative")
+	}
+	res.PidsLimit = *pidsLimit
+	for _, d := range []struct {
+		flag, kind string
+		specs      stringList
+	}{
+		{"device-read-bps", "rbps", deviceReadBps},
+		{"device-write-bps", "wbps", deviceWriteBps},
+		{"device-read-iops", "riops", deviceReadIOPS},
+		{"device-write-iops", "wiops", deviceWriteIOPS},
+	} {
+		for _, spec := range d.specs {
+			t, err := parseDeviceThrottle(d.kind, spec)
+			if err != nil {
+				log.Fatalf("Error: invalid --%s: %v", d.flag, err)
+			}
+			res.IOThrottle = append(res.IOThrottle, t)
+		}
+	}
+	if *cgroupManager != cgroupManagerCgroupfs && *cgroupManager != cgroupManagerSystemd {
+		log.Fatalf("Error: invalid --cgroup-manager %q (want cgroupfs or systemd)", *cgroupManager)
+	}
+	cgOpts := cgroupOptions{
+		Manager:  *cgroupManager,
+		Parent:   strings.Trim(strings.TrimPrefix(*cgroupParent, cgroupMountpoint), "/"),
+		Delegate: *delegateCgroup,
+	}
+	if cgOpts.Delegate && !cgroupUnified() {
+		log.Fatal("Error: --delegate-cgroup requires cgroup v2")
+	}
+	if cgOpts.Parent != "" {
+		if contains(strings.Split(cgOpts.Parent, "/"), "..") {
+			log.Fatalf("Error: --cgroup-parent %q must not contain ..", *cgroupParent)
+		}
+		if cgOpts.Manager == cgroupManagerSystemd && (strings.Contains(cgOpts.Parent, "/") || !strings.HasSuffix(cgOpts.Parent, ".slice")) {
+			log.Fatalf("Error: --cgroup-parent must be a slice name such as batch.slice with --cgroup-manager systemd")
+		}
+	}
+	for _, conf := range cgroupConf {
+		f, err := parseCgroupConf(conf)
+		if err != nil {
+			log.Fatalf("Error: invalid --cgroup-conf: %v", err)
+		}
+		res.Extra = append(res.Extra, f)
+	}
+	// Unprivileged users get a user namespace in which they are root. Device
+	// nodes are already out of their reach, so the default rules are skipped.
+	rootless := os.Geteuid() != 0
+	var uidMaps, gidMaps []idMap
+	for _, spec := range uidMapSpecs {
+		m, err := parseIDMap(spec)
+		if err != nil {
+			log.Fatalf("Error: invalid --uidmap: %v", err)
+		}
+		uidMaps = append(uidMaps, m)
+	}
+	for _, spec := range gidMapSpecs {
+		m, err := parseIDMap(spec)
+		if err != nil {
+			log.Fatalf("Error: invalid --gidmap: %v", err)
+		}
+		gidMaps = append(gidMaps, m)
+	}
+	if len(gidMaps) > 0 && len(uidMaps) == 0 {
+		log.Fatal("Error: --gidmap requires --uidmap")
+	}
+	if len(gidMaps) == 0 {
+		gidMaps = uidMaps
+	}
+	switch *userns {
+	case "":
+	case "keep-id":
+		if !rootless {
+			log.Fatal("Error: --userns=keep-id only applies to unprivileged runs")
+		}
+		if len(uidMaps) > 0 {
+			log.Fatal("Error: --userns=keep-id can't be combined with --uidmap/--gidmap")
+		}
+		uid, gid := os.Getuid(), os.Getgid()
+		uidMaps = []idMap{{uid, uid, 1}}
+		gidMaps = []idMap{{gid, gid, 1}}
+	default:
+		log.Fatalf("Error: invalid --userns %q (want keep-id)", *userns)
+	}
+	if rootless && len(uidMaps) == 0 {
+		uidMaps, gidMaps = rootlessIDMaps()
+	}
+	if *privileged && len(deviceRules) > 0 {
+		log.Fatal("Error: --device-cgroup-rule can't be combined with --privileged, which allows every device")
+	}
+	if !rootless && !*privileged {
+		res.Devices = append(res.Devices, defaultDeviceRules...)
+	}
+
+	// The container init runs as whatever the runtime's own IDs map to, and
+	// as root for a privileged runtime
+	initUID, initGID := 0, 0
+	if rootless {
+		var uidOK, gidOK bool
+		initUID, uidOK = containerID(uidMaps, os.Geteuid())
+		initGID, gidOK = containerID(gidMaps, os.Getegid())
+		if !uidOK || !gidOK {
+			log.Fatal("Error: --uidmap/--gidmap must map your own UID and GID in an unprivileged run")
+		}
+	} else if len(uidMaps) > 0 {
+		if _, ok := hostID(uidMaps, 0); !ok {
+			log.Fatal("Error: --uidmap must map container UID 0")
+		}
+		if _, ok := hostID(gidMaps, 0); !ok {
+			log.Fatal("Error: --gidmap must map container GID 0")
+		}
+	}
+	helperMaps := len(uidMaps) > 0 && !idMapsDirect(uidMaps, gidMaps)
+	if helperMaps && (initUID != 0 || initGID != 0) {
+		log.Fatal("Error: an unprivileged run with several --uidmap/--gidmap ranges must map your UID and GID to 0")
+	}
+	// The workload starts from a clean environment rather than ours
+	containerEnv := []string{"PATH=" + defaultPath}
+	if term, ok := os.LookupEnv("TERM"); ok {
+		containerEnv = append(containerEnv, "TERM="+term)
+	}
+	for _, path := range envFiles {
+		entries, err := readEnvFile(path)
+		if err != nil {
+			log.Fatalf("Error: invalid --env-file: %v", err)
+		}
+		for _, kv := range entries {
+			containerEnv = setEnv(containerEnv, kv)
+		}
+	}
+	for _, e := range envs {
+		kv, ok, err := parseEnv(e)
+		if err != nil {
+			log.Fatalf("Error: invalid --env: %v", err)
+		}
+		if ok {
+			containerEnv = setEnv(containerEnv, kv)
+		}
+	}
+
+	var secrets []secret
+	for _, spec := range secretSpecs {
+		s, err := parseSecret(spec)
+		if err != nil {
+			log.Fatalf("Error: invalid --secret: %v", err)
+		}
+		for _, other := range secrets {
+			if other.Name == s.Name {
+				log.Fatalf("Error: secret %q given more than once", s.Name)
+			}
+		}
+		secrets = append(secrets, s)
+	}
+	umaskValue, err := strconv.ParseUint(*umask, 8, 32)
+	if err != nil || umaskValue > 0777 {
+		log.Fatalf("Error: invalid --umask %q (want an octal mode like 0022)", *umask)
+	}
+	if *waitOrphans && !*initReaper {
+		log.Fatal("Error: --wait-orphans requires --init")
+	}
+	var health *healthCheck
+	if *healthCmd != "" {
+		if !*initReaper {
+			log.Fatal("Error: --health-cmd requires --init, which runs the checks")
+		}
+		if *healthInterval <= 0 || *healthTimeout <= 0 || *healthStartPeriod < 0 || *healthRetries < 1 {
+			log.Fatal("Error: --health-interval and --health-timeout must be positive, --health-start-period not negative, and --health-retries at least 1")
+		}
+		health = &healthCheck{Cmd: *healthCmd, Interval: *healthInterval, Timeout: *healthTimeout, StartPeriod: *healthStartPeriod, Retries: *healthRetries}
+	}
+	var readyChecks []readyCheck
+	for _, spec := range waitFor {
+		c, err := parseWaitFor(spec)
+		if err != nil {
+			log.Fatalf("Error: invalid --wait-for: %v", err)
+		}
+		readyChecks = append(readyChecks, c)
+	}
+	var secret []byte
+	if *webhookSecret != "" {
+		data, err := os.ReadFile(*webhookSecret)
+		if err != nil {
+			log.Fatalf("Error: invalid --webhook-secret: %v", err)
+		}
+		if secret = []byte(strings.TrimRight(string(data), "\r\n")); len(secret) == 0 {
+			log.Fatalf("Error: invalid --webhook-secret: %s is empty", *webhookSecret)
+		}
+		if len(webhookURLs) == 0 {
+			log.Fatal("Error: --webhook-secret requires --webhook")
+		}
+	}
+	events, err := newWebhooks(webhookURLs, secret)
+	if err != nil {
+		log.Fatalf("Error: invalid --webhook: %v", err)
+	}
+	var hooks *ociHooks
+	if *hooksFile != "" {
+		if hooks, err = loadHooks(*hooksFile); err != nil {
+			log.Fatalf("Error: invalid --hooks: %v", err)
+		}
+	}
+	stopSignal, err := parseSignal(*stopSignalName)
+	if err != nil {
+		log.Fatalf("Error: invalid --stop-signal: %v", err)
+	}
+	if *user != "" {
+		if err := parseUserSpec(*user); err != nil {
+			log.Fatalf("Error: invalid --user: %v", err)
+		}
+	}
+	for _, r := range deviceRules {
+		rule, err := parseDeviceRule(r)
+		if err != nil {
+			log.Fatalf("Error: invalid --device-cgroup-rule: %v", err)
+		}
+		res.Devices = append(res.Devices, rule)
+	}
+
+	thresholds := make(map[string]float64)
+	for _, t := range pressureThresholds {
+		resource, pct, err := parsePressureThreshold(t)
+		if err != nil {
+			log.Fatalf("Error: invalid --pressure-threshold: %v", err)
+		}
+		thresholds[resource] = pct
+	}
+	if *pressureHook != "" && len(thresholds) == 0 {
+		log.Fatal("Error: --pressure-hook requires --pressure-threshold")
+	}
+
+	var rlimits []string
+	coreLimit := false
+	for _, u := range ulimits {
+		r, err := parseUlimit(u)
+		if err != nil {
+			log.Fatalf("Error: invalid --ulimit: %v", err)
+		}
+		rlimits = append(rlimits, r.String())
+		coreLimit = coreLimit || r.Name == "core"
+	}
+
+	// --cores puts a host directory where the kernel will write core dumps,
+	// and unless --ulimit core says otherwise lets them be as large as allowed
+	var cores *coresMount
+	if *coresDir != "" {
+		dir, err := filepath.Abs(*coresDir)
+		if err == nil {
+			var fi os.FileInfo
+			if fi, err = os.Stat(dir); err == nil && !fi.IsDir() {
+				err = fmt.Errorf("%s is not a directory", dir)
+			}
+		}
+		if err != nil {
+			log.Fatalf("Error: invalid --cores: %v", err)
+		}
+		target, warning := coresTarget()
+		if warning != "" {
+			logWarnf("--cores: %s; mounting %s at %s anyway", warning, dir, target)
+		}
+		cores = &coresMount{Source: dir, Target: target}
+		if !coreLimit {
+			r, err := coreRlimit()
+			if err != nil {
+				log.Fatalf("Error: --cores: %v", err)
+			}
+			if r.Hard == 0 {
+				logWarnf("--cores: the hard core size limit is 0, so no cores will be written")
+			}
+			rlimits = append(rlimits, r.String())
+		}
+	}
+	if *privileged {
+		capAdd = append(capAdd, "ALL")
+	}
+	caps, err := capabilitySet(capAdd, capDrop)
+	if err != nil {
+		log.Fatalf("Error: invalid --cap-add/--cap-drop: %v", err)
+	}
+	seccomp := &defaultSeccompProfile
+	appArmor := defaultAppArmorProfile
+	label, labelSet, labelDisabled := defaultSELinuxLabel(), false, false
+	for _, opt := range securityOpts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "seccomp":
+			if value == "unconfined" {
+				seccomp = nil
+				continue
+			}
+			if seccomp, err = loadSeccompProfile(value); err != nil {
+				log.Fatalf("Error: invalid --security-opt seccomp: %v", err)
+			}
+		case "apparmor":
+			if value == "" {
+				log.Fatalf("Error: invalid --security-opt %q", opt)
+			}
+			appArmor = value
+		case "label":
+			if value == "disable" {
+				labelDisabled = true
+				continue
+			}
+			if err := label.setOption(value); err != nil {
+				log.Fatalf("Error: invalid --security-opt %q: %v", opt, err)
+			}
+			labelSet = true
+		case "no-new-privileges":
+			*noNewPrivs = true
+			if value != "" {
+				if *noNewPrivs, err = strconv.ParseBool(value); err != nil {
+					log.Fatalf("Error: invalid --security-opt %q", opt)
+				}
+			}
+		default:
+			log.Fatalf("Error: unknown --security-opt %q", opt)
+		}
+	}
+	if *privileged {
+		seccomp, appArmor, labelDisabled = nil, "unconfined", true
+	}
+	// The default AppArmor profile is loaded on first use; unprivileged users
+	// can only pick profiles that are already loaded
+	switch {
+	case appArmor == "unconfined":
+		appArmor = ""
+	case !appArmorEnabled():
+		if appArmor != defaultAppArmorProfile {
+			log.Fatal("Error: --security-opt apparmor: AppArmor is not enabled on this host")
+		}
+		appArmor = ""
+	case appArmorProfileLoaded(appArmor):
+	case appArmor != defaultAppArmorProfile:
+		log.Fatalf("Error: --security-opt apparmor: profile %q is not loaded", appArmor)
+	case rootless:
+		logWarnf("AppArmor profile %s is not loaded; running unconfined", appArmor)
+		appArmor = ""
+	default:
+		if err := loadDefaultAppArmorProfile(); err != nil {
+			log.Fatalf("failed to load AppArmor profile %s: %v", appArmor, err)
+		}
+	}
+	// Without container-selinux the default container_t label doesn't exist,
+	// and the container runs with the runtime's label as before
+	processLabel := ""
+	switch {
+	case labelDisabled:
+	case !selinuxEnabled():
+		if labelSet {
+			log.Fatal("Error: --security-opt label: SELinux is not enabled on this host")
+		}
+	case selinuxLabelValid(label):
+		processLabel = label.String()
+		logInfof("SELinux label %s", processLabel)
+	case labelSet:
+		log.Fatalf("Error: --security-opt label: the policy doesn't know %s", label)
+	default:
+		logWarnf("SELinux policy has no %s; running with the runtime's label", label.Type)
+	}
+	if *landlock && landlockABI() == 0 {
+		log.Fatal("Error: --landlock: Landlock is not available on this kernel")
+	}
+	var seccompProg []syscall.SockFilter
+	if seccomp != nil {
+		if seccompProg, err = compileSeccomp(seccomp, caps); err != nil {
+			log.Fatalf("Error: invalid seccomp profile: %v", err)
+		}
+	}
+
+	// "none" and "host" are namespace modes, so they can't be mixed with named networks
+	hostNetwork := false
+	var attachTo []string
+	for _, n := range networks {
+		switch {
+		case n == "none" || n == "host":
+			if len(networks) > 1 {
+				log.Fatalf("Error: --network %s cannot be combined with other networks", n)
+			}
+			hostNetwork = n == "host"
+		case contains(attachTo, n):
+			log.Fatalf("Error: network %q given more than once", n)
+		default:
+			attachTo = append(attachTo, n)
+		}
+	}
+	var sysctlSettings []string
+	for _, s := range sysctls {
+		setting, err := parseSysctl(s, hostNetwork)
+		if err != nil {
+			log.Fatalf("Error: invalid --sysctl: %v", err)
+		}
+		sysctlSettings = append(sysctlSettings, setting.String())
+	}
+	attached := len(attachTo) > 0
+	if attached && rootless {
+		log.Fatal("Error: named networks need root; run rootless containers with --network none or host")
+	}
+	var rateBits uint64
+	if *netRate != "" {
+		if !attached {
+			log.Fatal("Error: --net-rate requires --network <name>")
+		}
+		var err error
+		rateBits, err = parseRate(*netRate)
+		if err != nil {
+			log.Fatalf("Error: invalid --net-rate: %v", err)
+		}
+	}
+
+	if (*mtu != 0 || *txQueueLen != 0 || *disableOffload) && !attached {
+		log.Fatal("Error: --mtu, --txqueuelen and --disable-offload require --network <name>")
+	}
+	if *mtu != 0 && (*mtu < 68 || *mtu > 65535) {
+		log.Fatalf("Error: --mtu %d out of range (68-65535)", *mtu)
+	}
+	if *txQueueLen < 0 {
+		log.Fatalf("Error: --txqueuelen must not be negative")
+	}
+
+	var ports []portMapping
+	for _, spec := range publish {
+		if hostNetwork {
+			log.Fatal("Error: --publish can't be combined with --network host, where the container's ports are the host's")
+		}
+		m, err := parsePortMapping(spec)
+		if err != nil {
+			log.Fatalf("Error: invalid --publish: %v", err)
+		}
+		ports = append(ports, m)
+	}
+	// Without a network of ours, and so always rootless, the ports are
+	// reached through the reaper, the one process that stays in the
+	// container's network namespace
+	proxied := len(ports) > 0 && !attached
+	if proxied {
+		*initReaper = true
+	}
+
+	var wgCfg *wgConfig
+	if *wireguard != "" {
+		if hostNetwork {
+			log.Fatal("Error: --wireguard cannot be combined with --network host")
+		}
+		var err error
+		if wgCfg, err = parseWGConfig(*wireguard); err != nil {
+			log.Fatalf("Error: invalid --wireguard config: %v", err)
+		}
+	}
+
+	// Sockets from systemd socket activation come first, then our own --listen ones
+	listenFiles, listenNames := inheritedListenFds()
+	boundFiles, boundNames, err := bindListeners(listen)
 	if err != nil {
-		log.Fatalf("failed to find self executable: %v", err)
+		log.Fatalf("Error: %v", err)
+	}
+	listenFiles = append(listenFiles, boundFiles...)
+	listenNames = append(listenNames, boundNames...)
+
+	// The host's policy has the last word, before anything is set up
+	policy, err := loadPolicy()
+	if err != nil {
+		log.Fatalf("Error: invalid run policy: %v", err)
+	}
+	var coresSource, logPath string
+	if cores != nil {
+		coresSource = cores.Source
+	}
+	var secretSources []string
+	for _, s := range secrets {
+		if s.Source != "-" {
+			secretSources = append(secretSources, s.Source)
+		}
+	}
+	if *logDriver == "json-file" {
+		for _, opt := range logOpts {
+			if path, ok := strings.CutPrefix(opt, "path="); ok {
+				logPath = path
+			}
+		}
+	}
+	if err := policy.check(ctx, runRequest{
+		Privileged:   *privileged,
+		HostNetwork:  hostNetwork,
+		Capabilities: caps,
+		SecurityOpts: securityOpts,
+		DeviceRules:  deviceRules,
+		CgroupConf:   cgroupConf,
+		Rootfs:       *rootfs,
+		Image:        *verityImagePath,
+		HashTree:     *verityHashTree,
+		RootHash:     *verityRootHash,
+		Cores:        coresSource,
+		Hooks:        hooks.hostPrograms(),
+		PressureHook: *pressureHook,
+		Secrets:      secretSources,
+		LogPath:      logPath,
+		Networks:     attachTo,
+		Command:      remaining,
+		Processes:    pod,
+		UID:          os.Getuid(),
+	}); err != nil {
+		log.Fatalf("Error: run denied by policy: %v", err)
+	}
+
+	selfCopy, warning := selfExe()
+	if warning != "" {
+		logWarnf("%s", warning)
+	}
+
+	// A verity image needs device-mapper, and so root
+	var verity *verityImage
+	if *verityImagePath != "" {
+		if rootless {
+			log.Fatal("Error: --verity-image needs root")
+		}
+		imageSpan := tr.start("open-image", setupSpan)
+		verity, err = openVerityImage(*verityImagePath, *verityHashTree, *verityRootHash)
+		imageSpan.finish()
+		if err != nil {
+			log.Fatalf("failed to open verity image: %v", err)
+		}
+		*rootfs = verity.Dir
+		logInfof("verified rootfs %s mounted read-only at %s", *verityImagePath, verity.Dir)
 	}
 
 	// Build the command for the child: re-exec self with “init” marker
 	childArgs := append([]string{"init"}, remaining...)
-	cmd := exec.Command(cmdPath, childArgs...)
+	cmd := exec.Command("/proc/self/exe", childArgs...)
+	cmd.Args[0] = os.Args[0]
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	// With --console-socket the container's stdio is a new terminal, whose
+	// master goes to the socket's listener rather than staying with us
+	var console *os.File
+	if *consoleSocket != "" {
+		master, slave, err := openPTY()
+		if err == nil {
+			err = sendConsole(*consoleSocket, master)
+			master.Close()
+		}
+		if err != nil {
+			verity.close()
+			log.Fatalf("failed to set up console: %v", err)
+		}
+		console = slave
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = console, console, console
+	}
+	// With --record-tty it is a new terminal we relay, and record
+	var session *ttySession
+	if *recordTTY {
+		if console != nil {
+			log.Fatal("Error: --record-tty and --console-socket both give the container a terminal")
+		}
+		if session, err = newTTYSession(); err != nil {
+			verity.close()
+			log.Fatalf("Error: %v", err)
+		}
+		console = session.slave
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = console, console, console
+	}
+	// With a --log-driver the container writes to pipes we copy from
+	clog, err := newContainerLog(*logDriver, logOpts, *hostname)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if clog != nil {
+		if console != nil {
+			log.Fatal("Error: --log-driver can't capture a --console-socket or --record-tty terminal")
+		}
+		cmd.Stdout, cmd.Stderr = clog.stdout, clog.stderr
+	}
+	// The child blocks on the read end of this pipe until its cgroup and
+	// networks are in place, so the workload never runs unconfined
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("failed to create sync pipe: %v", err)
+	}
+	cmd.ExtraFiles = append(listenFiles, syncRead)
+
+	// With SCMP_ACT_NOTIFY rules the child passes its seccomp listener back
+	// over a socket that follows the sync pipe
+	var seccompConn, seccompChildConn *os.File
+	if seccompNotifies(seccompProg) {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			log.Fatalf("failed to create seccomp socket: %v", err)
+		}
+		seccompConn, seccompChildConn = os.NewFile(uintptr(fds[0]), "seccomp"), os.NewFile(uintptr(fds[1]), "seccomp")
+		cmd.ExtraFiles = append(cmd.ExtraFiles, seccompChildConn)
+	}
 
-	// Pass rootfs, mem limit, and desired hostname via environment
-	cmd.Env = append(os.Environ(),
-		"ROOTFS="+*rootfs,
-		"MEMLIMIT="+*memLimit,
-		"HOSTNAME="+*hostname,
-	)
+	// The reaper reports the container's health on another pipe
+	var healthRead, healthWrite *os.File
+	healthFd := 0
+	if health != nil {
+		if healthRead, healthWrite, err = os.Pipe(); err != nil {
+			log.Fatalf("failed to create health pipe: %v", err)
+		}
+		healthFd = SD_LISTEN_FDS_START + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, healthWrite)
+	}
+
+	// The reaper connects to the container's own ports over a socket
+	var dialConn, dialChildConn *os.File
+	dialFd := 0
+	if proxied {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			log.Fatalf("failed to create port proxy socket: %v", err)
+		}
+		dialConn, dialChildConn = os.NewFile(uintptr(fds[0]), "dial"), os.NewFile(uintptr(fds[1]), "dial")
+		dialFd = SD_LISTEN_FDS_START + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, dialChildConn)
+	}
 
-	// Unshare UTS, PID, Mount, Network, IPC namespaces
+	// Everything else the child needs to know comes as JSON over one more pipe
+	configRead, configWrite, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("failed to create init config pipe: %v", err)
+	}
+	cmd.Env = []string{"INITPIPE=" + strconv.Itoa(SD_LISTEN_FDS_START+len(cmd.ExtraFiles)), "LOGLEVEL=" + *logLevel, "LOGFORMAT=" + *logFormat}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, configRead)
+	// The sealed copy of minictr goes last, as the child only execs it after
+	// moving its other files into place, which could overwrite it elsewhere
+	if selfCopy != nil {
+		fd := strconv.Itoa(SD_LISTEN_FDS_START + len(cmd.ExtraFiles))
+		cmd.Path = "/proc/self/fd/" + fd
+		cmd.Env = append(cmd.Env, "SELFEXE="+fd)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, selfCopy)
+	}
+	// Under a Type=notify unit the container's sd_notify messages go to
+	// systemd through us, from a socket bound into the container
+	var notify *notifyProxy
+	var notifyDir string
+	if host := os.Getenv("NOTIFY_SOCKET"); host != "" {
+		if notify, err = newNotifyProxy(host); err != nil {
+			logWarnf("failed to proxy NOTIFY_SOCKET into the container: %v", err)
+		} else {
+			notifyDir = notify.Dir
+			for _, kv := range notifyEnv() {
+				containerEnv = setEnv(containerEnv, kv)
+			}
+		}
+	}
+	initCfg := &initConfig{
+		Rootfs:        *rootfs,
+		Hostname:      *hostname,
+		Env:           containerEnv,
+		ListenFds:     len(listenFiles),
+		ListenFdNames: strings.Join(listenNames, ":"),
+		SyncFd:        SD_LISTEN_FDS_START + len(listenFiles),
+		Rlimits:       rlimits,
+		OOMScoreAdj:   *oomScoreAdj,
+		SchedPolicy:   sched,
+		Nice:          *nice,
+		Sysctls:       sysctlSettings,
+		Secrets:       secrets,
+		CgroupNS:      cgOpts.Delegate,
+		Privileged:    *privileged,
+		AppArmor:      appArmor,
+		SELinuxLabel:  processLabel,
+		Landlock:      *landlock,
+		Seccomp:       seccompProg,
+		NoNewPrivs:    *noNewPrivs,
+		User:          *user,
+		Caps:          caps,
+		Umask:         int(umaskValue),
+		Init:          *initReaper,
+		WaitOrphans:   *waitOrphans,
+		Health:        health,
+		HealthFd:      healthFd,
+		DialFd:        dialFd,
+		Pod:           pod,
+		Cores:         cores,
+		NotifyDir:     notifyDir,
+	}
+	if seccompConn != nil {
+		initCfg.SeccompNotifyFd = SD_LISTEN_FDS_START + len(listenFiles) + 1
+	}
+	if ioprio >= 0 {
+		initCfg.IOPrio = &ioprio
+	}
+
+	// Unshare UTS, PID, Mount, Network, IPC namespaces; host networking keeps the host netns
+	cloneFlags := CLONE_NEWUTS | CLONE_NEWPID | CLONE_NEWNS | CLONE_NEWNET | CLONE_NEWIPC
+	if hostNetwork {
+		cloneFlags &^= CLONE_NEWNET
+	}
+	if len(uidMaps) > 0 {
+		cloneFlags |= CLONE_NEWUSER
+	}
+	// The container dies with the runtime instead of running on unsupervised.
+	// The clone hands us a pidfd for it too, where the kernel has them.
+	pidfd := -1
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: uintptr(
-			CLONE_NEWUTS |
-				CLONE_NEWPID |
-				CLONE_NEWNS |
-				CLONE_NEWNET |
-				CLONE_NEWIPC,
-		),
+		Cloneflags: uintptr(cloneFlags),
+		Pdeathsig:  syscall.SIGKILL,
+		PidFD:      &pidfd,
+	}
+	// In a process group of its own, and the terminal's foreground one, the
+	// container gets ^C from the terminal once; the runtime forwards the rest.
+	// A console is the controlling terminal of a session of its own.
+	switch {
+	case console != nil:
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+	case foregroundTerminal(0):
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = 0
+		fallthrough
+	default:
+		cmd.SysProcAttr.Setpgid = true
+	}
+	if len(uidMaps) > 0 && !helperMaps {
+		// The maps are in place before the child execs, so it starts as root in its namespace
+		cmd.SysProcAttr.UidMappings = sysProcIDMaps(uidMaps)
+		cmd.SysProcAttr.GidMappings = sysProcIDMaps(gidMaps)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = !rootless
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(initUID), Gid: uint32(initGID), NoSetGroups: rootless}
+		if initUID != 0 {
+			// Not root in its namespace, so the init borrows capabilities for the setup
+			cmd.SysProcAttr.AmbientCaps = allCapabilities()
+		}
 	}
 
-	log.Printf("[runtime] starting child process in new namespaces")
+	// The parent death signal fires when the thread that forked the child
+	// exits, not the process, so keep that thread for as long as we run
+	runtime.LockOSThread()
+	logDebugf("starting child process in new namespaces")
+	setupSpan.finish()
+	createSpan := tr.start("create", runSpan)
 	if err := cmd.Start(); err != nil {
+		verity.close()
 		log.Fatalf("failed to start child process: %v", err)
 	}
 
 	childPid := cmd.Process.Pid
-	log.Printf("[runtime] child PID: %d", childPid)
+	proc := watchProcess(childPid, pidfd)
+	logContainer = childPid
+	logInfof("child PID: %d", childPid)
+	runSpan.set("container.pid", childPid)
+	if selfCopy != nil {
+		selfCopy.Close()
+	}
+	if notify != nil {
+		go notify.forward(childPid)
+	}
+	if console != nil {
+		console.Close()
+	}
+	if session != nil {
+		if err := session.start(childPid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			verity.close()
+			log.Fatalf("failed to record the terminal session: %v", err)
+		}
+	}
+	if err := clog.start(childPid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		verity.close()
+		log.Fatalf("failed to start container log: %v", err)
+	}
+	if healthWrite != nil {
+		healthWrite.Close()
+		go watchHealth(childPid, healthRead, events)
+	}
+	var stopSpan *span
+	var stopOnce sync.Once
+	stopSignals := forwardSignals(proc, stopSignal, func() {
+		stopOnce.Do(func() { stopSpan = tr.start("stop", runSpan) })
+	})
 
-	// If a memory limit was specified, apply it via cgroup v1
-	if *memLimit != "" {
-		limitBytes, err := parseMemLimit(*memLimit)
-		if err != nil {
-			log.Printf("[runtime] warning: could not parse memory limit %q: %v", *memLimit, err)
+	// The container holds the listening sockets and its end of the sync pipe now
+	for _, f := range listenFiles {
+		f.Close()
+	}
+	syncRead.Close()
+	configRead.Close()
+	if dialChildConn != nil {
+		dialChildConn.Close()
+	}
+	if seccompConn != nil {
+		seccompChildConn.Close()
+		go superviseSeccomp(seccompConn, childPid, seccomp, *rootfs)
+	}
+
+	// With the helpers, the child holds off until it has IDs in its user
+	// namespace; a newline ahead of the config, which JSON skips, lets it go
+	if helperMaps {
+		if err := writeIDMapsWithHelpers(childPid, uidMaps, gidMaps); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			verity.close()
+			log.Fatalf("failed to set up user namespace: %v", err)
+		}
+		configWrite.Write([]byte("\n"))
+	}
+
+	// The createRuntime hooks see the container's namespaces before its init
+	// sets them up; the init runs the container-side ones itself
+	if hooks != nil {
+		if err := runHooks(ctx, "createRuntime", hooks.CreateRuntime, childPid, "creating", *rootfs); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			verity.close()
+			log.Fatalf("failed to create container: %v", err)
+		}
+		initCfg.Hooks = &ociHooks{CreateContainer: hooks.CreateContainer, StartContainer: hooks.StartContainer}
+	}
+	initCfg.Pid = childPid
+	if err := sendInitConfig(configWrite, initCfg); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		verity.close()
+		log.Fatalf("failed to send the container its config: %v", err)
+	}
+	if len(uidMaps) > 0 {
+		logDebugf("user namespace uid_map %v gid_map %v", uidMaps, gidMaps)
+	}
+
+	// Apply the resource limits and device rules via the container's cgroup.
+	// Only the default device rules may fail without failing the run.
+	if !res.empty() {
+		limits := res
+		limits.Devices = nil
+		requested := !limits.empty() || len(deviceRules) > 0
+		if err := applyCgroupLimits(childPid, &res, cgOpts); err != nil && requested {
+			cmd.Process.Kill()
+			cmd.Wait()
+			removeCgroupLimits(childPid, cgOpts)
+			verity.close()
+			log.Fatalf("failed to apply cgroup limits: %v", err)
+		} else if err != nil {
+			logWarnf("failed to apply cgroup limits: %v", err)
 		} else {
-			if err := applyMemoryCgroupLimit(childPid, limitBytes); err != nil {
-				log.Printf("[runtime] warning: failed to apply memory cgroup limit: %v", err)
-			} else {
-				log.Printf("[runtime] applied memory limit %d bytes to PID %d", limitBytes, childPid)
+			logDebugf("applied cgroup limits to PID %d: %s", childPid, &res)
+		}
+	}
+
+	// If named networks were requested, plumb the container into their bridges
+	var firewall, containerIP string
+	var stopProxies []func()
+	if attached {
+		ips, err := attachNetworks(childPid, attachTo, linkOptions{
+			MTU:            *mtu,
+			TxQueueLen:     *txQueueLen,
+			DisableOffload: *disableOffload,
+			EgressRate:     rateBits,
+		})
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			removeCgroupLimits(childPid, cgOpts)
+			verity.close()
+			log.Fatalf("failed to attach networks: %v", err)
+		}
+		for i, name := range attachTo {
+			logInfof("attached to network %q as %s on eth%d", name, ips[i], i)
+		}
+
+		// Publish ports with DNAT on the first network, or relay them from
+		// userspace if we can't program the firewall
+		if len(ports) > 0 {
+			ip := ips[0]
+			containerIP = ip
+			if nw, err := loadNetwork(attachTo[0]); err == nil {
+				firewall = nw.Firewall
 			}
+			if err := addPortForwards(firewall, childPid, ip, ports); err != nil {
+				logWarnf("cannot program DNAT rules (%v); falling back to userspace proxy", err)
+				firewall = ""
+				for _, m := range ports {
+					stop, err := startPortProxy(m, ip)
+					if err != nil {
+						logWarnf("failed to publish %s: %v", m, err)
+						continue
+					}
+					stopProxies = append(stopProxies, stop)
+				}
+			}
+			logInfof("published %v", ports)
+		}
+	}
+	if proxied {
+		dialer := &containerDialer{conn: dialConn}
+		for _, m := range ports {
+			stop, err := startProxy(m, func() (net.Conn, error) { return dialer.dial(m.Proto, m.ContainerPort) })
+			if err != nil {
+				logWarnf("failed to publish %s: %v", m, err)
+				continue
+			}
+			stopProxies = append(stopProxies, stop)
+		}
+		logInfof("published %v through the container's init", ports)
+	}
+
+	// Bring up the WireGuard overlay last so its AllowedIPs routes take precedence
+	if wgCfg != nil {
+		if err := setupWireGuard(childPid, wgCfg); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			releaseNetworkLeases(childPid, attachTo)
+			removeCgroupLimits(childPid, cgOpts)
+			verity.close()
+			log.Fatalf("failed to set up WireGuard: %v", err)
 		}
+		logInfof("WireGuard interface wg0 up with %s", strings.Join(wgCfg.Addresses, ", "))
 	}
 
+	// Pressure stall information is only kept per cgroup on the unified hierarchy
+	var stopPressure func()
+	if len(thresholds) > 0 {
+		if !cgroupUnified() {
+			logWarnf("--pressure-threshold requires cgroup v2; not monitoring")
+		} else if stopPressure, err = watchPressure(ctx, childPid, thresholds, *pressureHook); err != nil {
+			logWarnf("failed to monitor pressure: %v", err)
+		}
+	}
+
+	// Setup is done: let the child exec the workload
+	createSpan.finish()
+	startSpan := tr.start("start", runSpan)
+	if _, err := syncWrite.Write([]byte{0}); err != nil {
+		logWarnf("failed to release container: %v", err)
+	}
+	syncWrite.Close()
+	events.send("start", childPid, nil)
+	if len(readyChecks) > 0 {
+		readySpan := tr.start("ready", runSpan)
+		go func() {
+			defer readySpan.finish()
+			if err := waitReady(ctx, proc, readyChecks, *waitForTimeout); err != nil {
+				logWarnf("container %d %v", childPid, err)
+				readySpan.fail(err.Error())
+				return
+			}
+			logEventf("container %d is ready", childPid)
+			if notify != nil {
+				if err := notify.send("READY=1"); err != nil {
+					logWarnf("failed to notify systemd: %v", err)
+				}
+			}
+		}()
+	}
+	if hooks != nil {
+		if err := runHooks(ctx, "poststart", hooks.Poststart, childPid, "running", *rootfs); err != nil {
+			logWarnf("%v", err)
+		}
+	}
+	startSpan.finish()
+
 	// Wait for the containerized process to exit, and propagate its exit code
-	if err := cmd.Wait(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+	err = cmd.Wait()
+	stopSignals()
+	proc.release()
+	session.close()
+	clog.close()
+	cleanupSpan := tr.start("cleanup", runSpan)
+	if stopPressure != nil {
+		stopPressure()
+	}
+	for _, stop := range stopProxies {
+		stop()
+	}
+	if firewall != "" {
+		if err := removePortForwards(firewall, childPid, containerIP, ports); err != nil {
+			logWarnf("failed to remove port forwarding rules: %v", err)
+		}
+	}
+	releaseNetworkLeases(childPid, attachTo)
+	notify.close()
+	if !res.empty() {
+		// A SIGKILLed workload looks like any other crash unless we say why
+		if oomKills := cgroupOOMKills(childPid, cgOpts); oomKills > 0 {
+			events.send("oom", childPid, map[string]interface{}{"kills": oomKills, "memoryLimit": *memLimit})
+			if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+				logInfof("container was OOM-killed: memory limit %s exceeded", *memLimit)
+			} else {
+				logWarnf("OOM killer killed %d process(es) in the container (memory limit %s)", oomKills, *memLimit)
+			}
+		}
+		if err := removeCgroupLimits(childPid, cgOpts); err != nil {
+			logWarnf("failed to remove cgroup: %v", err)
+		}
+	}
+	verity.close()
+	if hooks != nil {
+		if err := runHooks(ctx, "poststop", hooks.Poststop, childPid, "stopped", *rootfs); err != nil {
+			logWarnf("%v", err)
+		}
+	}
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+		// ExitCode is -1 for a signal death; shells and docker say 128+signal
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			logInfof("container killed by signal %d (%v)", ws.Signal(), ws.Signal())
+			code = 128 + int(ws.Signal())
 		}
+	} else if err != nil {
 		log.Fatalf("error waiting for child process: %v", err)
 	}
+	died := map[string]interface{}{"exitCode": code}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		died["signal"] = ws.Signal().String()
+	}
+	events.send("die", childPid, died)
+	cleanupSpan.finish()
+	stopOnce.Do(func() {}) // so a stop under way has set stopSpan
+	stopSpan.finish()
+	runSpan.set("container.exit_code", code)
+	if code != 0 {
+		runSpan.fail(fmt.Sprintf("container exited with status %d", code))
+	}
+	if err := tr.export(ctx); err != nil {
+		logWarnf("failed to export traces: %v", err)
+	}
+	events.wait()
+	if code != 0 {
+		os.Exit(code)
+	}
 }
 
 // containerInit runs inside the child after namespaces are unshared.
 func containerInit() error {
-	// 1) Read environment variables
-	newRoot := os.Getenv("ROOTFS")
-	if newRoot == "" {
-		return fmt.Errorf("ROOTFS not set")
+	// 1) If newuidmap/newgidmap map our IDs, wait for them. We were exec'd while
+	//    still unmapped and so without capabilities; exec'ing again as the
+	//    namespace's root grants them. The config stays in the pipe meanwhile.
+	if lostCapabilities() {
+		pipe, err := initPipe()
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 1)
+		if _, err := pipe.Read(buf); err != nil {
+			return fmt.Errorf("runtime exited before the user namespace was set up: %w", err)
+		}
+		if buf[0] != '\n' {
+			// We did exec again, and still have no capabilities
+			return fmt.Errorf("the user namespace maps don't give the container init capabilities")
+		}
+		if err := syscall.Exec("/proc/self/exe", os.Args, os.Environ()); err != nil {
+			return fmt.Errorf("re-exec in user namespace: %w", err)
+		}
+	}
+
+	// 2) Read our config from the runtime
+	cfg, err := readInitConfig()
+	if err != nil {
+		return err
+	}
+	logContainer = cfg.Pid
+	if cfg.Rootfs == "" {
+		return fmt.Errorf("no rootfs in init config")
+	}
+	newRoot, hostname, env := cfg.Rootfs, cfg.Hostname, cfg.Env
+	// Tools we run from the rootfs, like ip below, are found on the workload's PATH
+	if path, ok := lookupEnv(env, "PATH"); ok {
+		os.Setenv("PATH", path)
 	}
-	memLimit := os.Getenv("MEMLIMIT") // may be empty
-	hostname := os.Getenv("HOSTNAME") // e.g. "mini-container"
 
-	// 2) Set hostname inside UTS namespace
+	// 3) Set hostname inside UTS namespace
 	if hostname != "" {
 		if err := syscall.Sethostname([]byte(hostname)); err != nil {
 			return fmt.Errorf("sethostname(%q): %w", hostname, err)
 		}
 	}
 
-	// 3) Make sure mounts below are private so that unmounts stay in this namespace
+	// 4) Leave the runtime's session keyring behind
+	if err := joinSessionKeyring(); err != nil {
+		return err
+	}
+
+	// 5) Make sure mounts below are private so that unmounts stay in this namespace
 	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
 		return fmt.Errorf("remount / as private: %w", err)
 	}
 
-	// 4) Pivot_root (or fallback to chroot) into newRoot
+	// 6) Mount /proc inside the new root. This happens before the pivot, as a
+	//    user namespace may only mount procfs while the host's is still visible.
+	if err := mountProc(newRoot); err != nil {
+		return fmt.Errorf("mountProc: %w", err)
+	}
+
+	// 7) A privileged container gets the host's devices and a writable /sys;
+	//    any other has the kernel interfaces it shouldn't read masked
+	if cfg.Privileged {
+		if err := mountPrivileged(newRoot); err != nil {
+			return fmt.Errorf("mountPrivileged: %w", err)
+		}
+	} else if err := maskPaths(newRoot); err != nil {
+		return fmt.Errorf("maskPaths: %w", err)
+	}
+
+	// 8) Bind the --cores directory and the sd_notify socket and run the
+	//    createContainer hooks while the host's filesystem is still in view,
+	//    then pivot_root (or fallback to chroot) into newRoot
+	if cfg.Cores != nil {
+		if err := mountCores(newRoot, cfg.Cores); err != nil {
+			return err
+		}
+	}
+	if cfg.NotifyDir != "" {
+		if err := mountNotifySocket(newRoot, cfg.NotifyDir); err != nil {
+			return err
+		}
+	}
+	if cfg.Hooks != nil {
+		if err := runHooks(context.Background(), "createContainer", cfg.Hooks.CreateContainer, cfg.Pid, "creating", cfg.Rootfs); err != nil {
+			return err
+		}
+	}
 	if err := pivotRoot(newRoot); err != nil {
 		return fmt.Errorf("pivotRoot: %w", err)
 	}
 
-	// 5) Mount /proc inside the new root
-	if err := mountProc(); err != nil {
-		return fmt.Errorf("mountProc: %w", err)
+	// 9) Put the --secret files in place
+	if len(cfg.Secrets) > 0 {
+		if err := mountSecrets(cfg.Secrets); err != nil {
+			return err
+		}
 	}
 
-	// 6) Bring up loopback interface inside new net namespace (best-effort)
+	// 10) Bring up loopback interface inside new net namespace (best-effort)
 	if err := setupLoopback(); err != nil {
-		log.Printf("[container] warning: failed to bring up loopback: %v", err)
+		logWarnf("failed to bring up loopback: %v", err)
+	}
+
+	// 11) Hand over any sockets passed at fd 3+ under the socket activation protocol
+	if cfg.ListenFds > 0 {
+		env = append(env, listenFdsEnv(cfg.ListenFds, cfg.ListenFdNames)...)
+	}
+
+	// 12) Apply --ulimit resource limits, the OOM score and the CPU and IO
+	//    scheduling settings; they survive the exec below
+	if len(cfg.Rlimits) > 0 {
+		if err := applyRlimits(cfg.Rlimits); err != nil {
+			return err
+		}
+	}
+	if cfg.OOMScoreAdj != 0 {
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(cfg.OOMScoreAdj)), 0644); err != nil {
+			return fmt.Errorf("set oom_score_adj: %w", err)
+		}
+	}
+	if cfg.SchedPolicy != "" {
+		if err := applySchedPolicy(cfg.SchedPolicy); err != nil {
+			return err
+		}
+	}
+	if cfg.Nice != 0 {
+		if err := applyNice(cfg.Nice); err != nil {
+			return err
+		}
+	}
+	if cfg.IOPrio != nil {
+		if err := applyIOPrio(*cfg.IOPrio); err != nil {
+			return err
+		}
+	}
+
+	// 13) Wait until the runtime has placed us in our cgroup and networks,
+	//     then run the startContainer hooks
+	if err := waitForRuntime(cfg.SyncFd); err != nil {
+		return err
+	}
+	if cfg.Hooks != nil {
+		if err := runHooks(context.Background(), "startContainer", cfg.Hooks.StartContainer, cfg.Pid, "created", cfg.Rootfs); err != nil {
+			return err
+		}
+	}
+
+	// 14) Set the --sysctl parameters, now that our network interfaces exist
+	if len(cfg.Sysctls) > 0 {
+		if err := applySysctls(cfg.Sysctls); err != nil {
+			return err
+		}
+	}
+
+	// 15) With a delegated cgroup, take over the cgroup we were just placed in
+	if cfg.CgroupNS {
+		if err := enterCgroupNamespace(); err != nil {
+			return err
+		}
+	}
+
+	// 16) Switch to the AppArmor profile or SELinux label on exec
+	if cfg.AppArmor != "" {
+		if err := applyAppArmor(cfg.AppArmor); err != nil {
+			return err
+		}
+	}
+	if cfg.SELinuxLabel != "" {
+		if err := applySELinux(cfg.SELinuxLabel); err != nil {
+			return err
+		}
+	}
+
+	// 17) Shut the workload in with Landlock, while we still hold CAP_SYS_ADMIN
+	if cfg.Landlock {
+		if err := applyLandlock(); err != nil {
+			return err
+		}
+	}
+
+	// 18) Without no_new_privs the seccomp filter can only be loaded while we
+	//     still hold CAP_SYS_ADMIN, so before the capabilities go
+	if len(cfg.Seccomp) > 0 && !cfg.NoNewPrivs {
+		if err := applySeccomp(cfg.Seccomp, cfg.SeccompNotifyFd); err != nil {
+			return err
+		}
+	}
+
+	// 19) Become the --user, while we can still set any IDs, and give the
+	//     workload its home unless --env did
+	home := "/root"
+	if cfg.User != "" {
+		u, err := lookupUser(cfg.User)
+		if err != nil {
+			return fmt.Errorf("--user %s: %w", cfg.User, err)
+		}
+		if err := switchUser(u); err != nil {
+			return fmt.Errorf("--user %s: %w", cfg.User, err)
+		}
+		home = u.Home
+	}
+	if _, ok := lookupEnv(env, "HOME"); !ok {
+		env = append(env, "HOME="+home)
+	}
+
+	// 20) Drop to the container's capability set, which also takes away any
+	//     capabilities lent to a non-root init for the setup
+	if err := applyCapabilities(cfg.Caps); err != nil {
+		return err
+	}
+
+	// 21) Keep exec of setuid and file-capability binaries from granting more
+	if cfg.NoNewPrivs {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+			return fmt.Errorf("set no_new_privs: %w", errno)
+		}
 	}
 
-	// 7) (Optional) If memLimit is still set, you could double-check cgroup here
-	//    But typically parent has already placed the child in the right cgroup.
+	// 22) Otherwise the seccomp filter goes on last, so that it doesn't have to
+	//     allow anything but the exec
+	if len(cfg.Seccomp) > 0 && cfg.NoNewPrivs {
+		if err := applySeccomp(cfg.Seccomp, cfg.SeccompNotifyFd); err != nil {
+			return err
+		}
+	}
 
-	// 8) Exec the user’s command (everything after “init”)
-	if len(os.Args) < 3 {
-		return fmt.Errorf("no command provided for container to run")
+	// 23) Start from the --umask rather than whatever the runtime was run with
+	syscall.Umask(cfg.Umask)
+
+	// 24) Exec the user’s command (everything after “init”), or with --init
+	//     run it, or the --pod processes, under a reaper that stays on as PID 1
+	procs := cfg.Pod
+	if len(procs) == 0 {
+		if len(os.Args) < 3 {
+			return fmt.Errorf("no command provided for container to run")
+		}
+		procs = []podProcess{{Name: filepath.Base(os.Args[2]), Args: os.Args[2:]}}
+	}
+	cmdPath := procs[0].Args[0]
+	cmdArgs := procs[0].Args
+	if cfg.Init {
+		code, err := runReaper(procs, env, cfg)
+		if err != nil {
+			return err
+		}
+		os.Exit(code)
 	}
-	cmdPath := os.Args[2]
-	cmdArgs := os.Args[2:]
-	if err := syscall.Exec(cmdPath, cmdArgs, os.Environ()); err != nil {
+	if err := syscall.Exec(cmdPath, cmdArgs, env); err != nil {
 		return fmt.Errorf("exec %q %v: %w", cmdPath, cmdArgs, err)
 	}
 	return nil
 }
 
+// waitForRuntime blocks on the sync pipe at fd until the runtime sends the
+// go-ahead byte, and closes it. EOF without it means the runtime gave up or
+// died, in which case the workload must not start.
+func waitForRuntime(fd int) error {
+	runtimeSync := os.NewFile(uintptr(fd), "sync")
+	defer runtimeSync.Close()
+	buf := make([]byte, 1)
+	if _, err := runtimeSync.Read(buf); err != nil {
+		return fmt.Errorf("runtime exited before the container was set up: %w", err)
+	}
+	return nil
+}
+
 // pivotRoot moves the current root to newRoot and makes newRoot “/”.
 // It creates a temporary directory “.pivot_root” inside newRoot to hold the old root.
 func pivotRoot(newRoot string) error {
@@ -168,7 +1660,9 @@ func pivotRoot(newRoot string) error {
 	}
 
 	putOld := filepath.Join(absRoot, ".pivot_root")
-	if err := os.MkdirAll(putOld, 0700); err != nil {
+	if err := os.MkdirAll(putOld, 0700); errors.Is(err, syscall.EROFS) {
+		return pivotReadOnlyRoot(absRoot)
+	} else if err != nil {
 		return fmt.Errorf("mkdir %q: %w", putOld, err)
 	}
 
@@ -201,19 +1695,90 @@ func pivotRoot(newRoot string) error {
 	return nil
 }
 
-// mountProc mounts a new procfs at /proc.
-func mountProc() error {
+// pivotReadOnlyRoot pivots into a root that has no room for .pivot_root,
+// such as a verity image: pivot_root(".", ".") stacks the old root on top of
+// the new one, from where it can be unmounted.
+func pivotReadOnlyRoot(absRoot string) error {
+	if err := syscall.Mount(absRoot, absRoot, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mount --bind %q onto itself: %w", absRoot, err)
+	}
+	if err := syscall.Chdir(absRoot); err != nil {
+		return fmt.Errorf("chdir %q: %w", absRoot, err)
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root(%q, %q): %w", absRoot, absRoot, err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir / after pivot: %w", err)
+	}
+	return nil
+}
+
+// mountProc mounts a new procfs at /proc under root.
+func mountProc(root string) error {
+	procDir := filepath.Join(root, "proc")
 	// Ensure /proc exists
-	if err := os.MkdirAll("/proc", 0555); err != nil {
+	if err := os.MkdirAll(procDir, 0555); err != nil {
 		return fmt.Errorf("mkdir /proc: %w", err)
 	}
-	// mount("proc", "/proc", "proc", 0, "")
-	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+	// mount("proc", "<root>/proc", "proc", 0, "")
+	if err := syscall.Mount("proc", procDir, "proc", 0, ""); err != nil {
 		return fmt.Errorf("mount procfs: %w", err)
 	}
 	return nil
 }
 
+// mountPrivileged bind-mounts the host's /dev into root, and mounts sysfs
+// with the host's cgroup hierarchy on top, all writable. It runs before the
+// pivot, like mountProc.
+func mountPrivileged(root string) error {
+	devDir := filepath.Join(root, "dev")
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		return fmt.Errorf("mkdir /dev: %w", err)
+	}
+	if err := syscall.Mount("/dev", devDir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount /dev: %w", err)
+	}
+
+	sysDir := filepath.Join(root, "sys")
+	if err := os.MkdirAll(sysDir, 0555); err != nil {
+		return fmt.Errorf("mkdir /sys: %w", err)
+	}
+	if err := syscall.Mount("sysfs", sysDir, "sysfs", 0, ""); err != nil {
+		return fmt.Errorf("mount sysfs: %w", err)
+	}
+	cgroupDir := filepath.Join(root, cgroupMountpoint)
+	if err := syscall.Mount(cgroupMountpoint, cgroupDir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %w", cgroupMountpoint, err)
+	}
+	return nil
+}
+
+// maskedPaths are hidden from unprivileged containers: /proc/keys would
+// list the keys of every keyring the container can view, its own or not.
+var maskedPaths = []string{
+	"/proc/keys",
+}
+
+// maskPaths bind-mounts /dev/null over each of the maskedPaths under root
+// that exists. It runs after mountProc and before the pivot, while the
+// host's /dev/null is still at hand.
+func maskPaths(root string) error {
+	for _, p := range maskedPaths {
+		target := filepath.Join(root, p)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		if err := syscall.Mount("/dev/null", target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("mask %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
 // setupLoopback is a best-effort attempt to bring up the loopback interface inside the new net namespace.
 // We exec "ip link set lo up" if the "ip" binary is present.
 func setupLoopback() error {
@@ -265,29 +1830,21 @@ func parseMemLimit(s string) (int64, error) {
 	return base * mult, nil
 }
 
-// applyMemoryCgroupLimit creates a memory cgroup under cgroup v1 and limits the given PID.
-// Requires that /sys/fs/cgroup/memory is mounted and writable (and that the runtime has permissions).
-func applyMemoryCgroupLimit(pid int, limitBytes int64) error {
-	// e.g. /sys/fs/cgroup/memory/mini_<pid>
-	cgroupBase := "/sys/fs/cgroup/memory"
-	if _, err := os.Stat(cgroupBase); err != nil {
-		return fmt.Errorf("%q not found or not accessible: %w", cgroupBase, err)
-	}
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
 
-	cgroupPath := filepath.Join(cgroupBase, fmt.Sprintf("mini_%d", pid))
-	if err := os.Mkdir(cgroupPath, 0755); err != nil {
-		return fmt.Errorf("mkdir %q: %w", cgroupPath, err)
-	}
+func (l *stringList) String() string { return strings.Join(*l, ",") }
 
-	limitPath := filepath.Join(cgroupPath, "memory.limit_in_bytes")
-	if err := os.WriteFile(limitPath, []byte(strconv.FormatInt(limitBytes, 10)), 0644); err != nil {
-		return fmt.Errorf("write %q: %w", limitPath, err)
-	}
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
 
-	procsPath := filepath.Join(cgroupPath, "cgroup.procs")
-	if err := os.WriteFile(procsPath, []byte(strconv.Itoa(pid)), 0644); err != nil {
-		return fmt.Errorf("write %q: %w", procsPath, err)
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-
-	return nil
+	return false
 }
@@ -0,0 +1,723 @@
+// network.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"unsafe"
+)
+
+// networksDir holds one JSON file per user-defined network, under the
+// config's storage-root.
+var networksDir = filepath.Join(defaultStorageRoot, "networks")
+
+// maxIfNameLen is IFNAMSIZ minus the trailing NUL.
+const maxIfNameLen = 15
+
+// Network is a named Linux bridge with its own IPv4 subnet.
+type Network struct {
+	Name    string `json:"name"`
+	Bridge  string `json:"bridge"`
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Firewall is the backend ("nftables" or "iptables") holding this network's NAT rules.
+	Firewall string `json:"firewall"`
+	// Leases maps each address handed out to the PID of the container holding it.
+	Leases map[string]int `json:"leases,omitempty"`
+}
+
+// linkOptions tunes the container's veth pair.
+type linkOptions struct {
+	MTU            int    // applied to both ends; 0 keeps the kernel default
+	TxQueueLen     int    // 0 keeps the kernel default
+	DisableOffload bool   // turn off checksum and TCP segmentation offloads inside the container
+	EgressRate     uint64 // bits per second the container may send; 0 means unlimited
+}
+
+// ethtool commands for the legacy per-feature interface (linux/ethtool.h).
+const (
+	SIOCETHTOOL     = 0x8946
+	ETHTOOL_SRXCSUM = 0x15
+	ETHTOOL_STXCSUM = 0x17
+	ETHTOOL_STSO    = 0x1f
+)
+
+var networkNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// runNetwork dispatches the "minictr network <command>" management commands.
+func runNetwork(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: minictr network create|ls|rm|inspect [args]")
+	}
+	switch args[0] {
+	case "create":
+		return networkCreate(args[1:])
+	case "ls", "list":
+		return networkList()
+	case "rm", "remove":
+		return networkRemove(args[1:])
+	case "inspect":
+		return networkInspect(args[1:])
+	}
+	return fmt.Errorf("unknown network command %q", args[0])
+}
+
+func networkCreate(args []string) error {
+	createCmd := flag.NewFlagSet("network create", flag.ExitOnError)
+	subnet := createCmd.String("subnet", "", "IPv4 subnet in CIDR form (default: next free 10.88.x.0/24)")
+	gateway := createCmd.String("gateway", "", "Gateway address on the bridge (default: first address of the subnet)")
+	bridge := createCmd.String("bridge", "", "Name of the host bridge device (default: mctr-<name>)")
+	firewall := createCmd.String("firewall", firewallAuto, "Backend for NAT rules: auto, nftables or iptables")
+	createCmd.Parse(args)
+
+	if createCmd.NArg() != 1 {
+		return fmt.Errorf("usage: minictr network create [flags] NAME")
+	}
+	name := createCmd.Arg(0)
+	if !networkNameRE.MatchString(name) {
+		return fmt.Errorf("invalid network name %q", name)
+	}
+	if name == "none" || name == "host" {
+		return fmt.Errorf("network name %q is reserved", name)
+	}
+
+	unlock, err := lockNetworks()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	for _, nw := range existing {
+		if nw.Name == name {
+			return fmt.Errorf("network %q already exists", name)
+		}
+	}
+
+	// 1) Pick or validate the subnet, refusing overlaps with other networks
+	var ipnet *net.IPNet
+	if *subnet == "" {
+		ipnet, err = nextFreeSubnet(existing)
+	} else {
+		ipnet, err = parseSubnet(*subnet)
+		if err == nil {
+			for _, nw := range existing {
+				if subnetsOverlap(ipnet, nw.ipnet()) {
+					err = fmt.Errorf("subnet %s overlaps network %q (%s)", ipnet, nw.Name, nw.Subnet)
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// 2) Gateway defaults to the first host address
+	gw := nextIP(ipnet.IP)
+	if *gateway != "" {
+		gw = net.ParseIP(*gateway).To4()
+		if gw == nil || !ipnet.Contains(gw) || gw.Equal(ipnet.IP) || gw.Equal(broadcastIP(ipnet)) {
+			return fmt.Errorf("gateway %q is not a usable address in %s", *gateway, ipnet)
+		}
+	}
+
+	// 3) Bridge name must fit IFNAMSIZ and be unique
+	br := *bridge
+	if br == "" {
+		br = "mctr-" + name
+		if len(br) > maxIfNameLen {
+			br = br[:maxIfNameLen]
+		}
+	}
+	if len(br) > maxIfNameLen {
+		return fmt.Errorf("bridge name %q longer than %d characters", br, maxIfNameLen)
+	}
+	for _, nw := range existing {
+		if nw.Bridge == br {
+			return fmt.Errorf("bridge %q already used by network %q", br, nw.Name)
+		}
+	}
+
+	backend, err := resolveFirewall(*firewall)
+	if err != nil {
+		return err
+	}
+
+	nw := &Network{Name: name, Bridge: br, Subnet: ipnet.String(), Gateway: gw.String(), Firewall: backend}
+	if err := setupBridge(nw); err != nil {
+		return err
+	}
+	if err := saveNetwork(nw); err != nil {
+		teardownBridge(nw)
+		return err
+	}
+	fmt.Println(nw.Name)
+	return nil
+}
+
+func networkList() error {
+	networks, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBRIDGE\tSUBNET\tGATEWAY\tCONTAINERS")
+	for _, nw := range networks {
+		pruneLeases(nw)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", nw.Name, nw.Bridge, nw.Subnet, nw.Gateway, len(nw.Leases))
+	}
+	return w.Flush()
+}
+
+func networkRemove(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: minictr network rm NAME [NAME...]")
+	}
+	unlock, err := lockNetworks()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, name := range args {
+		nw, err := loadNetwork(name)
+		if err != nil {
+			return err
+		}
+		pruneLeases(nw)
+		if len(nw.Leases) > 0 {
+			return fmt.Errorf("network %q still has %d attached container(s)", name, len(nw.Leases))
+		}
+		if err := teardownBridge(nw); err != nil {
+			return err
+		}
+		if err := os.Remove(networkPath(name)); err != nil {
+			return fmt.Errorf("remove %q: %w", networkPath(name), err)
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func networkInspect(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: minictr network inspect NAME [NAME...]")
+	}
+	var networks []*Network
+	for _, name := range args {
+		nw, err := loadNetwork(name)
+		if err != nil {
+			return err
+		}
+		pruneLeases(nw)
+		networks = append(networks, nw)
+	}
+	out, err := json.MarshalIndent(networks, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// attachNetworks connects pid to each named network in order as eth0, eth1, ...
+// and returns the addresses assigned. Only the first network provides the
+// default route. On failure the leases taken so far are released.
+func attachNetworks(pid int, names []string, opts linkOptions) ([]string, error) {
+	var ips []string
+	for i, name := range names {
+		ip, err := attachNetwork(pid, name, fmt.Sprintf("eth%d", i), i == 0, opts)
+		if err != nil {
+			releaseNetworkLeases(pid, names[:i])
+			return nil, fmt.Errorf("network %q: %w", name, err)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// releaseNetworkLeases releases the addresses held by pid on each named network.
+func releaseNetworkLeases(pid int, names []string) {
+	for _, name := range names {
+		if err := releaseNetworkLease(name, pid); err != nil {
+			logWarnf("failed to release address on network %q: %v", name, err)
+		}
+	}
+}
+
+// attachNetwork connects the network namespace of pid to the named network.
+// A veth pair is created with the host end enslaved to the bridge and the peer
+// moved into the container as ifname, configured with a leased address and,
+// if defaultRoute is set, a default route via the gateway. It returns the
+// address assigned. A network plugin of that name, if there is no such
+// network, does all this itself.
+func attachNetwork(pid int, name, ifname string, defaultRoute bool, opts linkOptions) (string, error) {
+	if p := networkPlugin(name); p != nil {
+		return attachPluginNetwork(p, pid, ifname, defaultRoute, opts)
+	}
+	unlock, err := lockNetworks()
+	if err != nil {
+		return "", err
+	}
+	nw, err := loadNetwork(name)
+	if err == nil {
+		// The bridge does not survive a reboot, so recreate it on demand
+		err = setupBridge(nw)
+	}
+	var ip net.IP
+	if err == nil {
+		ip, err = allocateIP(nw, pid)
+	}
+	if err == nil {
+		err = saveNetwork(nw)
+	}
+	unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if err := connectVeth(pid, nw, ip, ifname, defaultRoute, opts); err != nil {
+		releaseNetworkLease(name, pid)
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// connectVeth creates the veth pair for pid and configures both of its ends.
+func connectVeth(pid int, nw *Network, ip net.IP, ifname string, defaultRoute bool, opts linkOptions) error {
+	hostIf := fmt.Sprintf("mc%d-%s", pid, ifname)
+	peerIf := fmt.Sprintf("mp%d-%s", pid, ifname)
+	if len(hostIf) > maxIfNameLen {
+		return fmt.Errorf("interface name %q longer than %d characters", hostIf, maxIfNameLen)
+	}
+
+	// 1) Create the pair and push the peer end into the container's netns
+	if err := runIP("link", "add", hostIf, "type", "veth", "peer", "name", peerIf); err != nil {
+		return err
+	}
+	if err := runIP("link", "set", peerIf, "netns", fmt.Sprint(pid)); err != nil {
+		runIP("link", "del", hostIf)
+		return err
+	}
+
+	// 2) Enslave the host end to the bridge
+	tuning := opts.ipLinkArgs()
+	if err := runIP(append([]string{"link", "set", hostIf, "master", nw.Bridge, "up"}, tuning...)...); err != nil {
+		runIP("link", "del", hostIf)
+		return err
+	}
+
+	// 3) Rename and address the peer from inside the container's netns
+	prefix, _ := nw.ipnet().Mask.Size()
+	err := withNetns(pid, func() error {
+		if err := runIP("link", "set", peerIf, "name", ifname); err != nil {
+			return err
+		}
+		if err := runIP("addr", "add", fmt.Sprintf("%s/%d", ip, prefix), "dev", ifname); err != nil {
+			return err
+		}
+		if err := runIP(append([]string{"link", "set", ifname, "up"}, tuning...)...); err != nil {
+			return err
+		}
+		if opts.DisableOffload {
+			if err := disableOffloads(ifname); err != nil {
+				return err
+			}
+		}
+		if opts.EgressRate > 0 {
+			if err := limitEgress(ifname, opts.EgressRate); err != nil {
+				return err
+			}
+		}
+		if !defaultRoute {
+			return nil
+		}
+		return runIP("route", "add", "default", "via", nw.Gateway, "dev", ifname)
+	})
+	if err != nil {
+		// Deleting the host end also destroys the peer
+		runIP("link", "del", hostIf)
+		return fmt.Errorf("configure %s in netns of PID %d: %w", ifname, pid, err)
+	}
+	return nil
+}
+
+func (o linkOptions) ipLinkArgs() []string {
+	var args []string
+	if o.MTU > 0 {
+		args = append(args, "mtu", strconv.Itoa(o.MTU))
+	}
+	if o.TxQueueLen > 0 {
+		args = append(args, "txqueuelen", strconv.Itoa(o.TxQueueLen))
+	}
+	return args
+}
+
+// disableOffloads turns off rx/tx checksumming and TSO on ifname in the
+// calling thread's netns, the ioctl equivalent of
+// "ethtool -K ifname rx off tx off tso off".
+func disableOffloads(ifname string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open ethtool socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	for _, cmd := range []uint32{ETHTOOL_SRXCSUM, ETHTOOL_STXCSUM, ETHTOOL_STSO} {
+		// struct ethtool_value { __u32 cmd; __u32 data; } with data = 0 (off)
+		value := [2]uint32{cmd, 0}
+		// struct ifreq { char ifr_name[IFNAMSIZ]; void *ifr_data; ... }
+		var ifr [40]byte
+		copy(ifr[:maxIfNameLen], ifname)
+		*(*uintptr)(unsafe.Pointer(&ifr[16])) = uintptr(unsafe.Pointer(&value))
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+		runtime.KeepAlive(&value)
+		if errno != 0 {
+			return fmt.Errorf("ethtool cmd %#x on %s: %w", cmd, ifname, errno)
+		}
+	}
+	return nil
+}
+
+// releaseNetworkLease returns any address held by pid on the named network,
+// or has its plugin detach pid.
+func releaseNetworkLease(name string, pid int) error {
+	if p := networkPlugin(name); p != nil {
+		return p.call("detach", networkPluginRequest{Container: pid, Netns: fmt.Sprintf("/proc/%d/ns/net", pid)}, nil)
+	}
+	unlock, err := lockNetworks()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	nw, err := loadNetwork(name)
+	if err != nil {
+		return err
+	}
+	for ip, holder := range nw.Leases {
+		if holder == pid {
+			delete(nw.Leases, ip)
+		}
+	}
+	return saveNetwork(nw)
+}
+
+// allocateIP leases the lowest free host address of nw to pid.
+func allocateIP(nw *Network, pid int) (net.IP, error) {
+	pruneLeases(nw)
+	if nw.Leases == nil {
+		nw.Leases = make(map[string]int)
+	}
+	ipnet := nw.ipnet()
+	bcast := broadcastIP(ipnet)
+	for ip := nextIP(ipnet.IP); ipnet.Contains(ip) && !ip.Equal(bcast); ip = nextIP(ip) {
+		if ip.String() == nw.Gateway {
+			continue
+		}
+		if _, taken := nw.Leases[ip.String()]; taken {
+			continue
+		}
+		nw.Leases[ip.String()] = pid
+		return ip, nil
+	}
+	return nil, fmt.Errorf("network %q has no free addresses in %s", nw.Name, nw.Subnet)
+}
+
+// pruneLeases drops leases held by processes that no longer exist.
+func pruneLeases(nw *Network) {
+	for ip, pid := range nw.Leases {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			delete(nw.Leases, ip)
+		}
+	}
+}
+
+// setupBridge creates, addresses, and NATs the bridge for nw if it doesn't exist yet.
+func setupBridge(nw *Network) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", nw.Bridge)); err != nil {
+		if err := runIP("link", "add", "name", nw.Bridge, "type", "bridge"); err != nil {
+			return err
+		}
+		prefix, _ := nw.ipnet().Mask.Size()
+		if err := runIP("addr", "add", fmt.Sprintf("%s/%d", nw.Gateway, prefix), "dev", nw.Bridge); err != nil {
+			runIP("link", "del", nw.Bridge)
+			return err
+		}
+		setupMasquerade(nw)
+	}
+	return runIP("link", "set", nw.Bridge, "up")
+}
+
+// setupMasquerade enables forwarding and NATs traffic leaving the subnet.
+// It is best-effort: the network is still usable container-to-container without it.
+func setupMasquerade(nw *Network) {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		logWarnf("failed to enable IPv4 forwarding: %v", err)
+	}
+	if err := addMasquerade(nw); err != nil {
+		logWarnf("failed to set up masquerading for %s via %s: %v", nw.Subnet, nw.Firewall, err)
+	}
+}
+
+// teardownBridge removes the bridge and NAT rule created by setupBridge.
+func teardownBridge(nw *Network) error {
+	removeMasquerade(nw)
+	if _, err := os.Stat(filepath.Join("/sys/class/net", nw.Bridge)); err != nil {
+		return nil
+	}
+	return runIP("link", "del", nw.Bridge)
+}
+
+// withNetns runs fn on an OS thread that has joined the network namespace of pid.
+// Commands started from fn inherit that namespace.
+func withNetns(pid int, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread is deliberately left locked (and thus discarded when the
+		// goroutine exits) if we fail to switch it back to the original netns.
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer origin.Close()
+		target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer target.Close()
+
+		if err := setns(target.Fd(), CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("setns to netns of PID %d: %w", pid, err)
+			return
+		}
+		fnErr := fn()
+		if err := setns(origin.Fd(), CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("setns back to original netns: %w", err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+	return <-errCh
+}
+
+func setns(fd uintptr, nstype int) error {
+	if _, _, errno := syscall.RawSyscall(SYS_SETNS, fd, uintptr(nstype), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runIP runs the "ip" binary and folds its output into the returned error.
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// lockNetworks takes an exclusive lock on the network store and returns its release func.
+func lockNetworks() (func(), error) {
+	if err := os.MkdirAll(networksDir, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", networksDir, err)
+	}
+	lockPath := filepath.Join(networksDir, ".lock")
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", lockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %q: %w", lockPath, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func networkPath(name string) string {
+	return filepath.Join(networksDir, name+".json")
+}
+
+func loadNetwork(name string) (*Network, error) {
+	if !networkNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	data, err := os.ReadFile(networkPath(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("network %q not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nw Network
+	if err := json.Unmarshal(data, &nw); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", networkPath(name), err)
+	}
+	return &nw, nil
+}
+
+// saveNetwork writes nw atomically so readers never observe a partial file.
+func saveNetwork(nw *Network) error {
+	data, err := json.MarshalIndent(nw, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := networkPath(nw.Name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write %q: %w", tmp, err)
+	}
+	return os.Rename(tmp, networkPath(nw.Name))
+}
+
+func listNetworks() ([]*Network, error) {
+	matches, err := filepath.Glob(filepath.Join(networksDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var networks []*Network
+	for _, m := range matches {
+		nw, err := loadNetwork(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, nw)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+func (nw *Network) ipnet() *net.IPNet {
+	_, ipnet, _ := net.ParseCIDR(nw.Subnet)
+	return ipnet
+}
+
+func parseSubnet(s string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %w", s, err)
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %q is not IPv4", s)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("subnet %q is too small", s)
+	}
+	ipnet.IP = ipnet.IP.To4()
+	return ipnet, nil
+}
+
+// nextFreeSubnet returns the first 10.88.x.0/24 not overlapping an existing network.
+func nextFreeSubnet(existing []*Network) (*net.IPNet, error) {
+	for i := 0; i < 256; i++ {
+		candidate, _ := parseSubnet(fmt.Sprintf("10.88.%d.0/24", i))
+		free := true
+		for _, nw := range existing {
+			if subnetsOverlap(candidate, nw.ipnet()) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in 10.88.0.0/16, use --subnet")
+}
+
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip.To4()))
+	copy(next, ip.To4())
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func broadcastIP(ipnet *net.IPNet) net.IP {
+	ip := ipnet.IP.To4()
+	bcast := make(net.IP, len(ip))
+	for i := range ip {
+		bcast[i] = ip[i] | ^ipnet.Mask[i]
+	}
+	return bcast
+}
+
+// limitEgress installs a token bucket filter as the root qdisc of ifname in the
+// calling thread's netns, capping what the container can send at bitsPerSec.
+func limitEgress(ifname string, bitsPerSec uint64) error {
+	// Allow ~10ms worth of traffic per burst, but never less than a full-size frame
+	burst := bitsPerSec / 8 / 100
+	if burst < 1600 {
+		burst = 1600
+	}
+	return runTC("qdisc", "add", "dev", ifname, "root", "tbf",
+		"rate", fmt.Sprintf("%dbit", bitsPerSec),
+		"burst", fmt.Sprintf("%db", burst),
+		"latency", "50ms")
+}
+
+// parseRate parses tc-style rates like "512kbit", "10mbit" or "1mbps" into bits per second.
+// Units are decimal (k = 1000); the "bps" forms are bytes per second, as in tc.
+func parseRate(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mult   uint64
+	}{
+		{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+		{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(s, u.suffix), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse integer from %q: %w", s, err)
+			}
+			if n == 0 {
+				return 0, fmt.Errorf("rate must be positive")
+			}
+			if n > math.MaxUint64/u.mult {
+				return 0, fmt.Errorf("rate %q is too large", s)
+			}
+			return n * u.mult, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rate %q (expected a unit such as kbit, mbit, gbit or mbps)", s)
+}
+
+func runTC(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
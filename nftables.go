@@ -0,0 +1,375 @@
+// nftables.go
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Minimal nf_tables client speaking netfilter netlink directly, so that NAT
+// can be programmed without the nft binary. Only what minictr needs is
+// implemented: an ip table, one base chain per network, and flat rules.
+
+const (
+	NETLINK_NETFILTER       = 12
+	NFNL_SUBSYS_NFTABLES    = 10
+	NFNL_MSG_BATCH_BEGIN    = syscall.NLMSG_MIN_TYPE
+	NFNL_MSG_BATCH_END      = syscall.NLMSG_MIN_TYPE + 1
+	NFNETLINK_V0            = 0
+	NFPROTO_IPV4            = 2
+	NLA_F_NESTED            = 0x8000
+	NF_INET_PRE_ROUTING     = 0
+	NF_INET_LOCAL_OUT       = 3
+	NF_INET_POST_ROUTING    = 4
+	NFT_PAYLOAD_NETWORK     = 1
+	NFT_PAYLOAD_TRANSPORT   = 2
+	NFT_META_OIFNAME        = 7
+	NFT_META_L4PROTO        = 16
+	NFT_CMP_EQ              = 0
+	NFT_CMP_NEQ             = 1
+	NFT_REG_1               = 1
+	NFT_REG_2               = 2
+	NFT_NAT_DNAT            = 1
+	NFT_FIB_RESULT_ADDRTYPE = 3
+	NFTA_FIB_F_DADDR        = 1 << 1
+	RTN_LOCAL               = 2
+)
+
+// nf_tables message types and attributes (linux/netfilter/nf_tables.h).
+const (
+	NFT_MSG_NEWTABLE = 0
+	NFT_MSG_GETTABLE = 1
+	NFT_MSG_NEWCHAIN = 3
+	NFT_MSG_DELCHAIN = 5
+	NFT_MSG_NEWRULE  = 6
+	NFT_MSG_DELRULE  = 8
+
+	NFTA_TABLE_NAME = 1
+
+	NFTA_CHAIN_TABLE = 1
+	NFTA_CHAIN_NAME  = 3
+	NFTA_CHAIN_HOOK  = 4
+	NFTA_CHAIN_TYPE  = 7
+
+	NFTA_HOOK_HOOKNUM  = 1
+	NFTA_HOOK_PRIORITY = 2
+
+	NFTA_RULE_TABLE       = 1
+	NFTA_RULE_CHAIN       = 2
+	NFTA_RULE_EXPRESSIONS = 4
+
+	NFTA_LIST_ELEM  = 1
+	NFTA_EXPR_NAME  = 1
+	NFTA_EXPR_DATA  = 2
+	NFTA_DATA_VALUE = 1
+
+	NFTA_PAYLOAD_DREG   = 1
+	NFTA_PAYLOAD_BASE   = 2
+	NFTA_PAYLOAD_OFFSET = 3
+	NFTA_PAYLOAD_LEN    = 4
+
+	NFTA_BITWISE_SREG = 1
+	NFTA_BITWISE_DREG = 2
+	NFTA_BITWISE_LEN  = 3
+	NFTA_BITWISE_MASK = 4
+	NFTA_BITWISE_XOR  = 5
+
+	NFTA_CMP_SREG = 1
+	NFTA_CMP_OP   = 2
+	NFTA_CMP_DATA = 3
+
+	NFTA_META_DREG = 1
+	NFTA_META_KEY  = 2
+
+	NFTA_IMMEDIATE_DREG = 1
+	NFTA_IMMEDIATE_DATA = 2
+
+	NFTA_NAT_TYPE          = 1
+	NFTA_NAT_FAMILY        = 2
+	NFTA_NAT_REG_ADDR_MIN  = 3
+	NFTA_NAT_REG_PROTO_MIN = 5
+
+	NFTA_FIB_DREG   = 1
+	NFTA_FIB_RESULT = 2
+	NFTA_FIB_FLAGS  = 3
+)
+
+// nftTable is the table owning every chain minictr creates.
+const nftTable = "minictr"
+
+// nftBatch accumulates nf_tables messages to be committed atomically.
+type nftBatch struct {
+	msgs [][]byte
+	seq  uint32
+}
+
+func (b *nftBatch) add(msgType uint16, flags uint16, attrs ...[]byte) {
+	b.seq++
+	b.msgs = append(b.msgs, nlMessage(NFNL_SUBSYS_NFTABLES<<8|msgType,
+		syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags, b.seq, NFPROTO_IPV4, 0, concat(attrs...)))
+}
+
+// addTable creates the minictr table; it is a no-op if it already exists.
+func (b *nftBatch) addTable() {
+	b.add(NFT_MSG_NEWTABLE, syscall.NLM_F_CREATE, nlAttrString(NFTA_TABLE_NAME, nftTable))
+}
+
+// addBaseChain creates a chain of the given type attached to a netfilter hook.
+func (b *nftBatch) addBaseChain(name, chainType string, hook uint32, priority int32) {
+	b.add(NFT_MSG_NEWCHAIN, syscall.NLM_F_CREATE,
+		nlAttrString(NFTA_CHAIN_TABLE, nftTable),
+		nlAttrString(NFTA_CHAIN_NAME, name),
+		nlAttrNested(NFTA_CHAIN_HOOK,
+			nlAttr(NFTA_HOOK_HOOKNUM, be32(hook)),
+			nlAttr(NFTA_HOOK_PRIORITY, be32(uint32(priority))),
+		),
+		nlAttrString(NFTA_CHAIN_TYPE, chainType),
+	)
+}
+
+// flushChain deletes every rule in the chain.
+func (b *nftBatch) flushChain(name string) {
+	b.add(NFT_MSG_DELRULE, 0,
+		nlAttrString(NFTA_RULE_TABLE, nftTable),
+		nlAttrString(NFTA_RULE_CHAIN, name),
+	)
+}
+
+func (b *nftBatch) delChain(name string) {
+	b.add(NFT_MSG_DELCHAIN, 0,
+		nlAttrString(NFTA_CHAIN_TABLE, nftTable),
+		nlAttrString(NFTA_CHAIN_NAME, name),
+	)
+}
+
+func (b *nftBatch) addRule(chain string, exprs ...[]byte) {
+	b.add(NFT_MSG_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND,
+		nlAttrString(NFTA_RULE_TABLE, nftTable),
+		nlAttrString(NFTA_RULE_CHAIN, chain),
+		nlAttrNested(NFTA_RULE_EXPRESSIONS, exprs...),
+	)
+}
+
+// nftSocket opens a netfilter netlink socket.
+func nftSocket() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, NETLINK_NETFILTER)
+	if err != nil {
+		return -1, fmt.Errorf("open netfilter netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind netfilter netlink socket: %w", err)
+	}
+	return fd, nil
+}
+
+// nftAcks waits for the kernel to acknowledge pending messages.
+func nftAcks(fd, pending int) error {
+	// Each message is acked individually; the first failure wins
+	rbuf := make([]byte, 1<<16)
+	for pending > 0 {
+		n, _, err := syscall.Recvfrom(fd, rbuf, 0)
+		if err != nil {
+			return fmt.Errorf("receive nf_tables ack: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rbuf[:n])
+		if err != nil {
+			return fmt.Errorf("parse nf_tables ack: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return fmt.Errorf("nf_tables message %d: %w", m.Header.Seq, syscall.Errno(-errno))
+			}
+			pending--
+		}
+	}
+	return nil
+}
+
+// commit sends the batch and waits for the kernel to acknowledge every message.
+func (b *nftBatch) commit() error {
+	fd, err := nftSocket()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var buf []byte
+	buf = append(buf, nlMessage(NFNL_MSG_BATCH_BEGIN, syscall.NLM_F_REQUEST, 0, syscall.AF_UNSPEC, NFNL_SUBSYS_NFTABLES, nil)...)
+	for _, m := range b.msgs {
+		buf = append(buf, m...)
+	}
+	buf = append(buf, nlMessage(NFNL_MSG_BATCH_END, syscall.NLM_F_REQUEST, b.seq+1, syscall.AF_UNSPEC, NFNL_SUBSYS_NFTABLES, nil)...)
+	if err := syscall.Sendto(fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("send nf_tables batch: %w", err)
+	}
+	return nftAcks(fd, len(b.msgs))
+}
+
+// nftAvailable reports whether the kernel accepts nf_tables requests. It
+// asks for the minictr table rather than creating it, so the answer, even
+// "no such table", leaves nothing behind.
+func nftAvailable() bool {
+	fd, err := nftSocket()
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	msg := nlMessage(NFNL_SUBSYS_NFTABLES<<8|NFT_MSG_GETTABLE, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK,
+		1, NFPROTO_IPV4, 0, nlAttrString(NFTA_TABLE_NAME, nftTable))
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return false
+	}
+	err = nftAcks(fd, 1)
+	return err == nil || errors.Is(err, syscall.ENOENT)
+}
+
+// Expression builders. Each returns one NFTA_LIST_ELEM for NFTA_RULE_EXPRESSIONS.
+
+func nftExpr(name string, data ...[]byte) []byte {
+	attrs := [][]byte{nlAttrString(NFTA_EXPR_NAME, name)}
+	if len(data) > 0 {
+		attrs = append(attrs, nlAttrNested(NFTA_EXPR_DATA, data...))
+	}
+	return nlAttrNested(NFTA_LIST_ELEM, attrs...)
+}
+
+func nftPayload(base, offset, length uint32) []byte {
+	return nftExpr("payload",
+		nlAttr(NFTA_PAYLOAD_DREG, be32(NFT_REG_1)),
+		nlAttr(NFTA_PAYLOAD_BASE, be32(base)),
+		nlAttr(NFTA_PAYLOAD_OFFSET, be32(offset)),
+		nlAttr(NFTA_PAYLOAD_LEN, be32(length)),
+	)
+}
+
+func nftMeta(key uint32) []byte {
+	return nftExpr("meta",
+		nlAttr(NFTA_META_DREG, be32(NFT_REG_1)),
+		nlAttr(NFTA_META_KEY, be32(key)),
+	)
+}
+
+func nftImmediate(reg uint32, data []byte) []byte {
+	return nftExpr("immediate",
+		nlAttr(NFTA_IMMEDIATE_DREG, be32(reg)),
+		nlAttrNested(NFTA_IMMEDIATE_DATA, nlAttr(NFTA_DATA_VALUE, data)),
+	)
+}
+
+// nftDNAT rewrites the destination to the address in NFT_REG_1 and port in NFT_REG_2.
+func nftDNAT() []byte {
+	return nftExpr("nat",
+		nlAttr(NFTA_NAT_TYPE, be32(NFT_NAT_DNAT)),
+		nlAttr(NFTA_NAT_FAMILY, be32(NFPROTO_IPV4)),
+		nlAttr(NFTA_NAT_REG_ADDR_MIN, be32(NFT_REG_1)),
+		nlAttr(NFTA_NAT_REG_PROTO_MIN, be32(NFT_REG_2)),
+	)
+}
+
+// nftDaddrLocal matches packets addressed to one of the host's own addresses ("fib daddr type local").
+func nftDaddrLocal() [][]byte {
+	local := make([]byte, 4)
+	binary.NativeEndian.PutUint32(local, RTN_LOCAL)
+	return [][]byte{
+		nftExpr("fib",
+			nlAttr(NFTA_FIB_DREG, be32(NFT_REG_1)),
+			nlAttr(NFTA_FIB_RESULT, be32(NFT_FIB_RESULT_ADDRTYPE)),
+			nlAttr(NFTA_FIB_FLAGS, be32(NFTA_FIB_F_DADDR)),
+		),
+		nftCmp(NFT_CMP_EQ, local),
+	}
+}
+
+func nftCmp(op uint32, data []byte) []byte {
+	return nftExpr("cmp",
+		nlAttr(NFTA_CMP_SREG, be32(NFT_REG_1)),
+		nlAttr(NFTA_CMP_OP, be32(op)),
+		nlAttrNested(NFTA_CMP_DATA, nlAttr(NFTA_DATA_VALUE, data)),
+	)
+}
+
+func nftBitwiseMask(mask []byte) []byte {
+	return nftExpr("bitwise",
+		nlAttr(NFTA_BITWISE_SREG, be32(NFT_REG_1)),
+		nlAttr(NFTA_BITWISE_DREG, be32(NFT_REG_1)),
+		nlAttr(NFTA_BITWISE_LEN, be32(uint32(len(mask)))),
+		nlAttrNested(NFTA_BITWISE_MASK, nlAttr(NFTA_DATA_VALUE, mask)),
+		nlAttrNested(NFTA_BITWISE_XOR, nlAttr(NFTA_DATA_VALUE, make([]byte, len(mask)))),
+	)
+}
+
+// nftMatchSubnet compares the IPv4 address at offset (12 = saddr, 16 = daddr) against ipnet:
+// with NFT_CMP_EQ it matches addresses inside the subnet, with NFT_CMP_NEQ those outside.
+func nftMatchSubnet(offset uint32, ipnet *net.IPNet, op uint32) [][]byte {
+	return [][]byte{
+		nftPayload(NFT_PAYLOAD_NETWORK, offset, 4),
+		nftBitwiseMask([]byte(ipnet.Mask)),
+		nftCmp(op, []byte(ipnet.IP.To4())),
+	}
+}
+
+// nftIfname pads an interface name to IFNAMSIZ as stored in the meta register.
+func nftIfname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name)
+	return b
+}
+
+// Netlink framing helpers.
+
+func nlMessage(msgType, flags uint16, seq uint32, family uint8, resID uint16, payload []byte) []byte {
+	const hdrLen = syscall.NLMSG_HDRLEN + 4 // nlmsghdr + nfgenmsg
+	b := make([]byte, hdrLen, hdrLen+len(payload))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(hdrLen+len(payload)))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	b[16] = family
+	b[17] = NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[18:20], resID)
+	return append(b, payload...)
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, (l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+func nlAttrNested(typ uint16, children ...[]byte) []byte {
+	return nlAttr(typ|NLA_F_NESTED, concat(children...))
+}
+
+func nlAttrString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+// notify.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// containerNotifyDir is where the container finds notifySocketName.
+	containerNotifyDir = "/run/notify"
+	notifySocketName   = "notify.sock"
+
+	// maxNotifyMessage bounds one sd_notify datagram.
+	maxNotifyMessage = 4096
+)
+
+// notifyProxy passes a container's sd_notify messages on to the NOTIFY_SOCKET
+// systemd gave us. A Type=notify service's ready and watchdog state has to
+// come from its main process, the runtime, and the host's socket isn't in the
+// container's mount namespace.
+type notifyProxy struct {
+	Dir    string // bind-mounted on containerNotifyDir
+	conn   *net.UnixConn
+	client *net.UnixConn
+}
+
+// newNotifyProxy listens on a socket in a new directory for the container to
+// bind in. Anyone in the container may send to it.
+func newNotifyProxy(host string) (*notifyProxy, error) {
+	dir, err := os.MkdirTemp("", "minictr-notify-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	path := filepath.Join(dir, notifySocketName)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := os.Chmod(path, 0777); err != nil {
+		conn.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	client, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: host, Net: "unixgram"})
+	if err != nil {
+		conn.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("connect to NOTIFY_SOCKET %s: %w", host, err)
+	}
+	return &notifyProxy{Dir: dir, conn: conn, client: client}, nil
+}
+
+// forward relays the messages of the container with the given PID until the
+// proxy is closed. MAINPID= would name a PID in the container's namespace, so
+// it is dropped: the runtime stays the main process.
+func (p *notifyProxy) forward(pid int) {
+	buf := make([]byte, maxNotifyMessage)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		var keep []string
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line == "" || strings.HasPrefix(line, "MAINPID=") {
+				continue
+			}
+			if line == "READY=1" {
+				logEventf("container %d notified systemd it is ready", pid)
+			}
+			keep = append(keep, line)
+		}
+		if len(keep) == 0 {
+			continue
+		}
+		if err := p.send(strings.Join(keep, "\n")); err != nil {
+			logWarnf("failed to pass on sd_notify message: %v", err)
+		}
+	}
+}
+
+// send writes state to systemd's socket.
+func (p *notifyProxy) send(state string) error {
+	_, err := p.client.Write([]byte(state))
+	return err
+}
+
+// close stops the proxy and removes its directory.
+func (p *notifyProxy) close() {
+	if p == nil {
+		return
+	}
+	p.conn.Close()
+	p.client.Close()
+	os.RemoveAll(p.Dir)
+}
+
+// notifyEnv is what the container gets instead of our sd_notify variables.
+// WATCHDOG_PID is left out, as it names the runtime, so the workload takes
+// WATCHDOG_USEC as meant for it.
+func notifyEnv() []string {
+	env := []string{"NOTIFY_SOCKET=" + filepath.Join(containerNotifyDir, notifySocketName)}
+	if usec, ok := os.LookupEnv("WATCHDOG_USEC"); ok {
+		env = append(env, "WATCHDOG_USEC="+usec)
+	}
+	return env
+}
+
+// mountNotifySocket bind-mounts the proxy's directory into root.
+func mountNotifySocket(root, dir string) error {
+	target := filepath.Join(root, containerNotifyDir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", containerNotifyDir, err)
+	}
+	if err := syscall.Mount(dir, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s on %s: %w", dir, containerNotifyDir, err)
+	}
+	return nil
+}
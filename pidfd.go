@@ -0,0 +1,69 @@
+// pidfd.go
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// POLLIN is when a pidfd polls readable: once its process has exited.
+const POLLIN = 0x1
+
+// pollFd is struct pollfd.
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// containerProcess is the container init as the runtime signals and
+// watches it. With the pidfd its clone returned, on Linux 5.2 and later, a
+// signal can't reach a process given the init's PID after it was reaped,
+// and its exit shows as the pidfd polling readable rather than as the PID
+// going away. Without one it falls back to the PID.
+type containerProcess struct {
+	pid    int
+	pidfd  int // -1 without pidfd support
+	exited chan struct{}
+}
+
+// watchProcess takes over pidfd, and closes exited once the process exits:
+// when its pidfd polls readable, or without one when release is called.
+func watchProcess(pid, pidfd int) *containerProcess {
+	p := &containerProcess{pid: pid, pidfd: pidfd, exited: make(chan struct{})}
+	if pidfd >= 0 {
+		go func() {
+			defer close(p.exited)
+			fds := []pollFd{{fd: int32(pidfd), events: POLLIN}}
+			for {
+				_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, 0, 0, 0, 0)
+				if errno != syscall.EINTR {
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// signal sends sig to the process, if it is still the one we started.
+func (p *containerProcess) signal(sig syscall.Signal) error {
+	if p.pidfd < 0 {
+		return syscall.Kill(p.pid, sig)
+	}
+	if _, _, errno := syscall.Syscall6(SYS_PIDFD_SEND_SIGNAL, uintptr(p.pidfd), uintptr(sig), 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// release closes the pidfd once the process has been reaped and nothing
+// signals it any more.
+func (p *containerProcess) release() {
+	if p.pidfd < 0 {
+		close(p.exited)
+		return
+	}
+	<-p.exited
+	syscall.Close(p.pidfd)
+}
@@ -0,0 +1,205 @@
+// plugins.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Plugins are unix sockets speaking HTTP in pluginSocketDir, as daemons
+	// start them, or executables in pluginExecDir. Either is named
+	// <kind>-<name>, a socket with a .sock suffix.
+	pluginSocketDir = "/run/minictr/plugins"
+	pluginExecDir   = "/usr/lib/minictr/plugins"
+
+	// pluginTimeout bounds one call into a plugin.
+	pluginTimeout = 30 * time.Second
+)
+
+// plugin is a third-party driver. Each call is a method name with a JSON
+// request and response: an executable gets the method as its argument, the
+// request on stdin and answers on stdout, failing with a non-zero exit and
+// the reason on stderr. A socket gets a POST to /<method>, failing with a
+// non-2xx status and the reason as the body.
+type plugin struct {
+	Kind, Name, Path string
+	Socket           bool
+}
+
+// findPlugin returns the plugin of the given kind and name, preferring a
+// socket, or nil if there is none.
+func findPlugin(kind, name string) *plugin {
+	if !networkNameRE.MatchString(name) {
+		return nil
+	}
+	base := kind + "-" + name
+	if fi, err := os.Stat(filepath.Join(pluginSocketDir, base+".sock")); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		return &plugin{Kind: kind, Name: name, Path: filepath.Join(pluginSocketDir, base+".sock"), Socket: true}
+	}
+	if fi, err := os.Stat(filepath.Join(pluginExecDir, base)); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+		return &plugin{Kind: kind, Name: name, Path: filepath.Join(pluginExecDir, base)}
+	}
+	return nil
+}
+
+// listPlugins returns the plugins in both directories.
+func listPlugins() []plugin {
+	var plugins []plugin
+	for _, dir := range []string{pluginSocketDir, pluginExecDir} {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			base := strings.TrimSuffix(e.Name(), ".sock")
+			kind, name, ok := strings.Cut(base, "-")
+			if !ok {
+				continue
+			}
+			if p := findPlugin(kind, name); p != nil && p.Path == filepath.Join(dir, e.Name()) {
+				plugins = append(plugins, *p)
+			}
+		}
+	}
+	return plugins
+}
+
+// call runs method with req, decoding the answer into resp unless it is nil.
+func (p *plugin) call(method string, req, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	if p.Socket {
+		out, err = p.post(ctx, method, body)
+	} else {
+		out, err = p.exec(ctx, method, body)
+	}
+	if err != nil {
+		return fmt.Errorf("%s plugin %s: %s: %w", p.Kind, p.Name, method, err)
+	}
+	if resp == nil || len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(out, resp); err != nil {
+		return fmt.Errorf("%s plugin %s: %s: parse response: %w", p.Kind, p.Name, method, err)
+	}
+	return nil
+}
+
+func (p *plugin) exec(ctx context.Context, method string, body []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, p.Path, method)
+	cmd.Stdin = bytes.NewReader(body)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return nil, fmt.Errorf("%v: %s", err, msg)
+	}
+	return out, err
+}
+
+func (p *plugin) post(ctx context.Context, method string, body []byte) ([]byte, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", p.Path)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://plugin/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// runPlugins lists the installed plugins.
+func runPlugins(args []string) error {
+	if len(args) != 1 || (args[0] != "ls" && args[0] != "list") {
+		return fmt.Errorf("usage: minictr plugin ls")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tTYPE\tPATH")
+	for _, p := range listPlugins() {
+		typ := "exec"
+		if p.Socket {
+			typ = "socket"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Kind, p.Name, typ, p.Path)
+	}
+	return w.Flush()
+}
+
+// networkPluginRequest is what a network plugin's attach and detach methods
+// get: the container's network namespace and, to attach, the interface to
+// give it. Detach comes once the container has exited, when the namespace
+// may be gone.
+type networkPluginRequest struct {
+	Container      int    `json:"container"`
+	Netns          string `json:"netns"`
+	Interface      string `json:"interface,omitempty"`
+	DefaultRoute   bool   `json:"defaultRoute,omitempty"`
+	MTU            int    `json:"mtu,omitempty"`
+	TxQueueLen     int    `json:"txQueueLen,omitempty"`
+	DisableOffload bool   `json:"disableOffload,omitempty"`
+	EgressRate     uint64 `json:"egressRate,omitempty"` // bits per second
+}
+
+// networkPluginResponse is what attach answers with.
+type networkPluginResponse struct {
+	Address string `json:"address"` // without the prefix length
+}
+
+// networkPlugin returns the plugin that provides the named network, if no
+// user-defined network has that name.
+func networkPlugin(name string) *plugin {
+	if _, err := os.Stat(networkPath(name)); !os.IsNotExist(err) {
+		return nil
+	}
+	return findPlugin("network", name)
+}
+
+// attachPluginNetwork has p connect pid's network namespace as ifname.
+func attachPluginNetwork(p *plugin, pid int, ifname string, defaultRoute bool, opts linkOptions) (string, error) {
+	var resp networkPluginResponse
+	if err := p.call("attach", networkPluginRequest{
+		Container:      pid,
+		Netns:          fmt.Sprintf("/proc/%d/ns/net", pid),
+		Interface:      ifname,
+		DefaultRoute:   defaultRoute,
+		MTU:            opts.MTU,
+		TxQueueLen:     opts.TxQueueLen,
+		DisableOffload: opts.DisableOffload,
+		EgressRate:     opts.EgressRate,
+	}, &resp); err != nil {
+		return "", err
+	}
+	if net.ParseIP(resp.Address) == nil {
+		return "", fmt.Errorf("network plugin %s: attach: invalid address %q", p.Name, resp.Address)
+	}
+	return resp.Address, nil
+}
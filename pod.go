@@ -0,0 +1,65 @@
+// pod.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// podStopTimeout is how long the rest of a pod gets to exit on SIGTERM once
+// one of its processes has, before they are killed.
+const podStopTimeout = 10 * time.Second
+
+// podProcess is one process of a --pod spec. Args[0] is an absolute path in
+// the rootfs, and Env is added to the container's environment.
+type podProcess struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+}
+
+// podSpec is a --pod file: processes that share the container's namespaces
+// and rootfs and run and stop together.
+type podSpec struct {
+	Processes []podProcess `json:"processes"`
+}
+
+// loadPodSpec reads and checks a --pod file. A process's name defaults to
+// the base name of its program.
+func loadPodSpec(path string) ([]podProcess, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec podSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	if len(spec.Processes) == 0 {
+		return nil, fmt.Errorf("%s: no processes", path)
+	}
+	names := make(map[string]bool)
+	for i, p := range spec.Processes {
+		if len(p.Args) == 0 || !strings.HasPrefix(p.Args[0], "/") {
+			return nil, fmt.Errorf("%s: process %d: args must start with an absolute path", path, i+1)
+		}
+		if p.Name == "" {
+			p.Name = filepath.Base(p.Args[0])
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: process name %q given more than once", path, p.Name)
+		}
+		names[p.Name] = true
+		for _, kv := range p.Env {
+			if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+				return nil, fmt.Errorf("%s: process %s: invalid env entry %q (want KEY=value)", path, p.Name, kv)
+			}
+		}
+		spec.Processes[i] = p
+	}
+	return spec.Processes, nil
+}
@@ -0,0 +1,218 @@
+// policy.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// policyPath is the host's run policy. Without it every run is allowed.
+const policyPath = "/etc/minictr/policy.json"
+
+// runPolicy is what an admin allows 'minictr run' to do on this host.
+type runPolicy struct {
+	// DenyPrivileged also denies what --privileged amounts to: every
+	// capability, no seccomp filter or LSM confinement, or access to devices
+	// beyond the default ones.
+	DenyPrivileged  bool `json:"denyPrivileged"`
+	DenyHostNetwork bool `json:"denyHostNetwork"`
+	// AllowedPaths, if set, are the host directories a rootfs, verity image,
+	// hash tree, --cores directory, --secret file, json-file log path or
+	// program run by a --hooks hook or --pressure-hook on the host must come
+	// from.
+	AllowedPaths []string `json:"allowedPaths,omitempty"`
+	// RequireVerifiedImages allows only --verity-image runs, and with
+	// TrustedRootHashes set only images with one of those root hashes.
+	RequireVerifiedImages bool     `json:"requireVerifiedImages"`
+	TrustedRootHashes     []string `json:"trustedRootHashes,omitempty"`
+	// Hook is run with the runRequest as JSON on stdin after the checks
+	// above, e.g. to ask OPA; a non-zero exit denies the run, with its
+	// output as the reason.
+	Hook string `json:"hook,omitempty"`
+}
+
+// runRequest is the part of a run the policy judges.
+type runRequest struct {
+	Privileged   bool         `json:"privileged"`
+	HostNetwork  bool         `json:"hostNetwork"`
+	Capabilities []string     `json:"capabilities"`
+	SecurityOpts []string     `json:"securityOpts,omitempty"`
+	DeviceRules  []string     `json:"deviceRules,omitempty"`
+	CgroupConf   []string     `json:"cgroupConf,omitempty"`
+	Rootfs       string       `json:"rootfs,omitempty"`
+	Image        string       `json:"image,omitempty"`
+	HashTree     string       `json:"hashTree,omitempty"`
+	RootHash     string       `json:"rootHash,omitempty"`
+	Cores        string       `json:"cores,omitempty"`
+	Hooks        []string     `json:"hooks,omitempty"` // the programs run from the host
+	PressureHook string       `json:"pressureHook,omitempty"`
+	Secrets      []string     `json:"secrets,omitempty"` // the host files, not stdin
+	LogPath      string       `json:"logPath,omitempty"` // a json-file log's path option
+	Networks     []string     `json:"networks,omitempty"`
+	Command      []string     `json:"command,omitempty"`
+	Processes    []podProcess `json:"processes,omitempty"` // a --pod's, instead of Command
+	UID          int          `json:"uid"`
+}
+
+// loadPolicy reads policyPath, returning nil if there is none. A policy that
+// can't be read or parsed is an error rather than no policy.
+func loadPolicy() (*runPolicy, error) {
+	data, err := os.ReadFile(policyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p runPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", policyPath, err)
+	}
+	for i, dir := range p.AllowedPaths {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("%s: allowedPaths entry %q is not absolute", policyPath, dir)
+		}
+		p.AllowedPaths[i] = filepath.Clean(dir)
+	}
+	return &p, nil
+}
+
+// check returns why the policy forbids req, or nil if it allows it. A nil
+// policy allows everything.
+func (p *runPolicy) check(ctx context.Context, req runRequest) error {
+	if p == nil {
+		return nil
+	}
+	// 1) The fixed rules
+	if p.DenyPrivileged {
+		if err := checkUnprivileged(req); err != nil {
+			return err
+		}
+	}
+	if p.DenyHostNetwork && req.HostNetwork {
+		return fmt.Errorf("--network host is not allowed on this host")
+	}
+	if p.RequireVerifiedImages {
+		if req.Image == "" {
+			return fmt.Errorf("only --verity-image runs are allowed on this host")
+		}
+		if len(p.TrustedRootHashes) > 0 && !containsFold(p.TrustedRootHashes, req.RootHash) {
+			return fmt.Errorf("root hash %s is not trusted on this host", req.RootHash)
+		}
+	}
+	paths := append([]string{req.Rootfs, req.Image, req.HashTree, req.Cores}, req.Hooks...)
+	paths = append(paths, req.Secrets...)
+	if req.PressureHook != "" {
+		// Run like the hook is, from $PATH unless it has a slash
+		hook, err := exec.LookPath(req.PressureHook)
+		if err != nil {
+			return fmt.Errorf("--pressure-hook: %w", err)
+		}
+		paths = append(paths, hook)
+	}
+	if req.LogPath != "" {
+		// A log that doesn't exist yet is created, and rotated, in its directory
+		if _, err := os.Lstat(req.LogPath); os.IsNotExist(err) {
+			paths = append(paths, filepath.Dir(req.LogPath))
+		} else {
+			paths = append(paths, req.LogPath)
+		}
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := p.checkPath(path); err != nil {
+			return err
+		}
+	}
+
+	// 2) Then whatever the hook decides
+	if p.Hook == "" {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hook := exec.CommandContext(ctx, p.Hook)
+	hook.Stdin = bytes.NewReader(data)
+	out, err := hook.CombinedOutput()
+	if _, denied := err.(*exec.ExitError); denied {
+		return fmt.Errorf("denied by policy hook %s: %s", p.Hook, strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return fmt.Errorf("run policy hook %s: %w", p.Hook, err)
+	}
+	return nil
+}
+
+// checkUnprivileged returns an error if req is privileged, by --privileged
+// or by the options that add up to it.
+func checkUnprivileged(req runRequest) error {
+	if req.Privileged {
+		return fmt.Errorf("--privileged is not allowed on this host")
+	}
+	if len(req.Capabilities) == len(capabilities) {
+		return fmt.Errorf("--cap-add ALL is not allowed on this host")
+	}
+	for _, opt := range req.SecurityOpts {
+		switch opt {
+		case "seccomp=unconfined", "apparmor=unconfined", "label=disable":
+			return fmt.Errorf("--security-opt %s is not allowed on this host", opt)
+		}
+	}
+	for _, conf := range req.CgroupConf {
+		if strings.HasPrefix(conf, "devices.") {
+			return fmt.Errorf("--cgroup-conf %s is not allowed on this host", conf)
+		}
+	}
+	// Any device beyond the defaults may be a host disk or /dev/mem
+	for _, r := range req.DeviceRules {
+		rule, err := parseDeviceRule(r)
+		if err != nil {
+			return err
+		}
+		if !defaultDevice(rule) {
+			return fmt.Errorf("--device-cgroup-rule '%s' is not allowed on this host", r)
+		}
+	}
+	return nil
+}
+
+// checkPath checks that path, after resolving symlinks, is under one of the
+// allowed directories.
+func (p *runPolicy) checkPath(path string) error {
+	if len(p.AllowedPaths) == 0 {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return err
+	}
+	for _, dir := range p.AllowedPaths {
+		if abs == dir || strings.HasPrefix(abs, strings.TrimSuffix(dir, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside the paths allowed on this host (%s)", abs, strings.Join(p.AllowedPaths, ", "))
+}
+
+// containsFold reports whether list holds s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
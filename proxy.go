@@ -0,0 +1,245 @@
+// proxy.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// udpIdleTimeout is how long a UDP "session" is kept without traffic.
+const udpIdleTimeout = 90 * time.Second
+
+// portMapping is a parsed --publish hostPort:containerPort[/proto] spec.
+type portMapping struct {
+	Proto         string
+	HostPort      uint16
+	ContainerPort uint16
+}
+
+func (p portMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", p.HostPort, p.ContainerPort, p.Proto)
+}
+
+func (p portMapping) protoNumber() byte {
+	if p.Proto == "udp" {
+		return syscall.IPPROTO_UDP
+	}
+	return syscall.IPPROTO_TCP
+}
+
+// parsePortMapping parses "8080:80", "8080:80/tcp" or "5353:53/udp".
+func parsePortMapping(s string) (portMapping, error) {
+	m := portMapping{Proto: "tcp"}
+	spec := s
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		m.Proto = strings.ToLower(spec[i+1:])
+		spec = spec[:i]
+	}
+	if m.Proto != "tcp" && m.Proto != "udp" {
+		return m, fmt.Errorf("invalid protocol in %q (want tcp or udp)", s)
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return m, fmt.Errorf("invalid port mapping %q (want hostPort:containerPort[/proto])", s)
+	}
+	host, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || host == 0 {
+		return m, fmt.Errorf("invalid host port in %q", s)
+	}
+	ctr, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || ctr == 0 {
+		return m, fmt.Errorf("invalid container port in %q", s)
+	}
+	m.HostPort, m.ContainerPort = uint16(host), uint16(ctr)
+	return m, nil
+}
+
+// startPortProxy forwards traffic arriving on the host port of m to containerIP
+// from userspace. It is the fallback when DNAT rules can't be programmed.
+// The returned func stops the listener; established TCP streams run to completion.
+func startPortProxy(m portMapping, containerIP string) (func(), error) {
+	target := net.JoinHostPort(containerIP, strconv.Itoa(int(m.ContainerPort)))
+	return startProxy(m, func() (net.Conn, error) {
+		return net.DialTimeout(m.Proto, target, 10*time.Second)
+	})
+}
+
+// startProxy forwards traffic arriving on the host port of m to whatever dial
+// connects to.
+func startProxy(m portMapping, dial func() (net.Conn, error)) (func(), error) {
+	listen := fmt.Sprintf(":%d", m.HostPort)
+	if m.Proto == "udp" {
+		conn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			return nil, err
+		}
+		go proxyUDP(conn.(*net.UDPConn), dial)
+		return func() { conn.Close() }, nil
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go proxyTCP(client.(*net.TCPConn), dial)
+		}
+	}()
+	return func() { ln.Close() }, nil
+}
+
+func proxyTCP(client *net.TCPConn, dial func() (net.Conn, error)) {
+	defer client.Close()
+	upstream, err := dial()
+	if err != nil {
+		logWarnf("proxy: %v", err)
+		return
+	}
+	defer upstream.Close()
+
+	// Copy each direction independently, propagating half-closes
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		client.CloseWrite()
+	}()
+	wg.Wait()
+}
+
+// proxyUDP relays datagrams, keeping one upstream socket per client address
+// so that replies can be routed back to the right peer.
+func proxyUDP(conn *net.UDPConn, dial func() (net.Conn, error)) {
+	var mu sync.Mutex
+	sessions := make(map[string]*net.UDPConn)
+	buf := make([]byte, 65535)
+
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			mu.Lock()
+			for _, s := range sessions {
+				s.Close()
+			}
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		upstream, ok := sessions[client.String()]
+		if !ok {
+			c, err := dial()
+			if err != nil {
+				mu.Unlock()
+				logWarnf("proxy: %v", err)
+				continue
+			}
+			upstream = c.(*net.UDPConn)
+			sessions[client.String()] = upstream
+			go func(client *net.UDPAddr, upstream *net.UDPConn) {
+				reply := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					n, err := upstream.Read(reply)
+					if err != nil {
+						break
+					}
+					conn.WriteToUDP(reply[:n], client)
+				}
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+				upstream.Close()
+			}(client, upstream)
+		}
+		mu.Unlock()
+		upstream.Write(buf[:n])
+	}
+}
+
+// containerDialer connects to ports of a container without a network of
+// ours, in a network namespace a rootless runtime can't join: the --init
+// reaper, inside it, dials each one and passes the connection back over
+// conn, a SOCK_SEQPACKET socket.
+type containerDialer struct {
+	mu   sync.Mutex
+	conn *os.File
+}
+
+// dial connects to port on the container's loopback.
+func (d *containerDialer) dial(proto string, port uint16) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fd := int(d.conn.Fd())
+	if err := syscall.Sendmsg(fd, []byte(fmt.Sprintf("%s %d", proto, port)), nil, nil, 0); err != nil {
+		return nil, fmt.Errorf("ask the container to connect to %s port %d: %w", proto, port, err)
+	}
+	buf := make([]byte, 512)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_CMSG_CLOEXEC)
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s port %d in the container: %w", proto, port, err)
+	}
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(scms) == 0 {
+		// No connection, only why not
+		return nil, errors.New(string(buf[:n]))
+	}
+	fds, err := syscall.ParseUnixRights(&scms[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("connect to %s port %d in the container: bad reply", proto, port)
+	}
+	f := os.NewFile(uintptr(fds[0]), "container")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// serveDials is the reaper's side of containerDialer: it connects to the
+// ports the runtime asks for on conn, until the runtime closes it.
+func serveDials(conn *os.File) {
+	defer conn.Close()
+	fd := int(conn.Fd())
+	buf := make([]byte, 64)
+	for {
+		n, _, _, _, err := syscall.Recvmsg(fd, buf, nil, 0)
+		if err != nil || n == 0 {
+			return
+		}
+		proto, port, _ := strings.Cut(string(buf[:n]), " ")
+		c, err := net.DialTimeout(proto, net.JoinHostPort("127.0.0.1", port), 10*time.Second)
+		if err != nil {
+			syscall.Sendmsg(fd, []byte(err.Error()), nil, nil, 0)
+			continue
+		}
+		f, err := c.(interface{ File() (*os.File, error) }).File()
+		c.Close()
+		if err != nil {
+			syscall.Sendmsg(fd, []byte(err.Error()), nil, nil, 0)
+			continue
+		}
+		syscall.Sendmsg(fd, []byte{0}, syscall.UnixRights(int(f.Fd())), nil, 0)
+		f.Close()
+	}
+}
@@ -0,0 +1,156 @@
+// ready.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readyInterval is how often --wait-for checks are retried.
+const readyInterval = 100 * time.Millisecond
+
+// tcpListen is the TCP_LISTEN state in /proc/net/tcp.
+const tcpListen = "0A"
+
+// readyCheck is one --wait-for condition: a TCP socket listening on IP:Port
+// in the container's network namespace, or a file at Path in its rootfs.
+type readyCheck struct {
+	IP   net.IP
+	Port int
+	Path string
+}
+
+func (c readyCheck) String() string {
+	if c.Path != "" {
+		return "path:" + c.Path
+	}
+	return "tcp://" + net.JoinHostPort(c.IP.String(), strconv.Itoa(c.Port))
+}
+
+// parseWaitFor parses a --wait-for condition, tcp://host:port or path:/file.
+func parseWaitFor(s string) (readyCheck, error) {
+	if path, ok := strings.CutPrefix(s, "path:"); ok {
+		if !strings.HasPrefix(path, "/") {
+			return readyCheck{}, fmt.Errorf("%q: the path must be absolute", s)
+		}
+		return readyCheck{Path: path}, nil
+	}
+	addr, ok := strings.CutPrefix(s, "tcp://")
+	if !ok {
+		return readyCheck{}, fmt.Errorf("%q (want tcp://host:port or path:/file)", s)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return readyCheck{}, fmt.Errorf("%q: %v", s, err)
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil || n < 1 || n > 65535 {
+		return readyCheck{}, fmt.Errorf("%q: want an IP address and a port", s)
+	}
+	return readyCheck{IP: ip, Port: n}, nil
+}
+
+// ready reports whether the condition holds for the container with the given
+// PID. A socket file in the rootfs must also accept a connection.
+func (c readyCheck) ready(pid int) bool {
+	if c.Path == "" {
+		return listeningTCP(pid, c.IP, c.Port)
+	}
+	path := fmt.Sprintf("/proc/%d/root%s", pid, c.Path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// listeningTCP reports whether a socket in the network namespace of pid
+// listens on ip:port, or on the port of a wildcard address. It reads
+// /proc/<pid>/net, which unlike joining the namespace works rootless too.
+func listeningTCP(pid int, ip net.IP, port int) bool {
+	for _, file := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/net/%s", pid, file))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// sl local_address rem_address st ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != tcpListen {
+				continue
+			}
+			local, p, ok := parseProcNetAddr(fields[1])
+			if ok && p == port && (local.IsUnspecified() || local.Equal(ip)) {
+				f.Close()
+				return true
+			}
+		}
+		f.Close()
+	}
+	return false
+}
+
+// parseProcNetAddr parses a /proc/net/tcp address, hex IP:port with the IP
+// as 32-bit words in host (little-endian) order.
+func parseProcNetAddr(s string) (net.IP, int, bool) {
+	addr, port, ok := strings.Cut(s, ":")
+	b, err := hex.DecodeString(addr)
+	if !ok || err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(b), int(p), true
+}
+
+// waitReady polls the checks until they all hold, timeout passes, ctx is
+// done, or the container exits, after which its PID may be another
+// process's.
+func waitReady(ctx context.Context, proc *containerProcess, checks []readyCheck, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(readyInterval)
+	defer ticker.Stop()
+	for {
+		var pending []string
+		for _, c := range checks {
+			if !c.ready(proc.pid) {
+				pending = append(pending, c.String())
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %s", timeout, strings.Join(pending, ", "))
+		case <-proc.exited:
+			return fmt.Errorf("exited before it was ready: %s", strings.Join(pending, ", "))
+		case <-ticker.C:
+		}
+	}
+}
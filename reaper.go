@@ -0,0 +1,216 @@
+// reaper.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watched are the reaper's own children besides the workload, like health
+// checks, whose wait status goes to whoever started them.
+var (
+	watchedMu sync.Mutex
+	watched   = map[int]chan syscall.WaitStatus{}
+)
+
+// runReaper starts the workload as a child and stays on as the container's
+// PID 1, the way tini does: it passes on the signals it gets, reaps every
+// process orphaned into the namespace, and returns the workload's exit code
+// (128+signal if it was killed) once the workload is gone. As PID 1 it is the
+// reaper of every orphan in the namespace, so with waitOrphans it also waits
+// out the processes a daemonizing workload leaves running. It also runs the
+// --health-cmd checks, for as long as the workload runs, and connects to the
+// container's ports for a --publish proxy without a network of ours.
+//
+// A --pod workload is several processes. The first one to exit takes the pod
+// down: the others get SIGTERM, and SIGKILL after podStopTimeout, and its
+// exit code is the pod's.
+func runReaper(procs []podProcess, env []string, cfg *initConfig) (int, error) {
+	// 1) Catch everything before the children exist, so no SIGCHLD is missed
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+
+	// The workload doesn't get to write our health reports, or connect for us
+	if cfg.Health != nil {
+		syscall.CloseOnExec(cfg.HealthFd)
+	}
+	if cfg.DialFd != 0 {
+		syscall.CloseOnExec(cfg.DialFd)
+		go serveDials(os.NewFile(uintptr(cfg.DialFd), "dial"))
+	}
+
+	// 2) Start the processes. If one can't be started, our exit takes the
+	//    ones that were down with the namespace.
+	live := make(map[int]string)
+	for i, p := range procs {
+		pid, err := startProcess(p, env, i == 0)
+		if err != nil {
+			return 0, err
+		}
+		live[pid] = p.Name
+	}
+	ctx, stopHealth := context.WithCancel(context.Background())
+	defer stopHealth()
+	// The checks are forked by the loop below, on this thread: the user,
+	// capabilities, seccomp filter, Landlock domain and LSM label the
+	// workload runs with are this thread's, not the process's
+	forks := make(chan func())
+	if cfg.Health != nil {
+		go runHealthChecks(ctx, cfg.Health, env, os.NewFile(uintptr(cfg.HealthFd), "health"), forks)
+	}
+
+	// 3) Forward signals and reap until the workload has exited, and with
+	//    waitOrphans until whatever it left behind has too. Everything else
+	//    in the namespace is ours to signal then.
+	code, exited := 0, false
+	var kill <-chan time.Time
+	for {
+		select {
+		case <-kill:
+			for pid := range live {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		case fork := <-forks:
+			fork()
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGCHLD:
+				exits, none := reapChildren(live)
+				for _, e := range exits {
+					delete(live, e.pid)
+					if exited {
+						continue
+					}
+					code, exited = e.code, true
+					stopHealth()
+					if len(procs) > 1 {
+						logInfof("%s exited with status %d; stopping the pod", e.name, e.code)
+					}
+					for pid := range live {
+						syscall.Kill(pid, syscall.SIGTERM)
+					}
+					kill = time.After(podStopTimeout)
+				}
+				if exited && len(live) == 0 && (!cfg.WaitOrphans || none) {
+					return code, nil
+				}
+			case syscall.SIGURG:
+				// The Go runtime sends itself these to preempt goroutines
+			default:
+				if !exited {
+					for pid := range live {
+						syscall.Kill(pid, sig.(syscall.Signal))
+					}
+				} else {
+					syscall.Kill(-1, sig.(syscall.Signal))
+				}
+			}
+		}
+	}
+}
+
+// startProcess starts p in its own process group. The first process of the
+// workload gets stdin, and the foreground on a terminal, so that ^C reaches
+// it once, from us; the others read an empty stdin.
+func startProcess(p podProcess, env []string, first bool) (int, error) {
+	if len(p.Env) > 0 {
+		env = append([]string(nil), env...)
+		for _, kv := range p.Env {
+			env = setEnv(env, kv)
+		}
+	}
+	attr := &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	}
+	if !first {
+		stdin, closed, err := os.Pipe()
+		if err != nil {
+			return 0, err
+		}
+		closed.Close()
+		defer stdin.Close()
+		attr.Files[0] = stdin.Fd()
+	} else if isTerminal(0) {
+		attr.Sys.Foreground = true
+		attr.Sys.Ctty = 0
+	}
+	pid, err := syscall.ForkExec(p.Args[0], p.Args, attr)
+	if err != nil && attr.Sys.Foreground && (err == syscall.ENOTTY || err == syscall.EPERM) {
+		// Not our controlling terminal; run it in ours
+		attr.Sys = &syscall.SysProcAttr{}
+		pid, err = syscall.ForkExec(p.Args[0], p.Args, attr)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("exec %q %v: %w", p.Args[0], p.Args, err)
+	}
+	return pid, nil
+}
+
+// startWatched starts a child of the reaper's own, whose wait status is
+// sent on the returned channel once it exits.
+func startWatched(path string, argv []string, attr *syscall.ProcAttr) (int, <-chan syscall.WaitStatus, error) {
+	// Registered before reapChildren can get to it
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	pid, err := syscall.ForkExec(path, argv, attr)
+	if err != nil {
+		return 0, nil, err
+	}
+	exited := make(chan syscall.WaitStatus, 1)
+	watched[pid] = exited
+	return pid, exited, nil
+}
+
+// processExit is how one of the workload's processes exited.
+type processExit struct {
+	pid  int
+	name string
+	code int // 128+signal if it was killed
+}
+
+// reapChildren waits for every child that has exited, and returns the
+// processes of the workload, in live, among them, and whether no children
+// are left.
+func reapChildren(live map[int]string) (exits []processExit, none bool) {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	for {
+		var ws syscall.WaitStatus
+		p, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.ECHILD {
+			return exits, true
+		}
+		if p <= 0 || err != nil {
+			return exits, false
+		}
+		if ch, ok := watched[p]; ok {
+			ch <- ws
+			delete(watched, p)
+			continue
+		}
+		name, ok := live[p]
+		if !ok {
+			continue
+		}
+		e := processExit{pid: p, name: name, code: ws.ExitStatus()}
+		if ws.Signaled() {
+			e.code = 128 + int(ws.Signal())
+		}
+		exits = append(exits, e)
+	}
+}
+
+// isTerminal reports whether fd is a terminal.
+func isTerminal(fd int) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
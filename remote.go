@@ -0,0 +1,121 @@
+// remote.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// remoteCacheDir is where, relative to the remote user's home, a copy of
+// our binary is put on hosts that --host doesn't name a minictr for.
+const remoteCacheDir = ".cache/minictr"
+
+// unameMachines are the `uname -m` names of the architectures we build for.
+var unameMachines = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// runRemote runs minictr with args on the host of an ssh://[user@]host[:port][/path]
+// URL, with our stdio and its exit status. Paths in args are the remote
+// host's. Without a path to minictr there, the first run copies this binary
+// into remoteCacheDir, named after its hash so that each version gets its own.
+func runRemote(host string, args []string) error {
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return fmt.Errorf("invalid --host %q (want ssh://[user@]host[:port][/path/to/minictr])", host)
+	}
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	var opts []string
+	if u.Port() != "" {
+		opts = append(opts, "-p", u.Port())
+	}
+
+	// 1) Find or put minictr on the host
+	remote := strings.TrimSuffix(u.Path, "/")
+	if remote == "" {
+		if remote, err = bootstrapRemote(ssh, append(opts, "-T", dest)); err != nil {
+			return fmt.Errorf("%s: %w", dest, err)
+		}
+	}
+
+	// 2) Then become ssh running it, with a terminal if we have one
+	tty := "-T"
+	if isTerminal(0) {
+		tty = "-t"
+	}
+	command := []string{shellQuote(remote)}
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+	argv := append(append([]string{"ssh"}, opts...), tty, dest, "--", strings.Join(command, " "))
+	return syscall.Exec(ssh, argv, os.Environ())
+}
+
+// bootstrapRemote returns the path of our copy on the host ssh connects to,
+// uploading it first if it isn't there.
+func bootstrapRemote(ssh string, sshArgs []string) (string, error) {
+	self, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return "", err
+	}
+	defer self.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, self); err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf("%s/minictr-%s", remoteCacheDir, hex.EncodeToString(h.Sum(nil))[:12])
+
+	// 1) One round trip says whether it's there and what the host runs
+	out, err := exec.Command(ssh, append(sshArgs, "--", fmt.Sprintf("uname -m; test -x %s && echo present || true", path))...).Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh: %w", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("ssh: no output from uname")
+	}
+	if fields[0] != unameMachines[runtime.GOARCH] {
+		return "", fmt.Errorf("the host is %s and this minictr is built for %s; give its path to minictr in --host", fields[0], runtime.GOARCH)
+	}
+	if len(fields) > 1 && fields[1] == "present" {
+		return path, nil
+	}
+
+	// 2) Upload under a temporary name, so a broken copy is never used
+	if _, err := self.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	upload := exec.Command(ssh, append(sshArgs, "--", fmt.Sprintf("mkdir -p %s && cat > %s.tmp && chmod 755 %[2]s.tmp && mv %[2]s.tmp %[2]s", remoteCacheDir, path))...)
+	upload.Stdin = self
+	upload.Stderr = os.Stderr
+	if err := upload.Run(); err != nil {
+		return "", fmt.Errorf("copy minictr to the host: %w", err)
+	}
+	logInfof("copied minictr to %s on the host", path)
+	return path, nil
+}
+
+// shellQuote quotes s for a POSIX shell, as ssh runs the command through the
+// remote user's shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+:,./@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,114 @@
+// rlimit.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Resource numbers missing from the syscall package (asm-generic/resource.h,
+// shared by amd64 and arm64).
+const (
+	RLIMIT_RSS        = 5
+	RLIMIT_NPROC      = 6
+	RLIMIT_MEMLOCK    = 8
+	RLIMIT_LOCKS      = 10
+	RLIMIT_SIGPENDING = 11
+	RLIMIT_MSGQUEUE   = 12
+	RLIMIT_NICE       = 13
+	RLIMIT_RTPRIO     = 14
+	RLIMIT_RTTIME     = 15
+
+	RLIM_INFINITY = ^uint64(0)
+)
+
+// rlimitResources maps --ulimit names (the OCI RLIMIT_* names, lower-cased
+// and without the prefix) onto resource numbers.
+var rlimitResources = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      RLIMIT_LOCKS,
+	"memlock":    RLIMIT_MEMLOCK,
+	"msgqueue":   RLIMIT_MSGQUEUE,
+	"nice":       RLIMIT_NICE,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      RLIMIT_NPROC,
+	"rss":        RLIMIT_RSS,
+	"rtprio":     RLIMIT_RTPRIO,
+	"rttime":     RLIMIT_RTTIME,
+	"sigpending": RLIMIT_SIGPENDING,
+	"stack":      syscall.RLIMIT_STACK,
+}
+
+// rlimit is one parsed --ulimit name=soft[:hard]. A missing hard limit equals the soft one.
+type rlimit struct {
+	Name       string
+	Soft, Hard uint64
+}
+
+func (r rlimit) String() string {
+	return fmt.Sprintf("%s=%s:%s", r.Name, formatRlimit(r.Soft), formatRlimit(r.Hard))
+}
+
+func formatRlimit(v uint64) string {
+	if v == RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// parseUlimit parses "nofile=1024:4096", "core=0" or "memlock=unlimited".
+func parseUlimit(s string) (rlimit, error) {
+	name, values, ok := strings.Cut(s, "=")
+	if !ok {
+		return rlimit{}, fmt.Errorf("invalid ulimit %q (want name=soft[:hard])", s)
+	}
+	name = strings.ToLower(strings.TrimPrefix(strings.ToUpper(name), "RLIMIT_"))
+	if _, ok := rlimitResources[name]; !ok {
+		return rlimit{}, fmt.Errorf("unknown ulimit %q", name)
+	}
+	softStr, hardStr, hasHard := strings.Cut(values, ":")
+	if !hasHard {
+		hardStr = softStr
+	}
+	r := rlimit{Name: name}
+	for _, v := range []struct {
+		s   string
+		dst *uint64
+	}{{softStr, &r.Soft}, {hardStr, &r.Hard}} {
+		if v.s == "unlimited" || v.s == "-1" {
+			*v.dst = RLIM_INFINITY
+			continue
+		}
+		n, err := strconv.ParseUint(v.s, 10, 64)
+		if err != nil {
+			return rlimit{}, fmt.Errorf("invalid value %q in ulimit %q", v.s, s)
+		}
+		*v.dst = n
+	}
+	if r.Soft > r.Hard {
+		return rlimit{}, fmt.Errorf("soft limit exceeds hard limit in ulimit %q", s)
+	}
+	return r, nil
+}
+
+// applyRlimits sets the --ulimit limits on the current process, which keeps
+// them across exec.
+func applyRlimits(specs []string) error {
+	for _, spec := range specs {
+		r, err := parseUlimit(spec)
+		if err != nil {
+			return err
+		}
+		lim := syscall.Rlimit{Cur: r.Soft, Max: r.Hard}
+		if err := syscall.Setrlimit(rlimitResources[r.Name], &lim); err != nil {
+			return fmt.Errorf("setrlimit %s: %w", r, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// sched.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Scheduling policies from <linux/sched.h>.
+const (
+	SCHED_OTHER = 0
+	SCHED_FIFO  = 1
+	SCHED_RR    = 2
+	SCHED_BATCH = 3
+	SCHED_IDLE  = 5
+)
+
+// IO priority classes and ioprio_set(2) targets from <linux/ioprio.h>.
+const (
+	IOPRIO_CLASS_RT   = 1
+	IOPRIO_CLASS_BE   = 2
+	IOPRIO_CLASS_IDLE = 3
+
+	IOPRIO_CLASS_SHIFT = 13
+	IOPRIO_WHO_PROCESS = 1
+	IOPRIO_MAX_LEVEL   = 7
+)
+
+var ioprioClasses = map[string]int{
+	"realtime":    IOPRIO_CLASS_RT,
+	"best-effort": IOPRIO_CLASS_BE,
+	"idle":        IOPRIO_CLASS_IDLE,
+}
+
+var schedPolicies = map[string]int{
+	"other": SCHED_OTHER,
+	"fifo":  SCHED_FIFO,
+	"rr":    SCHED_RR,
+	"batch": SCHED_BATCH,
+	"idle":  SCHED_IDLE,
+}
+
+// parseSchedPolicy validates --sched-policy and --sched-priority and returns
+// them as "policy:priority" for the SCHEDPOLICY variable.
+func parseSchedPolicy(policy string, priority int) (string, error) {
+	p, ok := schedPolicies[policy]
+	if !ok {
+		return "", fmt.Errorf("unknown scheduling policy %q (want other, fifo, rr, batch or idle)", policy)
+	}
+	realtime := p == SCHED_FIFO || p == SCHED_RR
+	switch {
+	case realtime && (priority < 1 || priority > 99):
+		return "", fmt.Errorf("priority %d out of range for %s (1-99)", priority, policy)
+	case !realtime && priority != 0:
+		return "", fmt.Errorf("priority is only meaningful for fifo and rr")
+	}
+	return fmt.Sprintf("%s:%d", policy, priority), nil
+}
+
+// applySchedPolicy sets a policy:priority scheduling policy on the
+// current process; it is inherited across exec and by every child.
+func applySchedPolicy(spec string) error {
+	name, prio, _ := strings.Cut(spec, ":")
+	priority, err := strconv.Atoi(prio)
+	if err != nil {
+		return fmt.Errorf("invalid scheduling policy %q", spec)
+	}
+	param := struct{ Priority int32 }{int32(priority)}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, uintptr(schedPolicies[name]), uintptr(unsafe.Pointer(&param))); errno != 0 {
+		return fmt.Errorf("sched_setscheduler(%s): %w", spec, errno)
+	}
+	return nil
+}
+
+// parseIOPrio parses --ionice class[:level], e.g. best-effort:7 or idle, into
+// the ioprio value for ioprio_set(2). Levels run from 0 (highest) to 7.
+func parseIOPrio(s string) (int, error) {
+	class, levelStr, hasLevel := strings.Cut(s, ":")
+	c, ok := ioprioClasses[class]
+	if !ok {
+		return 0, fmt.Errorf("unknown IO class %q (want realtime, best-effort or idle)", class)
+	}
+	level := 4 // the kernel's default best-effort level
+	if c == IOPRIO_CLASS_IDLE {
+		if hasLevel {
+			return 0, fmt.Errorf("the idle IO class takes no level")
+		}
+		level = 0
+	} else if hasLevel {
+		var err error
+		if level, err = strconv.Atoi(levelStr); err != nil || level < 0 || level > IOPRIO_MAX_LEVEL {
+			return 0, fmt.Errorf("invalid IO priority level %q (want 0-%d)", levelStr, IOPRIO_MAX_LEVEL)
+		}
+	}
+	return c<<IOPRIO_CLASS_SHIFT | level, nil
+}
+
+// applyNice sets the nice value on the current process.
+func applyNice(n int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, n); err != nil {
+		return fmt.Errorf("setpriority(%d): %w", n, err)
+	}
+	return nil
+}
+
+// applyIOPrio sets the ioprio value on the current process.
+func applyIOPrio(prio int) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, uintptr(prio)); errno != 0 {
+		return fmt.Errorf("ioprio_set(%#x): %w", prio, errno)
+	}
+	return nil
+}
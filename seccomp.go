@@ -0,0 +1,392 @@
+// seccomp.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Seccomp constants from <linux/seccomp.h> and <linux/filter.h>.
+const (
+	SECCOMP_SET_MODE_FILTER = 1
+
+	SECCOMP_RET_KILL_PROCESS = 0x80000000
+	SECCOMP_RET_KILL_THREAD  = 0x00000000
+	SECCOMP_RET_TRAP         = 0x00030000
+	SECCOMP_RET_ERRNO        = 0x00050000
+	SECCOMP_RET_TRACE        = 0x7ff00000
+	SECCOMP_RET_LOG          = 0x7ffc0000
+	SECCOMP_RET_ALLOW        = 0x7fff0000
+
+	BPF_MAXINSNS = 4096
+
+	// Syscall numbers with this bit set are the x32 ABI on amd64 and don't
+	// exist elsewhere; they are never native for the profile
+	X32_SYSCALL_BIT = 0x40000000
+
+	// CLONE_NEW* flags that clone may not pass without CAP_SYS_ADMIN
+	cloneNamespaceFlags = 0x7e020000
+)
+
+// Offsets into struct seccomp_data.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// seccompProfile is a seccomp profile in the Docker/OCI JSON format.
+// Architectures lists are accepted but only native syscalls are allowed
+// through: anything else kills the process. ListenerPath is the agent
+// socket for SCMP_ACT_NOTIFY rules (see superviseSeccomp).
+type seccompProfile struct {
+	DefaultAction    string        `json:"defaultAction"`
+	DefaultErrnoRet  *uint32       `json:"defaultErrnoRet,omitempty"`
+	Architectures    []string      `json:"architectures,omitempty"`
+	ListenerPath     string        `json:"listenerPath,omitempty"`
+	ListenerMetadata string        `json:"listenerMetadata,omitempty"`
+	Syscalls         []seccompRule `json:"syscalls"`
+}
+
+// seccompRule applies Action to the named syscalls when all of Args match.
+// Per syscall the first matching rule decides. Includes and Excludes make the
+// rule depend on the container's capabilities and the architecture.
+type seccompRule struct {
+	Names    []string      `json:"names,omitempty"`
+	Name     string        `json:"name,omitempty"` // older Docker profiles
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []seccompArg  `json:"args,omitempty"`
+	Includes seccompFilter `json:"includes,omitempty"`
+	Excludes seccompFilter `json:"excludes,omitempty"`
+}
+
+type seccompFilter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// seccompArg compares a syscall argument with Value, or for
+// SCMP_CMP_MASKED_EQ the argument masked with Value against ValueTwo.
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+var (
+	eperm  = uint32(syscall.EPERM)
+	enosys = uint32(syscall.ENOSYS)
+)
+
+// defaultSeccompProfile allows everything except what a container has no
+// business doing: loading kernels and modules, mounting, switching
+// namespaces, keyrings, setting the clock and the like. Most of those are
+// given back along with the capability they would need anyway.
+var defaultSeccompProfile = seccompProfile{
+	DefaultAction: "SCMP_ACT_ALLOW",
+	Syscalls: []seccompRule{
+		{Names: []string{"kexec_load", "kexec_file_load", "add_key", "request_key", "keyctl",
+			"uselib", "nfsservctl", "_sysctl", "vm86", "vm86old", "create_module",
+			"get_kernel_syms", "query_module"},
+			Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm},
+		{Names: []string{"mount", "umount", "umount2", "pivot_root", "fsopen", "fsconfig",
+			"fsmount", "fspick", "move_mount", "open_tree", "mount_setattr", "swapon",
+			"swapoff", "unshare", "setns", "quotactl", "quotactl_fd", "lookup_dcookie"},
+			Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm, Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+		// clone3 passes its flags in memory that seccomp can't inspect;
+		// ENOSYS makes the C library fall back to clone
+		{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &enosys,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+		{Names: []string{"clone"}, Action: "SCMP_ACT_ALLOW",
+			Args:     []seccompArg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}},
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+		{Names: []string{"clone"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+		{Names: []string{"bpf"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN", "CAP_BPF"}}},
+		{Names: []string{"perf_event_open"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_ADMIN", "CAP_PERFMON"}}},
+		{Names: []string{"open_by_handle_at"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_DAC_READ_SEARCH"}}},
+		{Names: []string{"init_module", "finit_module", "delete_module"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_MODULE"}}},
+		{Names: []string{"acct"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_PACCT"}}},
+		{Names: []string{"reboot"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_BOOT"}}},
+		{Names: []string{"settimeofday", "stime", "clock_settime", "clock_adjtime"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_TIME"}}},
+		{Names: []string{"iopl", "ioperm"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_RAWIO"}}},
+		{Names: []string{"syslog"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYSLOG"}}},
+		{Names: []string{"process_vm_readv", "process_vm_writev", "kcmp", "userfaultfd"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm,
+			Excludes: seccompFilter{Caps: []string{"CAP_SYS_PTRACE"}}},
+	},
+}
+
+// loadSeccompProfile reads a JSON profile file.
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p seccompProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.DefaultAction == "" {
+		return nil, fmt.Errorf("%s: no defaultAction", path)
+	}
+	return &p, nil
+}
+
+// seccompAction translates an SCMP_ACT_* name into a filter return value.
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = *errnoRet
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return SECCOMP_RET_ERRNO | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_TRACE":
+		return SECCOMP_RET_TRACE | errno&0xffff, nil
+	case "SCMP_ACT_LOG":
+		return SECCOMP_RET_LOG, nil
+	case "SCMP_ACT_NOTIFY":
+		return SECCOMP_RET_USER_NOTIF, nil
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// applies reports whether the rule's includes and excludes hold for a
+// container with the given capabilities on this architecture.
+func (r *seccompRule) applies(caps map[string]bool) bool {
+	has := func(c string) bool { return caps[strings.TrimPrefix(strings.ToUpper(c), "CAP_")] }
+	for _, c := range r.Includes.Caps {
+		if !has(c) {
+			return false
+		}
+	}
+	for _, c := range r.Excludes.Caps {
+		if has(c) {
+			return false
+		}
+	}
+	arch := func(arches []string) bool {
+		for _, a := range arches {
+			if a == runtime.GOARCH {
+				return true
+			}
+		}
+		return false
+	}
+	if len(r.Includes.Arches) > 0 && !arch(r.Includes.Arches) {
+		return false
+	}
+	return !arch(r.Excludes.Arches)
+}
+
+// Classic BPF opcodes.
+const (
+	bpfLdW  = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfJeq  = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfJgt  = syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K
+	bpfJge  = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+	bpfJa   = syscall.BPF_JMP | syscall.BPF_JA
+	bpfAnd  = syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K
+	bpfRetK = syscall.BPF_RET | syscall.BPF_K
+)
+
+// seccompFail marks a jump to the end of the rule being assembled, i.e.
+// on to the next rule for the same syscall.
+const seccompFail = 0xff
+
+func stmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// compareArg assembles a check of one 64-bit argument, done as two 32-bit
+// halves. It falls through when the argument matches and jumps to
+// seccompFail otherwise.
+func compareArg(a seccompArg) ([]syscall.SockFilter, error) {
+	if a.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", a.Index)
+	}
+	lo := uint32(seccompDataArgs + 8*a.Index)
+	hi := lo + 4
+	vlo, vhi := uint32(a.Value), uint32(a.Value>>32)
+	switch a.Op {
+	case "SCMP_CMP_EQ":
+		return []syscall.SockFilter{
+			stmt(bpfLdW, hi), jump(bpfJeq, vhi, 0, seccompFail),
+			stmt(bpfLdW, lo), jump(bpfJeq, vlo, 0, seccompFail),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []syscall.SockFilter{
+			stmt(bpfLdW, hi), jump(bpfJeq, vhi, 0, 2),
+			stmt(bpfLdW, lo), jump(bpfJeq, vlo, seccompFail, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		return []syscall.SockFilter{
+			stmt(bpfLdW, hi), stmt(bpfAnd, vhi), jump(bpfJeq, uint32(a.ValueTwo>>32), 0, seccompFail),
+			stmt(bpfLdW, lo), stmt(bpfAnd, vlo), jump(bpfJeq, uint32(a.ValueTwo), 0, seccompFail),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		op := uint16(bpfJgt)
+		if a.Op == "SCMP_CMP_GE" {
+			op = bpfJge
+		}
+		return []syscall.SockFilter{
+			stmt(bpfLdW, hi), jump(bpfJgt, vhi, 3, 0), jump(bpfJeq, vhi, 0, seccompFail),
+			stmt(bpfLdW, lo), jump(op, vlo, 0, seccompFail),
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// lo < v is !(lo >= v), lo <= v is !(lo > v)
+		op := uint16(bpfJge)
+		if a.Op == "SCMP_CMP_LE" {
+			op = bpfJgt
+		}
+		return []syscall.SockFilter{
+			stmt(bpfLdW, hi), jump(bpfJgt, vhi, seccompFail, 0), jump(bpfJeq, vhi, 0, 2),
+			stmt(bpfLdW, lo), jump(op, vlo, seccompFail, 0),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported comparison %q", a.Op)
+}
+
+// compileSeccomp turns a profile into a filter program for a container
+// with the given capabilities. Syscalls the profile names that don't exist
+// on this architecture are skipped, as libseccomp does.
+func compileSeccomp(p *seccompProfile, caps []string) ([]syscall.SockFilter, error) {
+	capSet := make(map[string]bool)
+	for _, c := range caps {
+		capSet[c] = true
+	}
+	defaultRet, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1) Collect each syscall's rules, keeping the profile order
+	var order []int
+	rules := make(map[int][][]syscall.SockFilter)
+	for i := range p.Syscalls {
+		r := &p.Syscalls[i]
+		if !r.applies(capSet) {
+			continue
+		}
+		ret, err := seccompAction(r.Action, r.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		var code []syscall.SockFilter
+		for _, a := range r.Args {
+			cmp, err := compareArg(a)
+			if err != nil {
+				return nil, fmt.Errorf("syscall %v: %w", r.Names, err)
+			}
+			code = append(code, cmp...)
+		}
+		code = append(code, stmt(bpfRetK, ret))
+		// Point the failure exits past the end of the rule
+		for j := range code {
+			if code[j].Jt == seccompFail {
+				code[j].Jt = uint8(len(code) - j - 1)
+			}
+			if code[j].Jf == seccompFail {
+				code[j].Jf = uint8(len(code) - j - 1)
+			}
+		}
+
+		names := r.Names
+		if r.Name != "" {
+			names = append(names, r.Name)
+		}
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			if _, seen := rules[nr]; !seen {
+				order = append(order, nr)
+			}
+			rules[nr] = append(rules[nr], code)
+		}
+	}
+
+	// 2) Only native syscalls get past the architecture check
+	prog := []syscall.SockFilter{
+		stmt(bpfLdW, seccompDataArch),
+		jump(bpfJeq, AUDIT_ARCH_NATIVE, 1, 0),
+		stmt(bpfRetK, SECCOMP_RET_KILL_PROCESS),
+		stmt(bpfLdW, seccompDataNr),
+		jump(bpfJge, X32_SYSCALL_BIT, 0, 1),
+		stmt(bpfRetK, SECCOMP_RET_ERRNO|uint32(syscall.ENOSYS)),
+	}
+
+	// 3) One block per syscall, skipped with a long jump unless the number
+	//    matches. A block whose rules all fail takes the default action;
+	//    every block reloads the number as argument checks overwrite it.
+	for _, nr := range order {
+		var block []syscall.SockFilter
+		for _, code := range rules[nr] {
+			block = append(block, code...)
+		}
+		block = append(block, stmt(bpfRetK, defaultRet))
+		prog = append(prog,
+			stmt(bpfLdW, seccompDataNr),
+			jump(bpfJeq, uint32(nr), 1, 0),
+			stmt(bpfJa, uint32(len(block))))
+		prog = append(prog, block...)
+	}
+	prog = append(prog, stmt(bpfRetK, defaultRet))
+
+	if len(prog) > BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp program has %d instructions, the limit is %d", len(prog), BPF_MAXINSNS)
+	}
+	return prog, nil
+}
+
+// applySeccomp installs the filter on the current thread,
+// which is the one about to exec the workload. That needs either
+// no_new_privs or CAP_SYS_ADMIN. A filter with SCMP_ACT_NOTIFY rules comes
+// with a listener, which goes to the runtime over the socket at notifyFd.
+func applySeccomp(prog []syscall.SockFilter, notifyFd int) error {
+	runtime.LockOSThread()
+	var flags uintptr
+	notify := notifyFd != 0
+	if notify {
+		flags |= SECCOMP_FILTER_FLAG_NEW_LISTENER
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	listener, _, errno := syscall.RawSyscall(SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, flags, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("load seccomp filter: %w", errno)
+	}
+	runtime.KeepAlive(prog)
+	if notify {
+		return sendSeccompListener(notifyFd, int(listener))
+	}
+	return nil
+}
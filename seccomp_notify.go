@@ -0,0 +1,299 @@
+// seccomp_notify.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Seccomp user notification constants from <linux/seccomp.h>; the ioctl
+// numbers are the same on amd64 and arm64.
+const (
+	SECCOMP_RET_USER_NOTIF           = 0x7fc00000
+	SECCOMP_FILTER_FLAG_NEW_LISTENER = 1 << 3
+
+	SECCOMP_IOCTL_NOTIF_RECV     = 0xc0502100
+	SECCOMP_IOCTL_NOTIF_SEND     = 0xc0182101
+	SECCOMP_IOCTL_NOTIF_ID_VALID = 0x40082102
+
+	SYS_OPENAT2           = 437
+	O_PATH                = 0x200000
+	AT_SYMLINK_NOFOLLOW   = 0x100
+	RESOLVE_NO_MAGICLINKS = 0x02
+	RESOLVE_BENEATH       = 0x08
+	RESOLVE_IN_ROOT       = 0x10
+)
+
+// seccompNotif and seccompNotifResp are struct seccomp_notif and
+// struct seccomp_notif_resp.
+type seccompNotif struct {
+	ID    uint64
+	Pid   uint32
+	Flags uint32
+	Data  struct {
+		Nr   int32
+		Arch uint32
+		IP   uint64
+		Args [6]uint64
+	}
+}
+
+type seccompNotifResp struct {
+	ID    uint64
+	Val   int64
+	Error int32
+	Flags uint32
+}
+
+// seccompNotifies reports whether a compiled program refers any syscall to
+// a supervisor, in which case the container init has to hand over the
+// listener that comes with loading it.
+func seccompNotifies(prog []syscall.SockFilter) bool {
+	for _, insn := range prog {
+		if insn.Code == bpfRetK && insn.K == SECCOMP_RET_USER_NOTIF {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSeccompListener passes the init's filter listener to the runtime over
+// the socket at fd, and closes both.
+func sendSeccompListener(fd, listener int) error {
+	defer syscall.Close(fd)
+	defer syscall.Close(listener)
+	if err := syscall.Sendmsg(fd, []byte{0}, syscall.UnixRights(listener), nil, 0); err != nil {
+		return fmt.Errorf("send seccomp listener: %w", err)
+	}
+	return nil
+}
+
+// superviseSeccomp receives the container's seccomp listener on conn. If the
+// profile names a listenerPath the listener goes to the agent there, as OCI
+// runtimes do; otherwise the runtime answers the notifications itself.
+func superviseSeccomp(conn *os.File, pid int, p *seccompProfile, bundle string) {
+	defer conn.Close()
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(conn.Fd()), buf, oob, 0)
+	if err != nil || oobn == 0 {
+		// The init failed before loading the filter
+		return
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		logWarnf("no seccomp listener received: %v", err)
+		return
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		logWarnf("no seccomp listener received: %v", err)
+		return
+	}
+	listener := fds[0]
+	syscall.CloseOnExec(listener)
+
+	if p.ListenerPath != "" {
+		err := sendToSeccompAgent(p.ListenerPath, listener, pid, p.ListenerMetadata, bundle)
+		syscall.Close(listener)
+		if err != nil {
+			logWarnf("failed to hand seccomp listener to %s: %v", p.ListenerPath, err)
+		} else {
+			logInfof("seccomp notifications go to %s", p.ListenerPath)
+		}
+		return
+	}
+	serveSeccompNotify(listener)
+}
+
+// sendToSeccompAgent connects to the agent socket and passes it the listener
+// with the container process state, in the OCI seccomp agent format.
+func sendToSeccompAgent(path string, listener, pid int, metadata, bundle string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state, err := json.Marshal(map[string]interface{}{
+		"ociVersion": "1.0.2",
+		"fds":        []string{"seccompFd"},
+		"pid":        pid,
+		"metadata":   metadata,
+		"state":      ociState(pid, "creating", bundle),
+	})
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.(*net.UnixConn).WriteMsgUnix(state, syscall.UnixRights(listener), nil)
+	return err
+}
+
+// serveSeccompNotify answers notifications until no process uses the filter
+// any more. mknod of the devices every container may use (see
+// defaultDeviceRules) is carried out on the caller's behalf, which lets a
+// container in a user namespace create them when the runtime can; anything
+// else is refused with EPERM.
+func serveSeccompNotify(listener int) {
+	defer syscall.Close(listener)
+	names := make(map[int32]string)
+	for name, nr := range syscallNumbers {
+		names[int32(nr)] = name
+	}
+
+	for {
+		var req seccompNotif
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(listener), SECCOMP_IOCTL_NOTIF_RECV, uintptr(unsafe.Pointer(&req))); errno != 0 {
+			if errno == syscall.EINTR {
+				continue
+			}
+			// ENOENT: every process under the filter has exited
+			return
+		}
+
+		resp := seccompNotifResp{ID: req.ID}
+		name := names[req.Data.Nr]
+		var errno syscall.Errno
+		switch name {
+		case "mknod", "mknodat":
+			errno = emulateMknod(listener, &req, name == "mknodat")
+		default:
+			errno = syscall.EPERM
+		}
+		if errno != 0 {
+			resp.Error = -int32(errno)
+			logInfof("seccomp: refused %s from PID %d: %v", name, req.Pid, errno)
+		}
+		syscall.Syscall(syscall.SYS_IOCTL, uintptr(listener), SECCOMP_IOCTL_NOTIF_SEND, uintptr(unsafe.Pointer(&resp)))
+	}
+}
+
+// emulateMknod creates the device node a notified mknod or mknodat asked
+// for, resolving the path inside the caller's root and giving the node to
+// the caller's filesystem IDs. Relative paths may not climb above the
+// directory they start from.
+func emulateMknod(listener int, req *seccompNotif, at bool) syscall.Errno {
+	args := req.Data.Args[:]
+	dirfd := int32(-100) // AT_FDCWD
+	if at {
+		dirfd, args = int32(args[0]), args[1:]
+	}
+	pathPtr, mode, dev := args[0], uint32(args[1]), args[2]
+
+	// 1) Only the standard character devices
+	major, minor := int64((dev>>8)&0xfff), int64((dev&0xff)|((dev>>12)&0xfff00))
+	allowed := false
+	for _, r := range defaultDeviceRules {
+		if r.Type == 'c' && r.Major == major && r.Minor == minor {
+			allowed = true
+		}
+	}
+	if mode&syscall.S_IFMT != syscall.S_IFCHR || !allowed {
+		return syscall.EPERM
+	}
+
+	// 2) Read the path and open its directory without leaving the container root
+	pid := int(req.Pid)
+	path, err := readProcString(pid, pathPtr)
+	if err != nil {
+		return syscall.EFAULT
+	}
+	base, resolve := fmt.Sprintf("/proc/%d/root", pid), uint64(RESOLVE_IN_ROOT|RESOLVE_NO_MAGICLINKS)
+	if !filepath.IsAbs(path) {
+		base, resolve = fmt.Sprintf("/proc/%d/cwd", pid), RESOLVE_BENEATH|RESOLVE_NO_MAGICLINKS
+		if dirfd != -100 {
+			base = fmt.Sprintf("/proc/%d/fd/%d", pid, dirfd)
+		}
+	}
+	baseFd, err := syscall.Open(base, O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err.(syscall.Errno)
+	}
+	defer syscall.Close(baseFd)
+	dirFd, errno := openat2(baseFd, filepath.Dir(path), O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, resolve)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirFd)
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return syscall.ESRCH
+	}
+	umask, uid, gid := procStatusIDs(status)
+
+	// 3) The caller may have been killed, and its PID reused, meanwhile
+	id := req.ID
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(listener), SECCOMP_IOCTL_NOTIF_ID_VALID, uintptr(unsafe.Pointer(&id))); errno != 0 {
+		return errno
+	}
+
+	name := filepath.Base(path)
+	if err := syscall.Mknodat(dirFd, name, mode&^umask, int(dev)); err != nil {
+		return err.(syscall.Errno)
+	}
+	if err := syscall.Fchownat(dirFd, name, uid, gid, AT_SYMLINK_NOFOLLOW); err != nil {
+		return err.(syscall.Errno)
+	}
+	return 0
+}
+
+// readProcString reads a NUL-terminated string from another process.
+func readProcString(pid int, addr uint64) (string, error) {
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return "", err
+	}
+	defer mem.Close()
+	buf := make([]byte, syscall.PathMax)
+	n, err := mem.ReadAt(buf, int64(addr))
+	if n == 0 {
+		return "", err
+	}
+	i := bytes.IndexByte(buf[:n], 0)
+	if i < 0 {
+		return "", syscall.ENAMETOOLONG
+	}
+	return string(buf[:i]), nil
+}
+
+// procStatusIDs picks the umask and the filesystem UID and GID out of
+// /proc/<pid>/status.
+func procStatusIDs(status []byte) (umask uint32, uid, gid int) {
+	umask = 022
+	for _, line := range strings.Split(string(status), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		fields := strings.Fields(value)
+		switch {
+		case key == "Umask" && len(fields) == 1:
+			if n, err := strconv.ParseUint(fields[0], 8, 32); err == nil {
+				umask = uint32(n)
+			}
+		case key == "Uid" && len(fields) == 4:
+			uid, _ = strconv.Atoi(fields[3])
+		case key == "Gid" && len(fields) == 4:
+			gid, _ = strconv.Atoi(fields[3])
+		}
+	}
+	return umask, uid, gid
+}
+
+func openat2(dirfd int, path string, flags int, resolve uint64) (int, syscall.Errno) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, syscall.EINVAL
+	}
+	how := struct{ Flags, Mode, Resolve uint64 }{Flags: uint64(flags), Resolve: resolve}
+	fd, _, errno := syscall.Syscall6(SYS_OPENAT2, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), 0
+}
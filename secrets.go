@@ -0,0 +1,73 @@
+// secrets.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// secretsDir is where the container finds its --secret files.
+const secretsDir = "/run/secrets"
+
+// secret is one --secret, read by the runtime with the invoking user's access.
+type secret struct {
+	Name   string
+	Source string // the host file, or - for stdin
+	Data   []byte
+}
+
+// parseSecret reads a --secret given as [name=]file, where file - means stdin.
+// The name defaults to the file's base name.
+func parseSecret(spec string) (secret, error) {
+	name, src, ok := strings.Cut(spec, "=")
+	if !ok {
+		name, src = filepath.Base(spec), spec
+	}
+	if src == "-" && !ok {
+		return secret{}, fmt.Errorf("%q: a secret read from stdin needs a name, e.g. token=-", spec)
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return secret{}, fmt.Errorf("%q: invalid secret name %q", spec, name)
+	}
+	var data []byte
+	var err error
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return secret{}, fmt.Errorf("read secret %s: %w", name, err)
+	}
+	return secret{name, src, data}, nil
+}
+
+// mountSecrets puts the secrets in a read-only tmpfs at /run/secrets, so
+// they exist only in memory and never in the rootfs or the environment.
+func mountSecrets(secrets []secret) error {
+	// 1) A small tmpfs of its own
+	if err := os.MkdirAll(secretsDir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", secretsDir, err)
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("tmpfs", secretsDir, "tmpfs", flags, "mode=0755"); err != nil {
+		return fmt.Errorf("mount tmpfs on %s: %w", secretsDir, err)
+	}
+
+	// 2) One file per secret, readable by whichever user the workload runs as
+	for _, s := range secrets {
+		if err := os.WriteFile(filepath.Join(secretsDir, s.Name), s.Data, 0444); err != nil {
+			return fmt.Errorf("write secret %s: %w", s.Name, err)
+		}
+	}
+
+	// 3) Then make it read-only
+	if err := syscall.Mount("", secretsDir, "", flags|syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", secretsDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// selinux.go
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// selinuxLabel is a process context, user:role:type:level.
+type selinuxLabel struct {
+	User, Role, Type, Level string
+}
+
+func (l selinuxLabel) String() string {
+	return l.User + ":" + l.Role + ":" + l.Type + ":" + l.Level
+}
+
+// defaultSELinuxLabel confines a container the way container-selinux
+// expects: its own pair of MCS categories keeps containers apart from each
+// other, and container_t from the host.
+func defaultSELinuxLabel() selinuxLabel {
+	c1 := rand.Intn(1024)
+	c2 := rand.Intn(1023)
+	if c2 >= c1 {
+		c2++
+	} else {
+		c1, c2 = c2, c1
+	}
+	return selinuxLabel{"system_u", "system_r", "container_t", fmt.Sprintf("s0:c%d,c%d", c1, c2)}
+}
+
+// setOption applies a --security-opt label=key:value part.
+func (l *selinuxLabel) setOption(opt string) error {
+	key, value, ok := strings.Cut(opt, ":")
+	if !ok || value == "" {
+		return fmt.Errorf("invalid label option %q (want user:, role:, type:, level: or disable)", opt)
+	}
+	switch key {
+	case "user":
+		l.User = value
+	case "role":
+		l.Role = value
+	case "type":
+		l.Type = value
+	case "level":
+		l.Level = value
+	default:
+		return fmt.Errorf("unknown label option %q", key)
+	}
+	return nil
+}
+
+// selinuxEnabled reports whether selinuxfs is mounted, i.e. SELinux is active.
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// selinuxLabelValid asks the loaded policy whether it knows the context,
+// which it doesn't for container_t without container-selinux installed.
+func selinuxLabelValid(l selinuxLabel) bool {
+	f, err := os.OpenFile("/sys/fs/selinux/context", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(l.String()))
+	return err == nil
+}
+
+// applySELinux makes the exec that follows on this thread run with label.
+func applySELinux(label string) error {
+	runtime.LockOSThread()
+	if err := os.WriteFile("/proc/thread-self/attr/exec", []byte(label), 0); err != nil {
+		return fmt.Errorf("set SELinux label %q: %w", label, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// signals.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// forwardedSignals are passed on from the runtime to the container init.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH,
+}
+
+// signalNumbers maps the names --stop-signal takes, without SIG, to signals.
+var signalNumbers = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT,
+	"ILL": syscall.SIGILL, "TRAP": syscall.SIGTRAP, "ABRT": syscall.SIGABRT,
+	"BUS": syscall.SIGBUS, "FPE": syscall.SIGFPE, "KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1, "SEGV": syscall.SIGSEGV, "USR2": syscall.SIGUSR2,
+	"PIPE": syscall.SIGPIPE, "ALRM": syscall.SIGALRM, "TERM": syscall.SIGTERM,
+	"STKFLT": syscall.SIGSTKFLT, "CHLD": syscall.SIGCHLD, "CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP, "TSTP": syscall.SIGTSTP, "TTIN": syscall.SIGTTIN,
+	"TTOU": syscall.SIGTTOU, "URG": syscall.SIGURG, "XCPU": syscall.SIGXCPU,
+	"XFSZ": syscall.SIGXFSZ, "VTALRM": syscall.SIGVTALRM, "PROF": syscall.SIGPROF,
+	"WINCH": syscall.SIGWINCH, "IO": syscall.SIGIO, "PWR": syscall.SIGPWR,
+	"SYS": syscall.SIGSYS,
+}
+
+// parseSignal parses a signal given by name, with or without SIG, or number.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || n > 64 {
+			return 0, fmt.Errorf("signal %d out of range (1-64)", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNumbers[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// forwardSignals sends the forwardedSignals the runtime gets on to the
+// container init instead of letting them kill the runtime, until stop has
+// returned. SIGTERM, the request to stop, goes on as stopSignal, after
+// calling stopping. As PID 1 of its namespace the container init only gets
+// the ones it handles; --init handles them all.
+func forwardSignals(proc *containerProcess, stopSignal syscall.Signal, stopping func()) (stop func()) {
+	sigs := make(chan os.Signal, 8)
+	done := make(chan struct{})
+	signal.Notify(sigs, forwardedSignals...)
+	go func() {
+		defer close(done)
+		for sig := range sigs {
+			if sig == syscall.SIGTERM {
+				stopping()
+				sig = stopSignal
+			}
+			proc.signal(sig.(syscall.Signal))
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+		<-done
+	}
+}
+
+// foregroundTerminal reports whether fd is our controlling terminal, with our
+// process group in the foreground, so it can be handed over to a child's.
+func foregroundTerminal(fd int) bool {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
@@ -0,0 +1,286 @@
+// stats.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// pressureInterval is how often --pressure-threshold samples the PSI files.
+const pressureInterval = 2 * time.Second
+
+// pressureResources are the PSI files of a cgroup v2 directory.
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// cgroupStats is a snapshot of a running container's cgroup. On cgroup v1 the
+// container only has its own cgroup for controllers it has limits in, so the
+// others are reported as -1.
+type cgroupStats struct {
+	MemoryUsage int64
+	MemoryLimit int64 // 0 means unlimited
+	// Breakdown of MemoryUsage from memory.stat
+	RSS      int64 // anonymous memory
+	Cache    int64 // page cache
+	Swap     int64
+	Kernel   int64 // slab, stacks, page tables, ...
+	CPUTime  time.Duration
+	Pids     int64
+	Pressure map[string]float64 // "some" avg10 percentage per resource; nil on cgroup v1
+}
+
+// runStats implements "minictr stats PID...", where PID is the container's
+// PID as printed by the runtime.
+func runStats(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: minictr stats PID [PID...]")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tMEM USAGE\tMEM LIMIT\tRSS\tCACHE\tSWAP\tKERNEL\tCPU TIME\tPIDS\tCPU PSI\tMEM PSI\tIO PSI")
+	for _, arg := range args {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid PID %q", arg)
+		}
+		st, err := readCgroupStats(pid)
+		if err != nil {
+			return err
+		}
+		usage, limit, cpu, pids := "-", "-", "-", "-"
+		if st.MemoryUsage >= 0 {
+			usage, limit = formatBytes(uint64(st.MemoryUsage)), "unlimited"
+			if st.MemoryLimit > 0 {
+				limit = formatBytes(uint64(st.MemoryLimit))
+			}
+		}
+		breakdown := make([]string, 0, 4)
+		for _, v := range []int64{st.RSS, st.Cache, st.Swap, st.Kernel} {
+			if v < 0 {
+				breakdown = append(breakdown, "-")
+			} else {
+				breakdown = append(breakdown, formatBytes(uint64(v)))
+			}
+		}
+		if st.CPUTime >= 0 {
+			cpu = st.CPUTime.Round(time.Millisecond).String()
+		}
+		if st.Pids >= 0 {
+			pids = strconv.FormatInt(st.Pids, 10)
+		}
+		psi := make([]string, len(pressureResources))
+		for i, r := range pressureResources {
+			psi[i] = "-"
+			if v, ok := st.Pressure[r]; ok {
+				psi[i] = fmt.Sprintf("%.2f%%", v)
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", pid, usage, limit,
+			strings.Join(breakdown, "\t"), cpu, pids, strings.Join(psi, "\t"))
+	}
+	return w.Flush()
+}
+
+// containerCgroupDir returns the directory of pid's cgroup for controller,
+// wherever the cgroup manager put it. On the unified hierarchy the controller
+// is ignored; on v1 it's an error if the container has no cgroup of its own there.
+func containerCgroupDir(pid int, controller string) (string, error) {
+	paths, err := procCgroups(pid)
+	if err != nil {
+		return "", err
+	}
+	if cgroupUnified() {
+		return filepath.Join(cgroupMountpoint, paths[""]), nil
+	}
+	path, ok := paths[controller]
+	if !ok {
+		return "", fmt.Errorf("cgroup v1 controller %q not mounted", controller)
+	}
+	if base := filepath.Base(path); base != fmt.Sprintf("mini_%d", pid) && base != fmt.Sprintf("minictr-%d.scope", pid) {
+		return "", fmt.Errorf("container %d has no %s cgroup", pid, controller)
+	}
+	return filepath.Join(cgroupMountpoint, controller, path), nil
+}
+
+func readCgroupStats(pid int) (*cgroupStats, error) {
+	st := &cgroupStats{}
+	if cgroupUnified() {
+		dir, err := containerCgroupDir(pid, "")
+		if err != nil {
+			return nil, err
+		}
+		st.MemoryUsage = parseCgroupInt(readCgroupFile(dir, "memory.current"))
+		st.RSS = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "anon"))
+		st.Cache = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "file"))
+		st.Swap = parseCgroupInt(readCgroupFile(dir, "memory.swap.current"))
+		if st.Kernel = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "kernel")); st.Kernel < 0 {
+			// Kernels before 5.18 have no total, only its parts
+			st.Kernel = 0
+			for _, key := range []string{"kernel_stack", "pagetables", "percpu", "sock", "slab"} {
+				if v := parseCgroupInt(cgroupStatValue(dir, "memory.stat", key)); v > 0 {
+					st.Kernel += v
+				}
+			}
+		}
+		if st.MemoryLimit = parseCgroupInt(readCgroupFile(dir, "memory.max")); st.MemoryLimit < 0 {
+			st.MemoryLimit = 0 // "max"
+		}
+		st.CPUTime = time.Duration(parseCgroupInt(cgroupStatValue(dir, "cpu.stat", "usage_usec")))
+		if st.CPUTime > 0 {
+			st.CPUTime *= time.Microsecond
+		}
+		st.Pids = parseCgroupInt(readCgroupFile(dir, "pids.current"))
+		st.Pressure = make(map[string]float64)
+		for _, r := range pressureResources {
+			if v, err := readPressure(dir, r); err == nil {
+				st.Pressure[r] = v
+			}
+		}
+		return st, nil
+	}
+
+	st.MemoryUsage, st.CPUTime, st.Pids = -1, -1, -1
+	st.RSS, st.Cache, st.Swap, st.Kernel = -1, -1, -1, -1
+	if dir, err := containerCgroupDir(pid, "memory"); err == nil {
+		st.MemoryUsage = parseCgroupInt(readCgroupFile(dir, "memory.usage_in_bytes"))
+		// The total_ keys include any child cgroups
+		st.RSS = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "total_rss"))
+		st.Cache = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "total_cache"))
+		st.Swap = parseCgroupInt(cgroupStatValue(dir, "memory.stat", "total_swap")) // only with swap accounting
+		st.Kernel = parseCgroupInt(readCgroupFile(dir, "memory.kmem.usage_in_bytes"))
+		// An unlimited v1 cgroup reports PAGE_COUNTER_MAX pages, rounded down
+		if limit := parseCgroupInt(readCgroupFile(dir, "memory.limit_in_bytes")); limit < 1<<62 {
+			st.MemoryLimit = limit
+		}
+	}
+	if dir, err := containerCgroupDir(pid, "cpuacct"); err == nil {
+		st.CPUTime = time.Duration(parseCgroupInt(readCgroupFile(dir, "cpuacct.usage")))
+	}
+	if dir, err := containerCgroupDir(pid, "pids"); err == nil {
+		st.Pids = parseCgroupInt(readCgroupFile(dir, "pids.current"))
+	}
+	return st, nil
+}
+
+// parseCgroupInt parses a counter from an interface file, returning -1 if it is
+// missing or not a number (such as "max").
+func parseCgroupInt(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// cgroupStatValue returns the value for key in a flat-keyed file such as cpu.stat.
+func cgroupStatValue(dir, file, key string) string {
+	for _, line := range strings.Split(readCgroupFile(dir, file), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// readPressure returns the "some avg10" share from <resource>.pressure, i.e. the
+// percentage of the last 10 seconds in which at least one task was stalled.
+func readPressure(dir, resource string) (float64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, resource+".pressure"))
+	if err != nil {
+		return 0, err
+	}
+	// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+	for _, field := range strings.Fields(string(data)) {
+		if v, ok := strings.CutPrefix(field, "avg10="); ok {
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return 0, fmt.Errorf("no avg10 in %s.pressure", resource)
+}
+
+// parsePressureThreshold parses a --pressure-threshold resource=percent spec, e.g. memory=20.
+func parsePressureThreshold(s string) (string, float64, error) {
+	resource, value, ok := strings.Cut(s, "=")
+	if !ok || !contains(pressureResources, resource) {
+		return "", 0, fmt.Errorf("invalid pressure threshold %q (want cpu|memory|io=percent)", s)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return "", 0, fmt.Errorf("invalid percentage in %q", s)
+	}
+	return resource, pct, nil
+}
+
+// watchPressure polls the container's PSI files and logs an event whenever a
+// resource's 10s stall average crosses its threshold, in either direction.
+// On the way up it also runs hook, if set, with the details in MINICTR_*
+// variables. The returned func stops the watcher and any hook it is running,
+// as does cancelling ctx.
+func watchPressure(ctx context.Context, pid int, thresholds map[string]float64, hook string) (func(), error) {
+	dir, err := containerCgroupDir(pid, "")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(pressureInterval)
+		defer ticker.Stop()
+		under := make(map[string]bool)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for resource, threshold := range thresholds {
+				avg10, err := readPressure(dir, resource)
+				if err != nil {
+					continue
+				}
+				switch {
+				case avg10 >= threshold && !under[resource]:
+					under[resource] = true
+					logEventf("container %d under sustained %s pressure (some avg10=%.2f%%, threshold %.2f%%)", pid, resource, avg10, threshold)
+					if hook != "" {
+						runPressureHook(ctx, hook, pid, resource, avg10)
+					}
+				case avg10 < threshold && under[resource]:
+					under[resource] = false
+					logEventf("container %d %s pressure recovered (some avg10=%.2f%%)", pid, resource, avg10)
+				}
+			}
+		}
+	}()
+	return cancel, nil
+}
+
+func runPressureHook(ctx context.Context, hook string, pid int, resource string, avg10 float64) {
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = append(os.Environ(),
+		"MINICTR_PID="+strconv.Itoa(pid),
+		"MINICTR_PRESSURE_RESOURCE="+resource,
+		"MINICTR_PRESSURE_AVG10="+strconv.FormatFloat(avg10, 'f', 2, 64),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logWarnf("pressure hook %s: %v: %s", hook, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// formatBytes renders n in binary units, e.g. 12.5MiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,51 @@
+// sysctl.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysctl is one --sysctl setting.
+type sysctl struct {
+	Key, Value string
+}
+
+func (s sysctl) String() string { return s.Key + "=" + s.Value }
+
+// parseSysctl parses key=value, accepting only keys the container's own
+// namespaces scope: net.* for its network namespace (so not with --network
+// host), and the System V IPC and POSIX message queue limits of its IPC
+// namespace. Anything else would change the host.
+func parseSysctl(s string, hostNetwork bool) (sysctl, error) {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, "/ ") {
+		return sysctl{}, fmt.Errorf("%q (want key=value, e.g. net.ipv4.ip_forward=1)", s)
+	}
+	switch {
+	case strings.HasPrefix(key, "net."):
+		if hostNetwork {
+			return sysctl{}, fmt.Errorf("%s can't be set with --network host, as it would change the host", key)
+		}
+	case strings.HasPrefix(key, "kernel.shm"), strings.HasPrefix(key, "kernel.msg"),
+		key == "kernel.sem", strings.HasPrefix(key, "fs.mqueue."):
+	default:
+		return sysctl{}, fmt.Errorf("%s is not namespaced; only net.*, kernel.shm*, kernel.msg*, kernel.sem and fs.mqueue.* can be set per container", key)
+	}
+	return sysctl{key, value}, nil
+}
+
+// applySysctls writes key=value settings to the container's /proc/sys.
+func applySysctls(settings []string) error {
+	for _, line := range settings {
+		key, value, _ := strings.Cut(line, "=")
+		path := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("set sysctl %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// system.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// runSystem implements "minictr system df".
+func runSystem(args []string, cfg *minictrConfig) error {
+	if len(args) == 0 || args[0] != "df" {
+		return fmt.Errorf("usage: minictr system df [--verbose]")
+	}
+	return systemDF(args[1:], cfg)
+}
+
+// runTempPrefixes name the directories a run makes in the temporary directory.
+var runTempPrefixes = []string{"minictr-verity-", "minictr-notify-"}
+
+// diskObject is one thing minictr keeps on disk.
+type diskObject struct {
+	Type string // network, log, temporary or other
+	Name string
+	Size uint64
+}
+
+// systemDF reports what minictr keeps on disk: the network files under the
+// storage root, each container's logs and session recordings there, the
+// directories runs make in the temporary directory for
+// verity mounts and notify sockets, which outlive a run that was killed, and
+// whatever else is under the storage root.
+func systemDF(args []string, cfg *minictrConfig) error {
+	dfCmd := flag.NewFlagSet("system df", flag.ExitOnError)
+	verbose := dfCmd.Bool("verbose", false, "List every object rather than a total per type")
+	dfCmd.BoolVar(verbose, "v", false, "Shorthand for --verbose")
+	dfCmd.Parse(args)
+	if dfCmd.NArg() != 0 {
+		return fmt.Errorf("usage: minictr system df [--verbose]")
+	}
+
+	// 1) Networks, and anything else in their directory
+	var objects []diskObject
+	entries, err := os.ReadDir(networksDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		size, err := diskUsage(filepath.Join(networksDir, e.Name()))
+		if err != nil {
+			return err
+		}
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			objects = append(objects, diskObject{Type: "network", Name: name, Size: size})
+		} else {
+			objects = append(objects, diskObject{Type: "other", Name: filepath.Join(networksDir, e.Name()), Size: size})
+		}
+	}
+
+	// 2) Logs, rotated files and recordings, counted by the container's PID
+	entries, err = os.ReadDir(logsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logs := make(map[string]int)
+	for _, e := range entries {
+		size, err := diskUsage(filepath.Join(logsDir, e.Name()))
+		if err != nil {
+			return err
+		}
+		pid, ok := strings.CutSuffix(e.Name(), ".cast")
+		if i := strings.Index(e.Name(), "-json.log"); i > 0 {
+			pid, ok = e.Name()[:i], true
+		}
+		if _, err := strconv.Atoi(pid); err != nil || !ok {
+			objects = append(objects, diskObject{Type: "other", Name: filepath.Join(logsDir, e.Name()), Size: size})
+			continue
+		}
+		if i, seen := logs[pid]; seen {
+			objects[i].Size += size
+			continue
+		}
+		logs[pid] = len(objects)
+		objects = append(objects, diskObject{Type: "log", Name: pid, Size: size})
+	}
+
+	// 3) The runs' temporary directories, not counting what is mounted there
+	var temps []string
+	for _, prefix := range runTempPrefixes {
+		matches, _ := filepath.Glob(filepath.Join(os.TempDir(), prefix+"*"))
+		temps = append(temps, matches...)
+	}
+	for _, path := range temps {
+		size, err := diskUsage(path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, diskObject{Type: "temporary", Name: path, Size: size})
+	}
+
+	// 4) Anything else under the storage root
+	entries, err = os.ReadDir(cfg.StorageRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(cfg.StorageRoot, e.Name())
+		if path == networksDir || path == logsDir {
+			continue
+		}
+		size, err := diskUsage(path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, diskObject{Type: "other", Name: path, Size: size})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if *verbose {
+		sort.SliceStable(objects, func(i, j int) bool { return objects[i].Size > objects[j].Size })
+		fmt.Fprintln(w, "TYPE\tNAME\tSIZE")
+		for _, o := range objects {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", o.Type, o.Name, formatBytes(o.Size))
+		}
+		return w.Flush()
+	}
+	counts := make(map[string]int)
+	sizes := make(map[string]uint64)
+	for _, o := range objects {
+		counts[o.Type]++
+		sizes[o.Type] += o.Size
+	}
+	fmt.Fprintln(w, "TYPE\tCOUNT\tSIZE")
+	for _, typ := range []string{"network", "log", "temporary", "other"} {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", typ, counts[typ], formatBytes(sizes[typ]))
+	}
+	return w.Flush()
+}
+
+// diskUsage returns the space allocated to path and everything under it, as
+// du counts it: a hard-linked file once, and nothing on other filesystems
+// mounted in it, path included, as a verity mount point is.
+func diskUsage(path string) (uint64, error) {
+	var root syscall.Stat_t
+	if err := syscall.Lstat(filepath.Dir(path), &root); err != nil {
+		return 0, fmt.Errorf("stat %q: %w", filepath.Dir(path), err)
+	}
+	seen := make(map[uint64]bool)
+	var total uint64
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Something removed or unreadable is left out rather than failing the report
+			return nil
+		}
+		var st syscall.Stat_t
+		if syscall.Lstat(p, &st) != nil {
+			return nil
+		}
+		if st.Dev != root.Dev {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if st.Nlink > 1 && !d.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		total += uint64(st.Blocks) * 512
+		return nil
+	})
+	return total, err
+}
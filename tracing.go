@@ -0,0 +1,228 @@
+// tracing.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceExportTimeout bounds sending the spans at exit.
+const traceExportTimeout = 5 * time.Second
+
+// OTLP span kind and status codes
+const (
+	SPAN_KIND_INTERNAL = 1
+	STATUS_CODE_ERROR  = 2
+)
+
+// tracer collects the spans of one run and sends them to an OpenTelemetry
+// collector at exit, as OTLP/HTTP JSON. A nil tracer, for runs without an
+// OTLP endpoint, records nothing.
+type tracer struct {
+	endpoint string
+	service  string
+	traceID  [16]byte
+	parentID [8]byte // from TRACEPARENT, if the caller is traced
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+// span is one timed step of the run.
+type span struct {
+	t      *tracer
+	id     [8]byte
+	parent [8]byte
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]interface{}
+	err    string
+}
+
+// newTracer returns a tracer for the endpoint in the standard OTLP variables,
+// or nil if they don't name one. A W3C TRACEPARENT in the environment makes
+// the run part of the caller's trace.
+func newTracer() (*tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" && p != "http/json" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL %q is not supported (only http/json)", p)
+	}
+	t := &tracer{endpoint: endpoint, service: os.Getenv("OTEL_SERVICE_NAME")}
+	if t.service == "" {
+		t.service = "minictr"
+	}
+	if tp := os.Getenv("TRACEPARENT"); tp != "" {
+		// version-traceid-parentid-flags
+		parts := strings.Split(tp, "-")
+		traceID, err1 := hex.DecodeString(safeIndex(parts, 1))
+		parentID, err2 := hex.DecodeString(safeIndex(parts, 2))
+		if len(parts) != 4 || err1 != nil || err2 != nil || len(traceID) != 16 || len(parentID) != 8 {
+			return nil, fmt.Errorf("invalid TRACEPARENT %q", tp)
+		}
+		copy(t.traceID[:], traceID)
+		copy(t.parentID[:], parentID)
+	} else if _, err := rand.Read(t.traceID[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// safeIndex returns parts[i], or "" if there aren't that many.
+func safeIndex(parts []string, i int) string {
+	if i < len(parts) {
+		return parts[i]
+	}
+	return ""
+}
+
+// start begins a span under parent, or under the caller's span for the run's
+// root.
+func (t *tracer) start(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{t: t, name: name, start: time.Now(), attrs: make(map[string]interface{}), parent: t.parentID}
+	rand.Read(s.id[:])
+	if parent != nil {
+		s.parent = parent.id
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// set records an attribute: a string, an int or a bool.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.attrs[key] = value
+	s.t.mu.Unlock()
+}
+
+// fail marks the span as failed, with err as why.
+func (s *span) fail(err string) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.err = err
+	s.t.mu.Unlock()
+}
+
+// finish ends the span, once.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	s.t.mu.Unlock()
+}
+
+// export sends the spans so far, ending any still open.
+func (t *tracer) export(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, traceExportTimeout)
+	defer cancel()
+
+	// 1) Encode them as an OTLP ExportTraceServiceRequest
+	t.mu.Lock()
+	spans := make([]map[string]interface{}, 0, len(t.spans))
+	now := time.Now()
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			s.end = now
+		}
+		js := map[string]interface{}{
+			"traceId":           hex.EncodeToString(t.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              SPAN_KIND_INTERNAL,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			js["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			js["status"] = map[string]interface{}{"code": STATUS_CODE_ERROR, "message": s.err}
+		}
+		spans = append(spans, js)
+	}
+	t.mu.Unlock()
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "minictr"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2) Post them to the collector
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// otlpAttributes encodes attributes as OTLP KeyValues.
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	kvs := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, map[string]interface{}{"key": k, "value": value})
+	}
+	return kvs
+}
@@ -0,0 +1,216 @@
+// ttyrecord.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// ttySession runs the container on a terminal of its own and relays it to
+// ours, recording what the container shows, and when, as an asciicast v2 file
+// that asciinema can replay: a JSON header line, then [seconds, "o", text]
+// for output and [seconds, "r", "COLSxROWS"] for resizes. Keystrokes are not
+// recorded, so neither are passwords typed without echo.
+type ttySession struct {
+	master, slave *os.File
+	saved         syscall.Termios
+	cast          *os.File
+	started       time.Time
+	winch         chan os.Signal
+
+	mu      sync.Mutex
+	partial []byte // the start of a UTF-8 character split across reads
+	failed  bool
+	done    chan struct{}
+}
+
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+// newTTYSession opens the container's terminal, sized like ours. Its slave
+// is the container's stdio; the relay starts with start.
+func newTTYSession() (*ttySession, error) {
+	if !isTerminal(0) || !isTerminal(1) {
+		return nil, fmt.Errorf("--record-tty needs stdin and stdout to be a terminal")
+	}
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	s := &ttySession{master: master, slave: slave, done: make(chan struct{})}
+	s.resize()
+	return s, nil
+}
+
+// castPath returns where the session of the container with this PID is
+// recorded.
+func castPath(pid int) string {
+	return filepath.Join(logsDir, strconv.Itoa(pid)+".cast")
+}
+
+// start begins the recording and the relay, once the container holds the
+// slave: our terminal goes raw, so that keys like ^C reach the container's.
+func (s *ttySession) start(pid int) error {
+	// 1) The recording and its header
+	if err := os.MkdirAll(logsDir, 0700); err != nil {
+		return err
+	}
+	path := castPath(pid)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	s.cast, s.started = f, time.Now()
+	ws, _ := getWinsize(0)
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     ws.Col,
+		"height":    ws.Row,
+		"timestamp": s.started.Unix(),
+		"env":       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	// 2) Our terminal raw, and put back by close
+	if err := ioctlTermios(0, syscall.TCGETS, &s.saved); err != nil {
+		f.Close()
+		return fmt.Errorf("get terminal attributes: %w", err)
+	}
+	raw := s.saved
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := ioctlTermios(0, syscall.TCSETS, &raw); err != nil {
+		f.Close()
+		return fmt.Errorf("set terminal attributes: %w", err)
+	}
+	logInfof("recording the terminal session to %s", path)
+
+	// 3) The relay both ways, and our window size as it changes
+	s.winch = make(chan os.Signal, 1)
+	signal.Notify(s.winch, syscall.SIGWINCH)
+	go func() {
+		for range s.winch {
+			if ws, ok := s.resize(); ok {
+				s.record("r", fmt.Sprintf("%dx%d", ws.Col, ws.Row))
+			}
+		}
+	}()
+	go io.Copy(s.master, os.Stdin)
+	go func() {
+		defer close(s.done)
+		buf := make([]byte, 32*1024)
+		for {
+			// EIO once every process holding the slave has exited
+			n, err := s.master.Read(buf)
+			if n > 0 {
+				os.Stdout.Write(buf[:n])
+				s.record("o", string(buf[:n]))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// resize gives the container's terminal the size of ours.
+func (s *ttySession) resize() (winsize, bool) {
+	ws, err := getWinsize(0)
+	if err != nil {
+		return ws, false
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, s.master.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	return ws, errno == 0
+}
+
+// record appends one event, holding back a character split across reads
+// for the next one, since the text has to be valid UTF-8.
+func (s *ttySession) record(kind, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	if kind == "o" {
+		b := append(s.partial, text...)
+		end := len(b)
+		for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i]) {
+				if !utf8.FullRune(b[i:]) {
+					end = i
+				}
+				break
+			}
+		}
+		s.partial = append([]byte(nil), b[end:]...)
+		text = string(b[:end])
+		if text == "" {
+			return
+		}
+	}
+	s.writeLocked(kind, text)
+}
+
+func (s *ttySession) writeLocked(kind, text string) {
+	data, _ := json.Marshal(text)
+	if _, err := fmt.Fprintf(s.cast, "[%.6f, %q, %s]\n", time.Since(s.started).Seconds(), kind, data); err != nil {
+		s.failed = true
+		logWarnf("failed to record the terminal session: %v", err)
+	}
+}
+
+// close waits for the last of the container's output once it has exited,
+// then puts our terminal back as it was.
+func (s *ttySession) close() {
+	if s == nil {
+		return
+	}
+	if s.cast != nil {
+		<-s.done
+		signal.Stop(s.winch)
+		close(s.winch)
+		ioctlTermios(0, syscall.TCSETS, &s.saved)
+		// A character the container never finished is recorded as U+FFFD
+		s.mu.Lock()
+		if len(s.partial) > 0 && !s.failed {
+			s.writeLocked("o", string(s.partial))
+		}
+		s.mu.Unlock()
+		s.cast.Close()
+	}
+	s.master.Close()
+}
+
+func getWinsize(fd int) (winsize, error) {
+	var ws winsize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return ws, errno
+	}
+	return ws, nil
+}
+
+func ioctlTermios(fd int, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
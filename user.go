@@ -0,0 +1,200 @@
+// user.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	PR_SET_PDEATHSIG = 1
+	PR_SET_KEEPCAPS  = 8
+)
+
+// containerUser is who the workload runs as, resolved from a --user spec.
+type containerUser struct {
+	UID, GID int
+	Groups   []int
+	Home     string
+}
+
+// parseUserSpec checks a --user value, user[:group], where either part is a
+// name or a numeric ID. Names are only resolved inside the container.
+func parseUserSpec(spec string) error {
+	user, group, hasGroup := strings.Cut(spec, ":")
+	if user == "" || (hasGroup && group == "") || strings.Contains(group, ":") {
+		return fmt.Errorf("%q (want user[:group], e.g. 1000:1000 or nobody)", spec)
+	}
+	return nil
+}
+
+// lookupUser resolves a --user spec against the container's /etc/passwd and
+// /etc/group, the way Docker does: a name has to exist, a numeric UID needn't,
+// the group defaults to the user's primary group (or 0), and the user keeps
+// the supplementary groups /etc/group lists them in.
+func lookupUser(spec string) (*containerUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	u := &containerUser{Home: "/"}
+
+	// 1) The user, and from its passwd entry the primary group and home
+	name := ""
+	uid, err := strconv.Atoi(userPart)
+	numeric := err == nil
+	entry, err := findEntry("/etc/passwd", func(f []string) bool {
+		if numeric {
+			return len(f) >= 3 && f[2] == userPart
+		}
+		return f[0] == userPart
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	switch {
+	case entry != nil && len(entry) >= 6:
+		name = entry[0]
+		if u.UID, err = strconv.Atoi(entry[2]); err != nil {
+			return nil, fmt.Errorf("bad UID in /etc/passwd entry for %q", name)
+		}
+		if u.GID, err = strconv.Atoi(entry[3]); err != nil {
+			return nil, fmt.Errorf("bad GID in /etc/passwd entry for %q", name)
+		}
+		if entry[5] != "" {
+			u.Home = entry[5]
+		}
+	case numeric:
+		u.UID = uid
+	default:
+		return nil, fmt.Errorf("no user %q in the container's /etc/passwd", userPart)
+	}
+
+	// 2) An explicit group
+	if hasGroup {
+		if gid, err := strconv.Atoi(groupPart); err == nil {
+			u.GID = gid
+		} else {
+			entry, err := findEntry("/etc/group", func(f []string) bool { return f[0] == groupPart })
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if entry == nil || len(entry) < 3 {
+				return nil, fmt.Errorf("no group %q in the container's /etc/group", groupPart)
+			}
+			if u.GID, err = strconv.Atoi(entry[2]); err != nil {
+				return nil, fmt.Errorf("bad GID in /etc/group entry for %q", groupPart)
+			}
+		}
+	}
+
+	// 3) Supplementary groups naming the user as a member
+	if name != "" {
+		f, err := os.Open("/etc/group")
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				fields := strings.Split(scanner.Text(), ":")
+				if len(fields) < 4 || !contains(strings.Split(fields[3], ","), name) {
+					continue
+				}
+				if gid, err := strconv.Atoi(fields[2]); err == nil && gid != u.GID {
+					u.Groups = append(u.Groups, gid)
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// findEntry returns the fields of the first line in a colon-separated
+// database like /etc/passwd that match reports true for.
+func findEntry(path string, match func([]string) bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, ":"); match(fields) {
+			return fields, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// switchUser changes this thread's credentials to u: supplementary groups
+// first and the UID last, as each step needs the privileges the next one
+// gives up. The capabilities are kept across the UID change so that they
+// can still be dropped to the container's set afterwards; the exec then
+// clears them for a non-root user, as it does under Docker.
+func switchUser(u *containerUser) error {
+	runtime.LockOSThread()
+
+	// 1) Supplementary groups, unless the user namespace forbids setgroups
+	//    (an unprivileged map without the helpers)
+	if b, err := os.ReadFile("/proc/self/setgroups"); err == nil && strings.TrimSpace(string(b)) == "deny" {
+		if len(u.Groups) > 0 {
+			logWarnf("can't set supplementary groups %v in this user namespace", u.Groups)
+		}
+	} else {
+		groups := make([]uint32, len(u.Groups))
+		for i, g := range u.Groups {
+			groups[i] = uint32(g)
+		}
+		var p unsafe.Pointer
+		if len(groups) > 0 {
+			p = unsafe.Pointer(&groups[0])
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(groups)), uintptr(p), 0); errno != 0 {
+			return fmt.Errorf("setgroups %v: %w", u.Groups, errno)
+		}
+	}
+
+	// 2) GID, then UID
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESGID, uintptr(u.GID), uintptr(u.GID), uintptr(u.GID)); errno == syscall.EINVAL {
+		return fmt.Errorf("GID %d is not mapped in the container's user namespace", u.GID)
+	} else if errno != 0 {
+		return fmt.Errorf("setgid %d: %w", u.GID, errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+		return fmt.Errorf("set keepcaps: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, uintptr(u.UID), uintptr(u.UID), uintptr(u.UID)); errno == syscall.EINVAL {
+		return fmt.Errorf("UID %d is not mapped in the container's user namespace", u.UID)
+	} else if errno != 0 {
+		return fmt.Errorf("setuid %d: %w", u.UID, errno)
+	}
+
+	// 3) Leaving UID 0 cleared the effective set; raise it again from the
+	//    permitted set we kept
+	hdr := struct {
+		Version uint32
+		Pid     int32
+	}{Version: _LINUX_CAPABILITY_VERSION_3}
+	var data [2]struct{ Effective, Permitted, Inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %w", errno)
+	}
+	for i := range data {
+		data[i].Effective = data[i].Permitted
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+
+	// 4) Changing credentials also cleared the parent death signal
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0); errno != 0 {
+		return fmt.Errorf("set parent death signal: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// userns.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// idMap is one line of /proc/<pid>/uid_map or gid_map: Size IDs starting at
+// Container inside the user namespace are Host outside it.
+type idMap struct {
+	Container, Host, Size int
+}
+
+func (m idMap) String() string {
+	return fmt.Sprintf("%d %d %d", m.Container, m.Host, m.Size)
+}
+
+// parseIDMap parses a --uidmap/--gidmap container:host:size triple.
+func parseIDMap(spec string) (idMap, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return idMap{}, fmt.Errorf("%q: want container:host:size", spec)
+	}
+	var ids [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return idMap{}, fmt.Errorf("%q: invalid ID %q", spec, p)
+		}
+		ids[i] = n
+	}
+	if ids[2] == 0 {
+		return idMap{}, fmt.Errorf("%q: size must be at least 1", spec)
+	}
+	return idMap{ids[0], ids[1], ids[2]}, nil
+}
+
+// containerID translates a host ID into the namespace described by maps.
+func containerID(maps []idMap, host int) (int, bool) {
+	for _, m := range maps {
+		if host >= m.Host && host < m.Host+m.Size {
+			return m.Container + host - m.Host, true
+		}
+	}
+	return 0, false
+}
+
+// hostID translates an ID inside the namespace described by maps to the host.
+func hostID(maps []idMap, container int) (int, bool) {
+	for _, m := range maps {
+		if container >= m.Container && container < m.Container+m.Size {
+			return m.Host + container - m.Container, true
+		}
+	}
+	return 0, false
+}
+
+// rootlessIDMaps returns the mappings for an unprivileged run: the invoking
+// user becomes root in the container and, when newuidmap/newgidmap are
+// installed, the user's /etc/subuid and /etc/subgid ranges provide the IDs
+// from 1 up. Without them the container has a single user and group.
+func rootlessIDMaps() (uids, gids []idMap) {
+	uid, gid := os.Getuid(), os.Getgid()
+	uids = []idMap{{0, uid, 1}}
+	gids = []idMap{{0, gid, 1}}
+
+	name := strconv.Itoa(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	if _, err := exec.LookPath("newuidmap"); err == nil {
+		if start, count, ok := subordinateRange("/etc/subuid", name, uid); ok {
+			uids = append(uids, idMap{1, start, count})
+		}
+	}
+	if _, err := exec.LookPath("newgidmap"); err == nil {
+		if start, count, ok := subordinateRange("/etc/subgid", name, uid); ok {
+			gids = append(gids, idMap{1, start, count})
+		}
+	}
+	return uids, gids
+}
+
+// subordinateRange finds the first name:start:count entry for the user,
+// given by name or numeric ID, in /etc/subuid or /etc/subgid.
+func subordinateRange(path, name string, id int) (int, int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil && count > 0 {
+			return start, count, true
+		}
+	}
+	return 0, 0, false
+}
+
+// idMapsDirect reports whether the mappings can be written to the proc files
+// directly, which root may always do and other users only for their own IDs.
+// Those are handed to the kernel before the child execs; wider unprivileged
+// mappings go through the setuid newuidmap/newgidmap helpers after it started
+// (see writeIDMapsWithHelpers).
+func idMapsDirect(uids, gids []idMap) bool {
+	return os.Geteuid() == 0 || len(uids) == 1 && len(gids) == 1
+}
+
+func sysProcIDMaps(maps []idMap) []syscall.SysProcIDMap {
+	var out []syscall.SysProcIDMap
+	for _, m := range maps {
+		out = append(out, syscall.SysProcIDMap{ContainerID: m.Container, HostID: m.Host, Size: m.Size})
+	}
+	return out
+}
+
+// writeIDMapsWithHelpers installs pid's mappings with newuidmap and newgidmap,
+// which check the ranges against /etc/subuid and /etc/subgid.
+func writeIDMapsWithHelpers(pid int, uids, gids []idMap) error {
+	if err := runIDMapHelper("newuidmap", pid, uids); err != nil {
+		return err
+	}
+	return runIDMapHelper("newgidmap", pid, gids)
+}
+
+// lostCapabilities reports whether we hold no effective capabilities, as
+// happens to a child exec'd before newuidmap has mapped its IDs. They only
+// come back with another exec once the maps are there.
+func lostCapabilities() bool {
+	hdr := struct {
+		Version uint32
+		Pid     int32
+	}{Version: _LINUX_CAPABILITY_VERSION_3}
+	var data [2]struct{ Effective, Permitted, Inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return false
+	}
+	return data[0].Effective == 0 && data[1].Effective == 0
+}
+
+func runIDMapHelper(helper string, pid int, maps []idMap) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.Container), strconv.Itoa(m.Host), strconv.Itoa(m.Size))
+	}
+	if out, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", helper, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// webhook.go
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookAttempts is how often an event is posted before giving up, with
+	// webhookBackoff doubling between attempts.
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+	webhookTimeout  = 5 * time.Second
+	// webhookDrainTimeout bounds how long the runtime waits at exit for
+	// events still being delivered.
+	webhookDrainTimeout = 15 * time.Second
+)
+
+// webhookEvent is the JSON body of a --webhook POST.
+type webhookEvent struct {
+	Type       string                 `json:"type"` // start, health, oom or die
+	Container  int                    `json:"container"`
+	Time       time.Time              `json:"time"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// webhooks posts the container's lifecycle events to --webhook endpoints.
+// With a secret, each request is signed with HMAC-SHA256 over its body in
+// X-Minictr-Signature, as sha256=<hex>. A nil webhooks sends nothing.
+type webhooks struct {
+	urls    []string
+	secret  []byte
+	client  *http.Client
+	pending sync.WaitGroup
+}
+
+// newWebhooks checks the endpoints. It returns nil if there are none.
+func newWebhooks(urls []string, secret []byte) (*webhooks, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("%q is not an http or https URL", u)
+		}
+	}
+	return &webhooks{urls: urls, secret: secret, client: &http.Client{Timeout: webhookTimeout}}, nil
+}
+
+// send posts an event to every endpoint in the background.
+func (w *webhooks) send(typ string, pid int, attrs map[string]interface{}) {
+	if w == nil {
+		return
+	}
+	body, err := json.Marshal(webhookEvent{Type: typ, Container: pid, Time: time.Now().UTC(), Attributes: attrs})
+	if err != nil {
+		logWarnf("webhook: %v", err)
+		return
+	}
+	// One delivery ID for all attempts, so that receivers can drop repeats
+	id := make([]byte, 16)
+	rand.Read(id)
+	for _, u := range w.urls {
+		w.pending.Add(1)
+		go func(u string) {
+			defer w.pending.Done()
+			if err := w.deliver(u, typ, hex.EncodeToString(id), body); err != nil {
+				logWarnf("webhook %s: %s event not delivered: %v", u, typ, err)
+			}
+		}(u)
+	}
+}
+
+// deliver posts body to u, retrying failed connections, server errors and
+// 429s with backoff.
+func (w *webhooks) deliver(u, typ, id string, body []byte) error {
+	backoff := webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = w.post(u, typ, id, body); err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one attempt, reporting whether a failure is worth retrying.
+func (w *webhooks) post(u, typ, id string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Minictr-Event", typ)
+	req.Header.Set("X-Minictr-Delivery", id)
+	if w.secret != nil {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-Minictr-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("%s", resp.Status)
+	}
+	return false, nil
+}
+
+// wait waits for the events still being delivered, up to
+// webhookDrainTimeout.
+func (w *webhooks) wait() {
+	if w == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(webhookDrainTimeout):
+		logWarnf("webhook: gave up on events still being delivered after %s", webhookDrainTimeout)
+	}
+}
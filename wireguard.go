@@ -0,0 +1,148 @@
+// wireguard.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// wgConfig is a wg-quick style configuration split into the part understood by
+// "wg setconf" and the wg-quick extensions we apply ourselves.
+type wgConfig struct {
+	Addresses  []string // [Interface] Address=
+	MTU        int      // [Interface] MTU=
+	AllowedIPs []string // union of every [Peer] AllowedIPs=, used as routes
+	Stripped   string   // config with the wg-quick-only keys removed
+}
+
+// wgQuickKeys are wg-quick extensions that "wg setconf" rejects.
+var wgQuickKeys = map[string]bool{
+	"address": true, "dns": true, "mtu": true, "table": true, "saveconfig": true,
+	"preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+// parseWGConfig reads a wg-quick style config file.
+func parseWGConfig(path string) (*wgConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &wgConfig{}
+	var stripped strings.Builder
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			stripped.WriteString(line + "\n")
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+
+		switch {
+		case section == "interface" && key == "address":
+			cfg.Addresses = append(cfg.Addresses, splitList(value)...)
+		case section == "interface" && key == "mtu":
+			if cfg.MTU, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid MTU %q", path, lineNo, value)
+			}
+		case section == "peer" && key == "allowedips":
+			cfg.AllowedIPs = append(cfg.AllowedIPs, splitList(value)...)
+		}
+		if section == "interface" && wgQuickKeys[key] {
+			continue
+		}
+		stripped.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("%s: [Interface] has no Address", path)
+	}
+	cfg.Stripped = stripped.String()
+	return cfg, nil
+}
+
+// setupWireGuard gives the container a wg0 interface configured from cfg.
+// The device is created in the host netns and then moved into the container,
+// so its encrypted UDP socket stays on the host while the container only
+// sees the overlay address.
+func setupWireGuard(pid int, cfg *wgConfig) error {
+	hostIf := fmt.Sprintf("mwg%d", pid)
+	if err := runIP("link", "add", hostIf, "type", "wireguard"); err != nil {
+		return err
+	}
+
+	setconf := exec.Command("wg", "setconf", hostIf, "/dev/stdin")
+	setconf.Stdin = strings.NewReader(cfg.Stripped)
+	if out, err := setconf.CombinedOutput(); err != nil {
+		runIP("link", "del", hostIf)
+		return fmt.Errorf("wg setconf %s: %v: %s", hostIf, err, strings.TrimSpace(string(out)))
+	}
+	if err := runIP("link", "set", hostIf, "netns", strconv.Itoa(pid)); err != nil {
+		runIP("link", "del", hostIf)
+		return err
+	}
+
+	// From here on the device lives and dies with the container's netns
+	return withNetns(pid, func() error {
+		if err := runIP("link", "set", hostIf, "name", "wg0"); err != nil {
+			return err
+		}
+		for _, addr := range cfg.Addresses {
+			if err := runIP("addr", "add", addr, "dev", "wg0"); err != nil {
+				return err
+			}
+		}
+		up := []string{"link", "set", "wg0", "up"}
+		if cfg.MTU > 0 {
+			up = append(up, "mtu", strconv.Itoa(cfg.MTU))
+		}
+		if err := runIP(up...); err != nil {
+			return err
+		}
+		for _, cidr := range cfg.AllowedIPs {
+			dest := cidr
+			if cidr == "0.0.0.0/0" || cidr == "::/0" {
+				dest = "default"
+			}
+			route := []string{"route", "replace", dest, "dev", "wg0"}
+			if strings.Contains(cidr, ":") {
+				route = append([]string{"-6"}, route...)
+			}
+			if err := runIP(route...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}